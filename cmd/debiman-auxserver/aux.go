@@ -14,6 +14,7 @@ import (
 	"github.com/stapelberg/debiman/internal/aux"
 	"github.com/stapelberg/debiman/internal/bundled"
 	"github.com/stapelberg/debiman/internal/commontmpl"
+	"github.com/stapelberg/debiman/internal/distro"
 	"github.com/stapelberg/debiman/internal/redirect"
 )
 
@@ -33,6 +34,10 @@ var (
 	baseURL = flag.String("base_url",
 		"https://manpages.debian.org",
 		"Base URL (without trailing slash) to the site. Used where absolute URLs are required, e.g. sitemaps.")
+
+	distribution = flag.String("distribution",
+		"debian",
+		"Distribution profile: debian, ubuntu or the path to a JSON-encoded profile (see internal/distro). Must match the -distribution flag of debiman.")
 )
 
 // use go build -ldflags "-X main.debimanVersion=<version>" to set the version
@@ -41,6 +46,12 @@ var debimanVersion = "HEAD"
 func main() {
 	flag.Parse()
 
+	profile, err := distro.Load(*distribution)
+	if err != nil {
+		log.Fatal(err)
+	}
+	distro.Set(profile)
+
 	log.Printf("debiman auxserver loading index from %q", *indexPath)
 
 	if *injectAssets != "" {
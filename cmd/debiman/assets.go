@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/bundled"
+	"github.com/stapelberg/debiman/internal/write"
+)
+
+var assetRerenderLimit = flag.Int("asset_rerender_limit",
+	2000,
+	"When the page templates changed since the last run (a new debiman version or different -inject_assets), the manpages of at most this many packages are re-rendered per run to apply the change, most important packages first. Renderings of new formats (e.g. text) are added to the manpages of at most this many packages per run as well. 0 means no limit.")
+
+// pageAssets are the assets from which manpages and package index pages
+// are rendered. style.css is inlined by header.tmpl. Other assets (e.g.
+// status.tmpl) do not require re-rendering the pages when they change.
+var pageAssets = []string{
+	"header.tmpl",
+	"footer.tmpl",
+	"style.css",
+	"manpage.tmpl",
+	"manpageerror.tmpl",
+	"manpagefooterextra.tmpl",
+	"pkgindex.tmpl",
+	"srcpkgindex.tmpl",
+}
+
+// assetsFingerprint identifies the page assets (bundled or injected via
+// -inject_assets) and the debiman version.
+func assetsFingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "debiman %s\n", debimanVersion)
+	for _, name := range pageAssets {
+		content := bundled.Asset(name)
+		fmt.Fprintf(h, "%s %d\n%s", name, len(content), content)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// outputsFingerprint identifies the formats which manpages are rendered
+// to next to their HTML page.
+func outputsFingerprint() string {
+	if *renderMarkdown {
+		return "txt md"
+	}
+	return "txt"
+}
+
+// assetState tracks re-rendering the manpages after the assets changed.
+// Packages are re-rendered in order of importance (see importanceOrder),
+// at most -asset_rerender_limit per run, so that a template change does
+// not result in one very long run.
+//
+// Adding renderings of new formats (see outputsFingerprint) to existing
+// manpages is tracked the same way.
+type assetState struct {
+	path string
+	// change describes what re-rendering applies, e.g. “changed
+	// assets”.
+	change string
+
+	Fingerprint string `json:"fingerprint"`
+	// Since is the time at which Fingerprint was first encountered.
+	// Pages rendered before are stale.
+	Since    time.Time `json:"since"`
+	Complete bool      `json:"complete"`
+	// Done contains the packages (suite/binarypkg) which were
+	// re-rendered since Fingerprint was first encountered. It is
+	// cleared once all packages were re-rendered.
+	Done []string `json:"done,omitempty"`
+
+	// scheduled contains the packages to re-render in this run and last
+	// is true if they are the last packages to re-render.
+	scheduled map[string]bool
+	last      bool
+}
+
+// loadAssetState loads the state of path. If fingerprint differs from
+// the recorded fingerprint, re-rendering all manpages is started over.
+func loadAssetState(path, change, fingerprint string, now time.Time) (*assetState, error) {
+	s := &assetState{path: path, change: change}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(s); err != nil {
+			return nil, err
+		}
+	}
+	if s.Fingerprint != fingerprint {
+		if s.Fingerprint != "" {
+			log.Printf("Scheduling re-rendering all manpages to apply %s (previous state from %s)", change, s.Since.Format(time.RFC3339))
+		}
+		*s = assetState{
+			path:        path,
+			change:      change,
+			Fingerprint: fingerprint,
+			Since:       now,
+		}
+	}
+	return s, nil
+}
+
+// importanceOrder returns all packages (suite/binarypkg) of gv, most
+// important first: the default suite, then all other suites from newest
+// to oldest, each in sitemap order.
+func importanceOrder(gv globalView) []string {
+	rank := make(map[string]int, len(gv.suiteOrder))
+	for idx, suite := range gv.suiteOrder {
+		rank[suite] = idx + 1
+	}
+	rank[gv.defaultSuite] = len(gv.suiteOrder) + 1
+	seen := make(map[string]bool, len(gv.pkgs))
+	pkgs := make([]*pkgEntry, 0, len(gv.pkgs))
+	for _, p := range gv.pkgs {
+		key := p.suite + "/" + p.binarypkg
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		pkgs = append(pkgs, p)
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		if ri, rj := rank[pkgs[i].suite], rank[pkgs[j].suite]; ri != rj {
+			return ri > rj
+		}
+		if pkgs[i].suite != pkgs[j].suite {
+			return pkgs[i].suite < pkgs[j].suite
+		}
+		return pkgs[i].binarypkg < pkgs[j].binarypkg
+	})
+	order := make([]string, len(pkgs))
+	for idx, p := range pkgs {
+		order[idx] = p.suite + "/" + p.binarypkg
+	}
+	return order
+}
+
+// schedule selects the first limit packages of order (all if limit is
+// 0) which were not re-rendered yet for re-rendering in this run.
+// Packages whose pages were all rendered after Since for another
+// reason (e.g. a new version) are selected as well: determining that
+// would require listing every package directory in every run.
+func (s *assetState) schedule(order []string, limit int) {
+	if s.Complete {
+		return
+	}
+	done := make(map[string]bool, len(s.Done))
+	for _, key := range s.Done {
+		done[key] = true
+	}
+	s.scheduled = make(map[string]bool)
+	s.last = true
+	for _, key := range order {
+		if done[key] {
+			continue
+		}
+		if limit > 0 && len(s.scheduled) == limit {
+			s.last = false
+			break
+		}
+		s.scheduled[key] = true
+	}
+	log.Printf("Re-rendering %d packages to apply %s", len(s.scheduled), s.change)
+}
+
+// stale returns whether a page last rendered at modTime needs to be
+// re-rendered to apply changed assets.
+func (s *assetState) stale(modTime time.Time) bool {
+	return s != nil && !s.Complete && modTime.Before(s.Since)
+}
+
+// stalePackage returns whether a page of pkg (suite/binarypkg), i.e. a
+// manpage or the package index, last rendered at modTime should be
+// re-rendered in this run to apply changed assets.
+func (s *assetState) stalePackage(pkg string, modTime time.Time) bool {
+	return s.stale(modTime) && s.scheduled[pkg]
+}
+
+// staleSource returns whether the index page of a source package in
+// suite, which consists of binaries, last rendered at modTime should be
+// re-rendered in this run to apply changed assets. It is re-rendered
+// along with the first of its binary packages.
+func (s *assetState) staleSource(suite string, binaries []string, modTime time.Time) bool {
+	if !s.stale(modTime) {
+		return false
+	}
+	for _, binary := range binaries {
+		if s.scheduled[suite+"/"+binary] {
+			return true
+		}
+	}
+	return false
+}
+
+// due returns whether renderings of pkg (suite/binarypkg) which are
+// missing next to up-to-date HTML pages should be added in this run.
+// Once all packages were scheduled, they are added in every run.
+func (s *assetState) due(pkg string) bool {
+	return s == nil || s.Complete || s.scheduled[pkg]
+}
+
+// advance records that all scheduled packages were re-rendered.
+func (s *assetState) advance() error {
+	if s == nil || s.Complete {
+		return nil
+	}
+	for key := range s.scheduled {
+		s.Done = append(s.Done, key)
+	}
+	sort.Strings(s.Done)
+	s.Complete = s.last
+	if s.Complete {
+		log.Printf("All manpages re-rendered to apply %s", s.change)
+		s.Done = nil
+	}
+	return write.Atomically(s.path, false, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(s)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/bundled"
+)
+
+func TestImportanceOrder(t *testing.T) {
+	gv := globalView{
+		pkgs: []*pkgEntry{
+			{suite: "unstable", binarypkg: "zsh"},
+			{suite: "stretch", binarypkg: "zsh"},
+			{suite: "jessie", binarypkg: "bash"},
+			{suite: "stretch", binarypkg: "bash"},
+			{suite: "unstable", binarypkg: "bash"},
+			{suite: "unstable", binarypkg: "bash"}, // another architecture
+		},
+		suiteOrder:   []string{"jessie", "stretch", "unstable"},
+		defaultSuite: "stretch",
+	}
+	got := importanceOrder(gv)
+	want := []string{
+		"stretch/bash",
+		"stretch/zsh",
+		"unstable/bash",
+		"unstable/zsh",
+		"jessie/bash",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("importanceOrder() = %q, want %q", got, want)
+	}
+}
+
+func TestAssetState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "assets.json")
+
+	order := []string{"stretch/bash", "stretch/zsh", "unstable/bash"}
+	first := time.Now().Add(-1 * time.Hour)
+	before := first.Add(-1 * time.Minute)
+	// rendered contains the time at which the manpages of each package
+	// were last rendered.
+	rendered := make(map[string]time.Time)
+	for _, pkg := range order {
+		rendered[pkg] = before
+	}
+
+	run := func(fingerprint string, now time.Time) *assetState {
+		s, err := loadAssetState(path, "changed assets", fingerprint, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.schedule(order, 2)
+		return s
+	}
+	// render re-renders the scheduled packages at now.
+	render := func(s *assetState, now time.Time) []string {
+		var pkgs []string
+		for _, pkg := range order {
+			if s.stalePackage(pkg, rendered[pkg]) {
+				pkgs = append(pkgs, pkg)
+				rendered[pkg] = now
+			}
+		}
+		return pkgs
+	}
+
+	s := run("a", first)
+	if s.stalePackage("stretch/bash", first.Add(1*time.Minute)) {
+		t.Errorf("page rendered after the assets changed is stale")
+	}
+	// stretch/zsh was re-rendered for another reason, e.g. a new version.
+	rendered["stretch/zsh"] = first.Add(1 * time.Minute)
+	if got, want := render(s, first.Add(2*time.Minute)), []string{"stretch/bash"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("first run: re-rendered %q, want %q", got, want)
+	}
+	if !s.due("stretch/zsh") || s.due("unstable/bash") {
+		t.Errorf("due(stretch/zsh) = %v, due(unstable/bash) = %v, want true, false", s.due("stretch/zsh"), s.due("unstable/bash"))
+	}
+	if !s.staleSource("stretch", []string{"bash-doc", "bash"}, before) {
+		t.Errorf("source index of a scheduled package not stale")
+	}
+	if err := s.advance(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The remaining package is scheduled in the next run.
+	s = run("a", time.Now())
+	if got, want := render(s, time.Now()), []string{"unstable/bash"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("second run: re-rendered %q, want %q", got, want)
+	}
+	if s.stalePackage("stretch/bash", before) {
+		t.Errorf("package re-rendered in the previous run scheduled again")
+	}
+	if s.staleSource("stretch", []string{"bash"}, before) {
+		t.Errorf("source index of a package which is not scheduled is stale")
+	}
+	if err := s.advance(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = run("a", time.Now())
+	if got := render(s, time.Now()); len(got) > 0 {
+		t.Fatalf("third run: re-rendered %q, want none", got)
+	}
+	if s.stale(before) {
+		t.Errorf("pages stale after re-rendering completed")
+	}
+	if !s.due("stretch/bash") {
+		t.Errorf("missing renderings not due after re-rendering completed")
+	}
+	if len(s.Done) > 0 {
+		t.Errorf("re-rendered packages still recorded after re-rendering completed: %q", s.Done)
+	}
+
+	s = run("b", time.Now().Add(1*time.Minute))
+	if got, want := render(s, time.Now().Add(2*time.Minute)), []string{"stretch/bash", "stretch/zsh"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after changing assets: re-rendered %q, want %q", got, want)
+	}
+}
+
+func TestPageAssets(t *testing.T) {
+	for _, name := range pageAssets {
+		if bundled.Asset(name) == "" {
+			t.Errorf("page asset %q does not exist", name)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/write"
+)
+
+var deleteGracePeriod = flag.Duration("delete_grace_period",
+	24*time.Hour,
+	"How long files which are no longer present in the archive are kept in -serving_dir before they are deleted. Must be longer than it takes to deploy a new auxserver index, so that no redirects to deleted files are served.")
+
+// pendingDeletions tracks paths (relative to -serving_dir) which were
+// found to be no longer present in the archive. The paths are only
+// deleted once -delete_grace_period has passed, because an
+// already-running debiman-auxserver still serves redirects to them
+// until it loads the new index.
+type pendingDeletions struct {
+	path string
+
+	mu sync.Mutex
+	// since maps from path to the time at which the path was first
+	// found to be obsolete.
+	since map[string]time.Time
+}
+
+func loadPendingDeletions(path string) (*pendingDeletions, error) {
+	d := &pendingDeletions{
+		path:  path,
+		since: make(map[string]time.Time),
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return d, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&d.since); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *pendingDeletions) save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return write.Atomically(d.path, false, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(d.since)
+	})
+}
+
+// mark records that path is obsolete, unless it already was.
+func (d *pendingDeletions) mark(path string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.since[path]; !ok {
+		d.since[path] = now
+	}
+}
+
+// unmark records that path is present in the archive (again).
+func (d *pendingDeletions) unmark(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.since, path)
+}
+
+// isPackageDir returns whether path refers to a <suite>/<binarypkg>
+// (or <suite>/src:<sourcepkg>) directory, as opposed to an individual
+// file within such a directory.
+func isPackageDir(path string) bool {
+	return strings.Count(path, "/") == 1
+}
+
+// staleFiles returns all files within the package directory dir
+// (relative to -serving_dir) which were not written when extracting
+// the current version of the package. written contains the paths of
+// all manpages and auxiliary files which were extracted.
+func staleFiles(dir string, written map[string]bool) ([]string, error) {
+	var stale []string
+	err := walkFiles(dir, func(rel string) {
+		if filepath.Dir(rel) == dir {
+			base := filepath.Base(rel)
+			if base == "VERSION" || base == "index.html.gz" {
+				return
+			}
+			if suffix := renderedSuffix(base); suffix != "" {
+				// Rendered manpages are stale if and only if their
+				// source manpage is stale.
+				if written[strings.TrimSuffix(rel, suffix)+".gz"] {
+					return
+				}
+				stale = append(stale, rel)
+				return
+			}
+		}
+		if !written[rel] {
+			stale = append(stale, rel)
+		}
+	})
+	return stale, err
+}
+
+// walkFiles calls fn for all files (including symlinks) within the
+// directory dir (relative to -serving_dir), recursively, with their path
+// relative to -serving_dir.
+func walkFiles(dir string, fn func(rel string)) error {
+	infos, err := serving.ReadDir(filepath.Join(*servingDir, dir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		rel := filepath.Join(dir, fi.Name())
+		if fi.IsDir() {
+			if err := walkFiles(rel, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		fn(rel)
+	}
+	return nil
+}
+
+// obsoletePackageDirs returns all package directories (relative to
+// -serving_dir) of the suites in gv which do not correspond to a
+// binary or source package in gv.
+func obsoletePackageDirs(gv globalView) ([]string, error) {
+	present := make(map[string]bool, 2*len(gv.pkgs))
+	for _, p := range gv.pkgs {
+		present[p.suite+"/"+p.binarypkg] = true
+		present[p.suite+"/src:"+p.source] = true
+	}
+
+	var obsolete []string
+	for suite := range gv.suites {
+		infos, err := serving.ReadDir(filepath.Join(*servingDir, suite))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range infos {
+			if !fi.IsDir() {
+				continue // e.g. sitemap.xml.gz
+			}
+			dir := suite + "/" + fi.Name()
+			if present[dir] {
+				continue
+			}
+			obsolete = append(obsolete, dir)
+		}
+	}
+	sort.Strings(obsolete)
+	return obsolete, nil
+}
+
+// planCleanup updates d with the current state of -serving_dir and
+// returns the paths which have been obsolete for longer than
+// -delete_grace_period.
+func planCleanup(gv globalView, d *pendingDeletions, now time.Time) ([]string, error) {
+	dirs, err := obsoletePackageDirs(gv)
+	if err != nil {
+		return nil, err
+	}
+	obsolete := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		obsolete[dir] = true
+		d.mark(dir, now)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var due []string
+	for path, since := range d.since {
+		if isPackageDir(path) && !obsolete[path] {
+			// The package re-appeared in the archive.
+			delete(d.since, path)
+			continue
+		}
+		if _, err := serving.Lstat(filepath.Join(*servingDir, path)); os.IsNotExist(err) {
+			// Deleted already, e.g. as part of its package directory.
+			delete(d.since, path)
+			continue
+		}
+		if now.Sub(since) < *deleteGracePeriod {
+			continue
+		}
+		due = append(due, path)
+	}
+	sort.Strings(due)
+	return due, nil
+}
+
+// cleanup deletes packages and files which are no longer present in
+// the archive (see planCleanup).
+func cleanup(gv globalView, now time.Time) error {
+	due, err := planCleanup(gv, gv.deletions, now)
+	if err != nil {
+		return err
+	}
+	for _, path := range due {
+		log.Printf("Deleting %q, which is no longer present in the archive", path)
+		if err := serving.RemoveAll(filepath.Join(*servingDir, path)); err != nil {
+			return err
+		}
+		gv.deletions.unmark(path)
+		if isPackageDir(path) && !strings.HasPrefix(filepath.Base(path), "src:") {
+			atomic.AddUint64(&gv.stats.PackagesDeleted, 1)
+		}
+	}
+	return gv.deletions.save()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flag.Set("serving_dir", dir)
+
+	for _, path := range []string{
+		"testing/i3-wm/i3.1.en.gz",
+		"testing/i3-wm/i3.1.en.html.gz",
+		"testing/i3-wm/i3-old.1.en.gz",
+		"testing/i3-wm/i3-old.1.en.html.gz",
+		"testing/i3-wm/index.html.gz",
+		"testing/i3-wm/VERSION",
+		"testing/i3-wm/aux/usr/share/man/man1/old.inc.gz",
+		"testing/src:i3-wm/index.html.gz",
+		"testing/removed/removed.1.en.gz",
+		"testing/src:removed/index.html.gz",
+		"unstable/removed/removed.1.en.gz",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("staleFiles", func(t *testing.T) {
+		stale, err := staleFiles("testing/i3-wm", map[string]bool{
+			"testing/i3-wm/i3.1.en.gz": true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"testing/i3-wm/aux/usr/share/man/man1/old.inc.gz",
+			"testing/i3-wm/i3-old.1.en.gz",
+			"testing/i3-wm/i3-old.1.en.html.gz",
+		}
+		if got := stale; !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected staleFiles() result: got %v, want %v", got, want)
+		}
+	})
+
+	gv := globalView{
+		pkgs: []*pkgEntry{
+			{suite: "testing", binarypkg: "i3-wm", source: "i3-wm"},
+		},
+		suites:    map[string]bool{"testing": true},
+		deletions: &pendingDeletions{path: filepath.Join(dir, "deletions.json"), since: make(map[string]time.Time)},
+		stats:     &stats{},
+	}
+
+	start := time.Now()
+	due, err := planCleanup(gv, gv.deletions, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) > 0 {
+		t.Fatalf("planCleanup() unexpectedly returned paths within the grace period: %v", due)
+	}
+	want := map[string]time.Time{
+		"testing/removed":     start,
+		"testing/src:removed": start,
+	}
+	if got := gv.deletions.since; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected pending deletions: got %v, want %v", got, want)
+	}
+
+	if err := cleanup(gv, start.Add(*deleteGracePeriod)); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"testing/removed", "testing/src:removed"} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("%q unexpectedly still present after cleanup: %v", path, err)
+		}
+	}
+	// unstable is not part of the globalView, hence must not be touched.
+	if _, err := os.Stat(filepath.Join(dir, "unstable/removed")); err != nil {
+		t.Error(err)
+	}
+	if got, want := gv.stats.PackagesDeleted, uint64(1); got != want {
+		t.Fatalf("unexpected number of deleted packages: got %d, want %d", got, want)
+	}
+	if got := len(gv.deletions.since); got != 0 {
+		t.Fatalf("unexpected pending deletions after cleanup: %v", gv.deletions.since)
+	}
+}
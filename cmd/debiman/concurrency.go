@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+var discoverConcurrency = flag.Int("concurrency_discover",
+	2,
+	"Concurrency level for downloading and parsing the indices of suites. If not specified, planned according to the available CPUs and memory.")
+
+var downloadConcurrency = flag.Int("concurrency_download",
+	10,
+	"Concurrency level for downloading and extracting packages. If not specified, planned according to the available CPUs and memory.")
+
+// Rough per-item memory estimates, measured on a full Debian mirror
+// sync. They only need to be correct in order of magnitude.
+const (
+	pkgEntryBytes     = 300 // pkgEntry including strings and sha256
+	contentEntryBytes = 200 // contentEntry plus its contentByPath key
+	metaBytes         = 400 // manpage.Meta, shared PkgMeta amortized
+
+	// renderWorkerBytes covers a mandoc(1) process, a gzip writer at
+	// level 9 and the rendered page being buffered.
+	renderWorkerBytes = 64 << 20
+
+	// discoverWorkerBytes covers a suite’s parsed Contents and
+	// Packages files before they are added to the globalView.
+	discoverWorkerBytes = 512 << 20
+
+	// downloadWorkerBytes covers a package’s manpages being read into
+	// memory for .so elimination and recoding.
+	downloadWorkerBytes = 32 << 20
+
+	// reservedBytes is left to the page cache and other processes.
+	reservedBytes = 256 << 20
+)
+
+// resources describes the resources available to debiman.
+type resources struct {
+	// memBytes is the available memory in bytes, or 0 if unknown.
+	memBytes uint64
+	cpus     int
+	// openFiles is the limit on open file descriptors, or 0 if unknown.
+	openFiles uint64
+}
+
+// concurrency contains the concurrency level of each stage.
+type concurrency struct {
+	discover int
+	download int
+	render   int
+	manwalk  int
+}
+
+// estimateGlobalViewBytes returns an estimate of the memory which
+// gv occupies.
+func estimateGlobalViewBytes(gv globalView) uint64 {
+	n := uint64(len(gv.pkgs)) * pkgEntryBytes
+	for _, entries := range gv.contentByPath {
+		n += uint64(len(entries)) * contentEntryBytes
+	}
+	for _, metas := range gv.xref {
+		n += uint64(len(metas)) * metaBytes
+	}
+	return n
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+func atLeastOne(n uint64) int {
+	if n < 1 {
+		return 1
+	}
+	return int(n)
+}
+
+// planConcurrency picks the concurrency level of each stage so that
+// the stage uses all CPUs without exceeding the available memory.
+// Stages run one after the other, so each stage can use all memory
+// which is not occupied by the globalView.
+func planConcurrency(res resources, gvBytes uint64) concurrency {
+	cpus := res.cpus
+	if cpus < 1 {
+		cpus = 1
+	}
+	// Rendering is CPU-bound, downloading is mostly network-bound.
+	c := concurrency{
+		discover: clamp(cpus, 1, 8),
+		download: clamp(2*cpus, 4, 32),
+		render:   cpus,
+		manwalk:  1000,
+	}
+	if res.memBytes > 0 {
+		var avail uint64
+		if res.memBytes > gvBytes+reservedBytes {
+			avail = res.memBytes - gvBytes - reservedBytes
+		}
+		c.discover = clamp(c.discover, 1, atLeastOne(avail/discoverWorkerBytes))
+		c.download = clamp(c.download, 1, atLeastOne(avail/downloadWorkerBytes))
+		c.render = clamp(c.render, 1, atLeastOne(avail/renderWorkerBytes))
+	}
+	if res.openFiles > 0 {
+		// Leave room for the file descriptors of the render and
+		// download workers.
+		c.manwalk = clamp(c.manwalk, 1, atLeastOne(res.openFiles/2))
+	}
+	return c
+}
+
+// explicitFlags returns the names of all flags which were specified
+// on the command line.
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// applyConcurrency sets the concurrency flags of the stages which
+// run after discover (or of the discover stage, if discover is true)
+// which were not specified on the command line according to c.
+func applyConcurrency(c concurrency, explicit map[string]bool, discover bool) {
+	for _, f := range []struct {
+		name     string
+		value    *int
+		plan     int
+		discover bool
+	}{
+		{"concurrency_discover", discoverConcurrency, c.discover, true},
+		{"concurrency_download", downloadConcurrency, c.download, false},
+		{"concurrency_render", renderConcurrency, c.render, false},
+		{"concurrency_manwalk", manwalkConcurrency, c.manwalk, false},
+	} {
+		if f.discover != discover {
+			continue
+		}
+		if explicit[f.name] {
+			log.Printf("-%s=%d (specified)", f.name, *f.value)
+			continue
+		}
+		*f.value = f.plan
+		log.Printf("-%s=%d (planned)", f.name, *f.value)
+	}
+}
+
+// planStages estimates the memory used by gv and sets the concurrency
+// level of all stages for which no flag was specified.
+func planStages(gv globalView) {
+	res := systemResources()
+	gvBytes := estimateGlobalViewBytes(gv)
+	log.Printf("resources: %d bytes of memory available, %d CPUs, %d open files; globalView uses ≈%d bytes",
+		res.memBytes, res.cpus, res.openFiles, gvBytes)
+	applyConcurrency(planConcurrency(res, gvBytes), explicitFlags(), false)
+}
+
+// planDiscover sets the concurrency level of the discover stage, unless
+// -concurrency_discover was specified. No globalView exists yet.
+func planDiscover() {
+	res := systemResources()
+	log.Printf("resources: %d bytes of memory available, %d CPUs, %d open files",
+		res.memBytes, res.cpus, res.openFiles)
+	applyConcurrency(planConcurrency(res, 0), explicitFlags(), true)
+}
+
+// readResources determines the available resources from the proc and
+// cgroup (v1 or v2) file systems mounted below root. Limits which
+// cannot be determined are left at 0.
+func readResources(root string) resources {
+	res := resources{cpus: runtime.NumCPU()}
+
+	if avail, ok := readMeminfo(filepath.Join(root, "proc/meminfo"), "MemAvailable"); ok {
+		res.memBytes = avail
+	}
+
+	// The limits of the systemd unit (or container) are configured on
+	// the cgroup of the process, not on the root cgroup. Limits of
+	// all parent cgroups apply as well.
+	cgroup := filepath.Join(root, "sys/fs/cgroup")
+	paths := readCgroupPaths(filepath.Join(root, "proc/self/cgroup"))
+
+	// cgroup v2: “max” means unlimited.
+	for _, dir := range cgroupDirs(cgroup, paths[""]) {
+		if limit, ok := readUint(filepath.Join(dir, "memory.max")); ok {
+			if usage, ok := readUint(filepath.Join(dir, "memory.current")); ok {
+				res.memBytes = minAvail(res.memBytes, limit, usage)
+			}
+		}
+		if quota, period, ok := readCPUMax(filepath.Join(dir, "cpu.max")); ok {
+			res.cpus = minCPUs(res.cpus, quota, period)
+		}
+	}
+
+	// cgroup v1: an unlimited cgroup has a limit close to 2^63.
+	for _, dir := range cgroupDirs(filepath.Join(cgroup, "memory"), paths["memory"]) {
+		if limit, ok := readUint(filepath.Join(dir, "memory.limit_in_bytes")); ok && limit < 1<<62 {
+			if usage, ok := readUint(filepath.Join(dir, "memory.usage_in_bytes")); ok {
+				res.memBytes = minAvail(res.memBytes, limit, usage)
+			}
+		}
+	}
+	for _, dir := range cgroupDirs(filepath.Join(cgroup, "cpu"), paths["cpu"]) {
+		if quota, ok := readInt(filepath.Join(dir, "cpu.cfs_quota_us")); ok && quota > 0 {
+			if period, ok := readInt(filepath.Join(dir, "cpu.cfs_period_us")); ok {
+				res.cpus = minCPUs(res.cpus, quota, period)
+			}
+		}
+	}
+	return res
+}
+
+// readCgroupPaths parses a /proc/self/cgroup file and returns the
+// cgroup path of the process for each cgroup v1 controller. The cgroup
+// v2 path has the key "".
+func readCgroupPaths(path string) map[string]string {
+	paths := make(map[string]string)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return paths
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		// e.g. “0::/system.slice/debiman.service” (v2) or
+		// “4:cpu,cpuacct:/system.slice/debiman.service” (v1)
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[1] == "" {
+			paths[""] = parts[2]
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			paths[controller] = parts[2]
+		}
+	}
+	return paths
+}
+
+// cgroupDirs returns the directories of the cgroup path and all its
+// parents up to the hierarchy mounted at mount. Directories which do
+// not exist, e.g. because the path refers to a cgroup outside of the
+// container’s cgroup namespace, are skipped.
+func cgroupDirs(mount, path string) []string {
+	dir := filepath.Join(mount, path)
+	if !strings.HasPrefix(dir, mount+"/") {
+		dir = mount
+	}
+	var dirs []string
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			dirs = append(dirs, dir)
+		}
+		if dir == mount {
+			return dirs
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// minAvail returns the memory available within a cgroup with the
+// specified limit and usage, or avail if that is lower.
+func minAvail(avail, limit, usage uint64) uint64 {
+	var cg uint64
+	if limit > usage {
+		cg = limit - usage
+	}
+	if avail == 0 || cg < avail {
+		return cg
+	}
+	return avail
+}
+
+// minCPUs returns the number of CPUs which a CPU quota allows for, or
+// cpus if that is lower.
+func minCPUs(cpus int, quota, period int64) int {
+	if quota <= 0 || period <= 0 {
+		return cpus
+	}
+	n := int((quota + period - 1) / period) // round up
+	if n < cpus {
+		return n
+	}
+	return cpus
+}
+
+// readMeminfo returns the value of key in a /proc/meminfo file, in
+// bytes.
+func readMeminfo(path, key string) (uint64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// e.g. “MemAvailable:    8105212 kB”
+		if len(fields) < 2 || fields[0] != key+":" {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			v *= 1024
+		}
+		return v, true
+	}
+	return 0, false
+}
+
+func readFirstLine(path string) (string, bool) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(b)), true
+}
+
+func readUint(path string) (uint64, bool) {
+	s, ok := readFirstLine(path)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(s, 10, 64)
+	return v, err == nil
+}
+
+func readInt(path string) (int64, bool) {
+	s, ok := readFirstLine(path)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	return v, err == nil
+}
+
+// readCPUMax parses a cgroup v2 cpu.max file, e.g. “200000 100000”.
+// ok is false if there is no quota.
+func readCPUMax(path string) (quota, period int64, ok bool) {
+	s, ok := readFirstLine(path)
+	if !ok {
+		return 0, 0, false
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0, 0, false
+	}
+	quota, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	period, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return quota, period, true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadResources(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		files    map[string]string
+		wantMem  uint64
+		maxCPUs  int
+		wantCPUs int // if non-zero
+	}{
+		{
+			name: "host",
+			files: map[string]string{
+				"proc/meminfo": "MemTotal:       16307632 kB\nMemFree:         1024000 kB\nMemAvailable:    8388608 kB\n",
+			},
+			wantMem: 8 << 30,
+		},
+
+		{
+			name: "cgroup v2",
+			files: map[string]string{
+				"proc/meminfo":                 "MemAvailable:    8388608 kB\n",
+				"sys/fs/cgroup/memory.max":     "2147483648\n",
+				"sys/fs/cgroup/memory.current": "1073741824\n",
+				"sys/fs/cgroup/cpu.max":        "150000 100000\n",
+			},
+			wantMem:  1 << 30,
+			wantCPUs: 2,
+		},
+
+		{
+			name: "cgroup v2 unlimited",
+			files: map[string]string{
+				"proc/meminfo":                 "MemAvailable:    8388608 kB\n",
+				"sys/fs/cgroup/memory.max":     "max\n",
+				"sys/fs/cgroup/memory.current": "1073741824\n",
+				"sys/fs/cgroup/cpu.max":        "max 100000\n",
+			},
+			wantMem: 8 << 30,
+		},
+
+		{
+			name: "cgroup v1",
+			files: map[string]string{
+				"proc/meminfo": "MemAvailable:    8388608 kB\n",
+				"sys/fs/cgroup/memory/memory.limit_in_bytes": "4294967296\n",
+				"sys/fs/cgroup/memory/memory.usage_in_bytes": "1073741824\n",
+				"sys/fs/cgroup/cpu/cpu.cfs_quota_us":         "100000\n",
+				"sys/fs/cgroup/cpu/cpu.cfs_period_us":        "100000\n",
+			},
+			wantMem:  3 << 30,
+			wantCPUs: 1,
+		},
+
+		{
+			name: "cgroup v1 unlimited",
+			files: map[string]string{
+				"proc/meminfo": "MemAvailable:    8388608 kB\n",
+				"sys/fs/cgroup/memory/memory.limit_in_bytes": "9223372036854771712\n",
+				"sys/fs/cgroup/memory/memory.usage_in_bytes": "1073741824\n",
+				"sys/fs/cgroup/cpu/cpu.cfs_quota_us":         "-1\n",
+				"sys/fs/cgroup/cpu/cpu.cfs_period_us":        "100000\n",
+			},
+			wantMem: 8 << 30,
+		},
+
+		{
+			name: "cgroup v2 systemd unit",
+			files: map[string]string{
+				"proc/meminfo":     "MemAvailable:    8388608 kB\n",
+				"proc/self/cgroup": "0::/system.slice/debiman.service\n",
+				"sys/fs/cgroup/system.slice/debiman.service/memory.max":     "2147483648\n",
+				"sys/fs/cgroup/system.slice/debiman.service/memory.current": "536870912\n",
+				"sys/fs/cgroup/system.slice/debiman.service/cpu.max":        "max 100000\n",
+				"sys/fs/cgroup/system.slice/memory.max":                     "max\n",
+				"sys/fs/cgroup/system.slice/memory.current":                 "4294967296\n",
+				"sys/fs/cgroup/system.slice/cpu.max":                        "200000 100000\n",
+			},
+			wantMem:  3 << 29,
+			wantCPUs: 2,
+		},
+
+		{
+			name: "cgroup v2 parent limit",
+			files: map[string]string{
+				"proc/meminfo":     "MemAvailable:    8388608 kB\n",
+				"proc/self/cgroup": "0::/system.slice/debiman.service\n",
+				"sys/fs/cgroup/system.slice/debiman.service/memory.max":     "max\n",
+				"sys/fs/cgroup/system.slice/debiman.service/memory.current": "536870912\n",
+				"sys/fs/cgroup/system.slice/memory.max":                     "4294967296\n",
+				"sys/fs/cgroup/system.slice/memory.current":                 "3221225472\n",
+			},
+			wantMem: 1 << 30,
+		},
+
+		{
+			name: "cgroup v2 outside of namespace",
+			files: map[string]string{
+				"proc/meminfo":                 "MemAvailable:    8388608 kB\n",
+				"proc/self/cgroup":             "0::/../../system.slice/docker.service\n",
+				"sys/fs/cgroup/memory.max":     "2147483648\n",
+				"sys/fs/cgroup/memory.current": "1073741824\n",
+			},
+			wantMem: 1 << 30,
+		},
+
+		{
+			name: "cgroup v1 systemd unit",
+			files: map[string]string{
+				"proc/meminfo":     "MemAvailable:    8388608 kB\n",
+				"proc/self/cgroup": "5:memory:/system.slice/debiman.service\n4:cpu,cpuacct:/system.slice/debiman.service\n1:name=systemd:/system.slice/debiman.service\n",
+				"sys/fs/cgroup/memory/memory.limit_in_bytes":                              "9223372036854771712\n",
+				"sys/fs/cgroup/memory/memory.usage_in_bytes":                              "8589934592\n",
+				"sys/fs/cgroup/memory/system.slice/debiman.service/memory.limit_in_bytes": "4294967296\n",
+				"sys/fs/cgroup/memory/system.slice/debiman.service/memory.usage_in_bytes": "1073741824\n",
+				"sys/fs/cgroup/cpu/system.slice/debiman.service/cpu.cfs_quota_us":         "100000\n",
+				"sys/fs/cgroup/cpu/system.slice/debiman.service/cpu.cfs_period_us":        "100000\n",
+			},
+			wantMem:  3 << 30,
+			wantCPUs: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "debiman-resources")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			for path, content := range tt.files {
+				path = filepath.Join(root, path)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			res := readResources(root)
+			if got, want := res.memBytes, tt.wantMem; got != want {
+				t.Errorf("unexpected memory: got %d, want %d", got, want)
+			}
+			if tt.wantCPUs != 0 && res.cpus > tt.wantCPUs {
+				t.Errorf("unexpected CPUs: got %d, want at most %d", res.cpus, tt.wantCPUs)
+			}
+		})
+	}
+}
+
+func TestPlanConcurrency(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		res     resources
+		gvBytes uint64
+		want    concurrency
+	}{
+		{
+			name: "unknown memory",
+			res:  resources{cpus: 4},
+			want: concurrency{discover: 4, download: 8, render: 4, manwalk: 1000},
+		},
+
+		{
+			name:    "small VM",
+			res:     resources{cpus: 2, memBytes: 1 << 30, openFiles: 1024},
+			gvBytes: 512 << 20,
+			want:    concurrency{discover: 1, download: 4, render: 2, manwalk: 512},
+		},
+
+		{
+			name:    "out of memory",
+			res:     resources{cpus: 8, memBytes: 1 << 30},
+			gvBytes: 1 << 30,
+			want:    concurrency{discover: 1, download: 1, render: 1, manwalk: 1000},
+		},
+
+		{
+			name:    "big machine",
+			res:     resources{cpus: 64, memBytes: 256 << 30, openFiles: 65536},
+			gvBytes: 4 << 30,
+			want:    concurrency{discover: 8, download: 32, render: 64, manwalk: 1000},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planConcurrency(tt.res, tt.gvBytes); got != tt.want {
+				t.Fatalf("planConcurrency(%+v, %d) = %+v, want %+v", tt.res, tt.gvBytes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyConcurrency(t *testing.T) {
+	oldDiscover, oldDownload, oldRender, oldManwalk := *discoverConcurrency, *downloadConcurrency, *renderConcurrency, *manwalkConcurrency
+	defer func() {
+		*discoverConcurrency, *downloadConcurrency, *renderConcurrency, *manwalkConcurrency = oldDiscover, oldDownload, oldRender, oldManwalk
+	}()
+	*discoverConcurrency = 2
+	*renderConcurrency = 3
+	c := concurrency{discover: 5, download: 7, render: 9, manwalk: 11}
+	explicit := map[string]bool{
+		"concurrency_render": true,
+	}
+	applyConcurrency(c, explicit, true)
+	if got, want := *discoverConcurrency, 5; got != want {
+		t.Errorf("-concurrency_discover: got %d, want %d", got, want)
+	}
+	if got, want := *downloadConcurrency, oldDownload; got != want {
+		t.Errorf("-concurrency_download: got %d, want %d (planned before discover)", got, want)
+	}
+	applyConcurrency(c, explicit, false)
+	if got, want := *downloadConcurrency, 7; got != want {
+		t.Errorf("-concurrency_download: got %d, want %d", got, want)
+	}
+	if got, want := *renderConcurrency, 3; got != want {
+		t.Errorf("-concurrency_render: got %d, want %d (explicit flags must win)", got, want)
+	}
+	if got, want := *manwalkConcurrency, 11; got != want {
+		t.Errorf("-concurrency_manwalk: got %d, want %d", got, want)
+	}
+}
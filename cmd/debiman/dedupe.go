@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/stapelberg/debiman/internal/cas"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/deb"
+)
+
+var dedupe = flag.Bool("dedupe",
+	false,
+	"Deduplicate identical manpages, text and printable renderings and cached HTML fragments (see -fragment_cache) across suites, packages and architectures by hardlinking them to a content-addressed store in .cas/ in -serving_dir. Objects which are no longer linked are removed after cleaning up obsolete files.")
+
+// openStore returns the content-addressed store of -serving_dir, or nil
+// if -dedupe is not set.
+func openStore() *cas.Store {
+	if !*dedupe {
+		return nil
+	}
+	if !servingLocally() {
+		log.Printf("WARNING: -dedupe requires -serving_dir to be stored on local disk (see -storage), not deduplicating")
+		return nil
+	}
+	return cas.New(filepath.Join(*servingDir, ".cas"))
+}
+
+// storeFile replaces path with a hardlink into store if another file
+// has the same content.
+func storeFile(store *cas.Store, suite, path string) {
+	linked, err := store.Link(path)
+	if err != nil {
+		log.Printf("WARNING: deduplicating %q: %v", path, err)
+		return
+	}
+	if linked {
+		runMetrics.add("files_deduplicated_total", metricLabels("suite", suite), 1)
+	}
+}
+
+// collectStore removes unused objects from store and records its disk
+// usage in gv.stats.
+func collectStore(store *cas.Store, gv globalView) error {
+	removed, freed, err := store.Collect()
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d unused objects (%d bytes) from the content-addressed store", removed, freed)
+	u, err := store.Usage()
+	if err != nil {
+		return err
+	}
+	log.Printf("Content-addressed store: %d objects (%d bytes) linked to %d files, saving %d bytes", u.Objects, u.Bytes, u.Links, u.SavedBytes)
+	atomic.StoreUint64(&gv.stats.StoreBytes, uint64(u.Bytes))
+	atomic.StoreUint64(&gv.stats.StoreSavedBytes, uint64(u.SavedBytes))
+	return nil
+}
+
+// groupPkgs groups the packages which refer to the same package version
+// (e.g. in testing and unstable), so that each package version is only
+// downloaded and decompressed once. Groups are ordered by their first
+// package.
+func groupPkgs(pkgs []*pkgEntry) [][]pkgEntry {
+	groups := make([][]pkgEntry, 0, len(pkgs))
+	byKey := make(map[string]int)
+	for _, p := range pkgs {
+		if len(p.sha256) == 0 {
+			// Not a .deb file, e.g. a filesystem tree.
+			groups = append(groups, []pkgEntry{*p})
+			continue
+		}
+		key := fmt.Sprintf("%s_%s_%x", p.binarypkg, p.version, p.sha256)
+		if idx, ok := byKey[key]; ok {
+			groups[idx] = append(groups[idx], *p)
+			continue
+		}
+		byKey[key] = len(groups)
+		groups = append(groups, []pkgEntry{*p})
+	}
+	return groups
+}
+
+// bufferedFile is a file of a package, read into memory.
+type bufferedFile struct {
+	header  *tar.Header
+	content []byte
+}
+
+// bufferedTar provides bufferedFiles like a *tar.Reader.
+type bufferedTar struct {
+	files []bufferedFile
+	cur   *bytes.Reader
+}
+
+func (b *bufferedTar) Next() (*tar.Header, error) {
+	if len(b.files) == 0 {
+		b.cur = nil
+		return nil, io.EOF
+	}
+	f := b.files[0]
+	b.files = b.files[1:]
+	b.cur = bytes.NewReader(f.content)
+	header := *f.header // copy
+	return &header, nil
+}
+
+func (b *bufferedTar) Read(p []byte) (int, error) {
+	if b.cur == nil {
+		return 0, io.EOF
+	}
+	return b.cur.Read(p)
+}
+
+// sharedPkg is a package version which was downloaded once for all
+// suites containing it. If it is contained in multiple suites, its
+// manpages are kept in memory, so that extracting it for another suite
+// does not require decompressing the .deb file again.
+type sharedPkg struct {
+	ar *mirrorPool
+
+	deb      *os.File
+	filename string
+	remove   bool
+	// buffer is true if the package version is contained in multiple
+	// suites, see openManpages.
+	buffer bool
+	// manpages are the files underneath /usr/share/man, or nil if the
+	// .deb file was not read yet.
+	manpages []bufferedFile
+	// first is the first package which was extracted, whose files are
+	// hardlinked by the packages extracted after it, see linkFirst.
+	first *pkgEntry
+	// portable contains the files of first (relative to its package
+	// directory) which do not depend on the suite, i.e. manpages
+	// without .so statements and referenced non-manpage files.
+	portable map[string]bool
+}
+
+// newSharedPkg returns a sharedPkg for a package version which is
+// contained in members suites.
+func newSharedPkg(ar *mirrorPool, members int) *sharedPkg {
+	return &sharedPkg{ar: ar, buffer: members > 1}
+}
+
+// fetch downloads the .deb file of p, unless it was already downloaded.
+func (s *sharedPkg) fetch(p pkgEntry) error {
+	if s.deb != nil {
+		return nil
+	}
+	if p.local {
+		f, err := os.Open(p.filename)
+		if err != nil {
+			return err
+		}
+		s.deb = f
+	} else {
+		f, err := s.ar.TempFile(control.FileHash{
+			Filename:  p.filename,
+			Algorithm: "sha256",
+			Hash:      fmt.Sprintf("%x", p.sha256),
+		})
+		if err != nil {
+			return fmt.Errorf("archive download: %v", err)
+		}
+		countDownload(p.suite, f)
+		s.deb = f
+		s.remove = true
+	}
+	s.filename = p.filename
+	return nil
+}
+
+// openDeb returns the files of the .deb file.
+func (s *sharedPkg) openDeb() (tarReader, error) {
+	if _, err := s.deb.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	d, err := deb.Load(s.deb, s.filename)
+	if err != nil {
+		return nil, fmt.Errorf("loading %q: %v", s.filename, err)
+	}
+	return d.Data, nil
+}
+
+// openManpages returns the files underneath /usr/share/man of the .deb
+// file. If the package version is contained in multiple suites, they
+// are read only once.
+func (s *sharedPkg) openManpages() (tarReader, error) {
+	if !s.buffer {
+		return s.openDeb()
+	}
+	if s.manpages == nil {
+		data, err := s.openDeb()
+		if err != nil {
+			return nil, err
+		}
+		manpages := []bufferedFile{}
+		for {
+			header, err := data.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !strings.HasPrefix(header.Name, "./usr/share/man/") {
+				continue
+			}
+			content, err := ioutil.ReadAll(data)
+			if err != nil {
+				return nil, err
+			}
+			manpages = append(manpages, bufferedFile{header: header, content: content})
+		}
+		s.manpages = manpages
+	}
+	return &bufferedTar{files: s.manpages}, nil
+}
+
+func (s *sharedPkg) close() {
+	if s.deb == nil {
+		return
+	}
+	if s.remove {
+		os.Remove(s.deb.Name())
+	}
+	s.deb.Close()
+}
+
+// linkFirst replaces the file name (relative to the package directory)
+// of p with a hardlink to the same file of s.first, if that file does
+// not depend on the suite. It returns whether the file was linked.
+func (s *sharedPkg) linkFirst(p pkgEntry, name string) (bool, error) {
+	if s.first == nil || !s.portable[name] || !servingLocally() {
+		return false, nil // hardlinks require local disk
+	}
+	src := filepath.Join(*servingDir, s.first.suite, s.first.binarypkg, name)
+	dest := filepath.Join(*servingDir, p.suite, p.binarypkg, name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+	tmp := dest + ".link"
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return false, err
+	}
+	runMetrics.add("files_hardlinked_total", metricLabels("suite", p.suite), 1)
+	return true, nil
+}
+
+// hasSo returns whether the manpage content contains .so statements,
+// which are resolved differently in each suite (see soElim).
+func hasSo(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(".so ")) ||
+		bytes.Contains(content, []byte("\n.so "))
+}
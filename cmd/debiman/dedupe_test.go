@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pault.ag/go/debian/version"
+)
+
+func TestGroupPkgs(t *testing.T) {
+	v1 := version.Version{Version: "4.13", Revision: "1"}
+	v2 := version.Version{Version: "4.14", Revision: "1"}
+	pkgs := []*pkgEntry{
+		{suite: "testing", binarypkg: "i3-wm", version: v1, sha256: []byte{1}},
+		{suite: "testing", binarypkg: "i3lock", version: v1, sha256: []byte{2}},
+		{suite: "unstable", binarypkg: "i3-wm", version: v1, sha256: []byte{1}},
+		{suite: "experimental", binarypkg: "i3-wm", version: v2, sha256: []byte{3}},
+		{suite: "system", binarypkg: "unpackaged", version: v1},
+		{suite: "other", binarypkg: "unpackaged", version: v1},
+	}
+	groups := groupPkgs(pkgs)
+	var got []string
+	for _, g := range groups {
+		var suites string
+		for _, p := range g {
+			suites += " " + p.suite + "/" + p.binarypkg
+		}
+		got = append(got, suites)
+	}
+	want := []string{
+		" testing/i3-wm unstable/i3-wm",
+		" testing/i3lock",
+		" experimental/i3-wm",
+		" system/unpackaged",
+		" other/unpackaged",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("groupPkgs() = %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("groupPkgs() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestLinkFirst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flag.Set("serving_dir", dir)
+
+	files := map[string]string{
+		"testing/i3-wm/i3.1.en.gz":              "portable",
+		"testing/i3-wm/i3-msg.1.gz":             ".so man1/i3.1",
+		"testing/i3-wm/aux/usr/share/i3/ref.tr": "portable",
+	}
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newSharedPkg(nil, 2)
+	p := pkgEntry{suite: "unstable", binarypkg: "i3-wm"}
+	if linked, err := s.linkFirst(p, "i3.1.en.gz"); err != nil || linked {
+		t.Fatalf("linkFirst() without first package = %v, %v, want false, nil", linked, err)
+	}
+	s.first = &pkgEntry{suite: "testing", binarypkg: "i3-wm"}
+	s.portable = map[string]bool{
+		"i3.1.en.gz":              true,
+		"aux/usr/share/i3/ref.tr": true,
+		"i3bar.1.gz":              true, // not written
+	}
+
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"i3.1.en.gz", true},
+		{"aux/usr/share/i3/ref.tr", true},
+		{"i3-msg.1.gz", false},
+		{"i3bar.1.gz", false},
+	} {
+		linked, err := s.linkFirst(p, tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if linked != tt.want {
+			t.Errorf("linkFirst(%q) = %v, want %v", tt.name, linked, tt.want)
+		}
+		if !tt.want {
+			continue
+		}
+		ast, err := os.Stat(filepath.Join(dir, "testing/i3-wm", tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bst, err := os.Stat(filepath.Join(dir, "unstable/i3-wm", tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(ast, bst) {
+			t.Errorf("%s: not hardlinked", tt.name)
+		}
+	}
+}
+
+func TestHasSo(t *testing.T) {
+	for _, tt := range []struct {
+		content string
+		want    bool
+	}{
+		{".so man1/i3.1\n", true},
+		{".TH I3 1\n.so man1/i3.1\n", true},
+		{".TH I3 1\n.SH NAME\n", false},
+		{".TH I3 1\n\\.so not a statement\n", false},
+	} {
+		if got := hasSo([]byte(tt.content)); got != tt.want {
+			t.Errorf("hasSo(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
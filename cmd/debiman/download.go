@@ -14,6 +14,7 @@ import (
 	"sort"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unicode/utf8"
 
 	"golang.org/x/net/context"
@@ -21,28 +22,39 @@ import (
 
 	"github.com/stapelberg/debiman/internal/manpage"
 	"github.com/stapelberg/debiman/internal/recode"
-	"github.com/stapelberg/debiman/internal/write"
 
-	"pault.ag/go/archive"
-	"pault.ag/go/debian/control"
-	"pault.ag/go/debian/deb"
 	"pault.ag/go/debian/version"
 )
 
+// versionFileContent returns the content of the VERSION file of p. For
+// local .deb files, which can be rebuilt without changing their
+// version, it additionally contains the SHA256 hash of the .deb file.
+func versionFileContent(p pkgEntry) string {
+	if p.local {
+		return fmt.Sprintf("%s\n%x\n", p.version, p.sha256)
+	}
+	return p.version.String()
+}
+
 // canSkip returns true if the package is present in the same (or a
 // newer) version on disk already.
 func canSkip(p pkgEntry, vPath string) bool {
-	v, err := ioutil.ReadFile(vPath)
+	v, err := readFile(vPath)
 	if err != nil {
 		return false
 	}
+	lines := strings.Split(strings.TrimSpace(string(v)), "\n")
 
-	vCurrent, err := version.Parse(string(v))
+	vCurrent, err := version.Parse(lines[0])
 	if err != nil {
 		log.Printf("Warning: could not parse current package version from %q: %v", vPath, err)
 		return false
 	}
 
+	if p.local && (len(lines) < 2 || lines[1] != fmt.Sprintf("%x", p.sha256)) {
+		return false
+	}
+
 	return version.Compare(vCurrent, p.version) >= 0
 }
 
@@ -159,8 +171,11 @@ func findFile(logger *log.Logger, src, name string, contentByPath map[string][]*
 	return name, "", false
 }
 
-func soElim(logger *log.Logger, src string, r io.Reader, w io.Writer, contentByPath map[string][]*contentEntry) ([]string, error) {
-	var refs []string
+// soElim rewrites .so lines in r to reference paths within
+// -serving_dir. It returns the referenced non-manpage files (which need
+// to be extracted) and the references which could not be resolved
+// (which are omitted).
+func soElim(logger *log.Logger, src string, r io.Reader, w io.Writer, contentByPath map[string][]*contentEntry) (refs []string, omitted []string, err error) {
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -175,6 +190,7 @@ func soElim(logger *log.Logger, src string, r io.Reader, w io.Writer, contentByP
 			// Omitting .so lines which cannot be found is consistent
 			// with what man(1) and other online man viewers do.
 			logger.Printf("WARNING: could not find .so referenced file %q, omitting the .so line", so)
+			omitted = append(omitted, so)
 			continue
 		}
 
@@ -183,61 +199,79 @@ func soElim(logger *log.Logger, src string, r io.Reader, w io.Writer, contentByP
 			refs = append(refs, ref)
 		}
 	}
-	return refs, scanner.Err()
+	return refs, omitted, scanner.Err()
 }
 
-func writeManpage(logger *log.Logger, src, dest string, r io.Reader, m *manpage.Meta, contentByPath map[string][]*contentEntry) ([]string, error) {
-	var refs []string
-	content, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
-	}
+func writeManpage(logger *log.Logger, src, dest string, content []byte, m *manpage.Meta, contentByPath map[string][]*contentEntry) (refs []string, omitted []string, err error) {
 	if !utf8.Valid(content) {
 		content, err = ioutil.ReadAll(recode.Reader(bytes.NewReader(content), m.Language))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
-	err = write.Atomically(dest, true, func(w io.Writer) error {
+	err = serving.Write(dest, true, func(w io.Writer) error {
 		var err error
-		refs, err = soElim(logger, src, bytes.NewReader(content), w, contentByPath)
+		refs, omitted, err = soElim(logger, src, bytes.NewReader(content), w, contentByPath)
 		return err
 	})
-	return refs, err
+	return refs, omitted, err
 }
 
-func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
+// tarReader is implemented by *tar.Reader (for .deb files) and by
+// *treeReader (for filesystem trees).
+type tarReader interface {
+	io.Reader
+	Next() (*tar.Header, error)
+}
+
+func downloadPkg(ar *mirrorPool, p pkgEntry, gv globalView) error {
+	s := newSharedPkg(ar, 1)
+	defer s.close()
+	return s.extract(p, gv)
+}
+
+// extract extracts the manpages of p, which must refer to the same
+// package version as all other packages extracted using s.
+func (s *sharedPkg) extract(p pkgEntry, gv globalView) error {
 	vPath := filepath.Join(*servingDir, p.suite, p.binarypkg, "VERSION")
 
-	if !*forceReextract && canSkip(p, vPath) {
+	if (!*forceReextract || extractedSince(vPath, gv.resumeSince)) && canSkip(p, vPath) {
+		gv.report.skippedPackage(p)
 		return nil
 	}
 
 	logger := log.New(os.Stderr, p.suite+"/"+p.binarypkg+": ", log.LstdFlags)
 
-	tmp, err := ar.TempFile(control.FileHash{
-		Filename:  p.filename,
-		Algorithm: "sha256",
-		Hash:      fmt.Sprintf("%x", p.sha256),
-	})
-	if err != nil {
-		return fmt.Errorf("archive download: %v", err)
-	}
-	defer os.Remove(tmp.Name())
-	defer tmp.Close()
-
-	if _, err := tmp.Seek(0, os.SEEK_SET); err != nil {
-		return err
+	// open returns the files of the package, starting at the first
+	// file. openRefs returns the files referenced via .so statements.
+	var open, openRefs func() (tarReader, error)
+	if p.tree != "" {
+		open = func() (tarReader, error) {
+			return newTreeReader(p.tree, p.files), nil
+		}
+	} else {
+		if err := s.fetch(p); err != nil {
+			return err
+		}
+		open = s.openManpages
+		openRefs = s.openDeb
 	}
 
 	allRefs := make(map[string]bool)
-
-	d, err := deb.Load(tmp, p.filename)
+	// written contains the paths (relative to -serving_dir) of all
+	// files belonging to this package version, see staleFiles.
+	written := make(map[string]bool)
+	// portable contains the files (relative to the package directory)
+	// which can be hardlinked by other suites, see linkFirst.
+	portable := make(map[string]bool)
+	pkgdir := filepath.Join(p.suite, p.binarypkg)
+
+	data, err := open()
 	if err != nil {
-		return fmt.Errorf("loading %q: %v", p.filename, err)
+		return err
 	}
 	for {
-		header, err := d.Data.Next()
+		header, err := data.Next()
 		if err == io.EOF {
 			break
 		}
@@ -259,7 +293,7 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 		}
 
 		destdir := filepath.Join(*servingDir, p.suite, p.binarypkg)
-		if err := os.MkdirAll(destdir, 0755); err != nil {
+		if err := serving.MkdirAll(destdir); err != nil {
 			return err
 		}
 
@@ -271,10 +305,12 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 
 		if err != nil {
 			logger.Printf("WARNING: file name %q (underneath /usr/share/man) cannot be parsed: %v", header.Name, err)
+			gv.report.unparseablePath(p, header.Name, err)
 			continue
 		}
 
 		destPath := filepath.Join(*servingDir, m.ServingPath()+".gz")
+		written[m.ServingPath()+".gz"] = true
 		if header.Typeflag == tar.TypeLink {
 			d, err := manpage.FromManPath(strings.TrimPrefix(header.Linkname, "./usr/share/man/"), &manpage.PkgMeta{
 				Binarypkg: p.binarypkg,
@@ -282,9 +318,10 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 			})
 			if err != nil {
 				logger.Printf("WARNING: hard link name %q (underneath /usr/share/man) cannot be parsed: %v", header.Linkname, err)
+				gv.report.unparseablePath(p, header.Linkname, err)
 				continue
 			}
-			if err := os.Link(filepath.Join(*servingDir, d.ServingPath()+".gz"), m.ServingPath()+".gz"); err != nil {
+			if err := serving.Link(filepath.Join(*servingDir, d.ServingPath()+".gz"), destPath); err != nil {
 				if os.IsExist(err) {
 					continue
 				}
@@ -307,6 +344,7 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 				allRefs[resolved] = true
 				destsp = filepath.Join(filepath.Dir(m.ServingPath()), "aux", resolved)
 				logger.Printf("WARNING: possibly dangling symlink %q -> %q", header.Name, header.Linkname)
+				gv.report.danglingSymlink(p, header.Name, header.Linkname)
 			}
 
 			// TODO(stapelberg): add a unit test for this entire function
@@ -316,7 +354,7 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 				logger.Printf("WARNING: %v", err)
 				continue
 			}
-			if err := os.Symlink(rel, destPath); err != nil {
+			if err := serving.Symlink(rel, destPath); err != nil {
 				if os.IsExist(err) {
 					continue
 				}
@@ -329,20 +367,40 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 			continue
 		}
 
-		r := io.Reader(d.Data)
+		name, err := filepath.Rel(pkgdir, m.ServingPath()+".gz")
+		if err != nil {
+			return err
+		}
+		linked, err := s.linkFirst(p, name)
+		if err != nil {
+			return err
+		}
+		if linked {
+			continue
+		}
+
+		r := io.Reader(data)
 		var gzr *gzip.Reader
 		if strings.HasSuffix(header.Name, ".gz") {
-			gzr, err = gzip.NewReader(d.Data)
+			gzr, err = gzip.NewReader(data)
 			if err != nil {
 				return err
 			}
 			r = gzr
 		}
-		refs, err := writeManpage(logger, header.Name, destPath, r, m, gv.contentByPath)
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		refs, omitted, err := writeManpage(logger, header.Name, destPath, content, m, gv.contentByPath)
 		if err != nil {
 			return err
 		}
-		if err := os.Chtimes(destPath, header.ModTime, header.ModTime); err != nil {
+		if !hasSo(content) {
+			portable[name] = true
+		}
+		gv.report.omittedSo(p, header.Name, omitted)
+		if err := serving.Chtimes(destPath, header.ModTime); err != nil {
 			return err
 		}
 		if gzr != nil {
@@ -370,6 +428,7 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 		})
 		if err != nil {
 			logger.Printf("WARNING: file name %q (underneath /usr/share/man) cannot be parsed: %v", link.from, err)
+			gv.report.unparseablePath(p, link.from, err)
 			continue
 		}
 
@@ -386,6 +445,7 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 			allRefs[resolved] = true
 			destsp = filepath.Join(filepath.Dir(m.ServingPath()), "aux", resolved)
 			logger.Printf("WARNING: possibly dangling symlink %q -> %q, setting to %q", link.from, link.to, destsp)
+			gv.report.danglingSymlink(p, link.from, link.to)
 		}
 
 		// TODO(stapelberg): add a unit test for this entire function
@@ -396,11 +456,13 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 			continue
 		}
 
-		if err := os.MkdirAll(filepath.Dir(m.ServingPath()), 0755); err != nil {
+		destPath := filepath.Join(*servingDir, m.ServingPath()+".gz")
+		if err := serving.MkdirAll(filepath.Dir(destPath)); err != nil {
 			return err
 		}
 
-		if err := os.Symlink(rel, m.ServingPath()+".gz"); err != nil {
+		written[m.ServingPath()+".gz"] = true
+		if err := serving.Symlink(rel, destPath); err != nil {
 			if os.IsExist(err) {
 				continue
 			}
@@ -408,19 +470,41 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 		}
 	}
 
+	// Referenced non-manpage files which were already extracted for
+	// another suite are hardlinked instead of being extracted again.
+	for ref := range allRefs {
+		name := filepath.Join("aux", ref)
+		linked, err := s.linkFirst(p, name)
+		if err != nil {
+			return err
+		}
+		if linked {
+			written[filepath.Join(pkgdir, name)] = true
+			delete(allRefs, ref)
+		}
+	}
+
 	// Extract all non-manpage files which were referenced via .so
 	// statements, if any.
 	if len(allRefs) > 0 {
-		if _, err := tmp.Seek(0, os.SEEK_SET); err != nil {
-			return err
+		if p.tree != "" {
+			// Unlike a .deb file, a filesystem tree can be accessed
+			// by path, so only the referenced files are read.
+			refs := make([]string, 0, len(allRefs))
+			for ref := range allRefs {
+				refs = append(refs, strings.TrimPrefix(ref, "/"))
+			}
+			sort.Strings(refs)
+			openRefs = func() (tarReader, error) {
+				return newTreeReader(p.tree, refs), nil
+			}
 		}
-
-		d, err = deb.Load(tmp, p.filename)
+		data, err := openRefs()
 		if err != nil {
 			return err
 		}
 		for {
-			header, err := d.Data.Next()
+			header, err := data.Next()
 			if err == io.EOF {
 				break
 			}
@@ -443,12 +527,14 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 			}
 
 			destPath := filepath.Join(*servingDir, p.suite, p.binarypkg, "aux", header.Name)
+			written[filepath.Join(p.suite, p.binarypkg, "aux", header.Name)] = true
+			portable[filepath.Join("aux", header.Name)] = true
 			logger.Printf("extracting referenced non-manpage file %q to %q", header.Name, destPath)
-			if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			if err := serving.MkdirAll(filepath.Dir(destPath)); err != nil {
 				return err
 			}
-			if err := write.Atomically(destPath, false, func(w io.Writer) error {
-				_, err := io.Copy(w, d.Data)
+			if err := serving.Write(destPath, false, func(w io.Writer) error {
+				_, err := io.Copy(w, data)
 				return err
 			}); err != nil {
 				return err
@@ -456,7 +542,10 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 		}
 	}
 
-	if err := ioutil.WriteFile(vPath, []byte(p.version.String()), 0644); err != nil {
+	if err := serving.Write(vPath, false, func(w io.Writer) error {
+		_, err := io.WriteString(w, versionFileContent(p))
+		return err
+	}); err != nil {
 		if os.IsNotExist(err) {
 			// If the directory does not exist, we did not extract any
 			// manpages. Since Contents files are not precise (they
@@ -466,32 +555,93 @@ func downloadPkg(ar *archive.Downloader, p pkgEntry, gv globalView) error {
 		return fmt.Errorf("Writing version file %q: %v", vPath, err)
 	}
 
+	// Files which the previous version of this package contained, but
+	// the current version does not, are deleted after a grace period.
+	now := time.Now()
+	stale, err := staleFiles(filepath.Join(p.suite, p.binarypkg), written)
+	if err != nil {
+		return err
+	}
+	for _, path := range stale {
+		logger.Printf("%q is no longer present in version %v", path, p.version)
+		gv.deletions.mark(path, now)
+	}
+	for path := range written {
+		gv.deletions.unmark(path)
+	}
+
 	atomic.AddUint64(&gv.stats.PackagesExtracted, 1)
+	runMetrics.add("packages_extracted_total", metricLabels("suite", p.suite), 1)
+
+	if s.first == nil {
+		s.first = &p
+		s.portable = portable
+	}
+	if gv.store != nil {
+		for path := range written {
+			storeFile(gv.store, p.suite, filepath.Join(*servingDir, path))
+		}
+	}
 
 	return nil
 }
 
-func parallelDownload(ar *archive.Downloader, gv globalView) error {
-	eg, ctx := errgroup.WithContext(context.Background())
-	downloadChan := make(chan pkgEntry)
-	// TODO: flag for parallelism level
-	for i := 0; i < 10; i++ {
+// extractedSince returns whether the package whose VERSION file is
+// vPath was extracted after since, i.e. by an interrupted run which is
+// being resumed.
+func extractedSince(vPath string, since time.Time) bool {
+	if since.IsZero() {
+		return false
+	}
+	st, err := serving.Stat(vPath)
+	return err == nil && st.ModTime().After(since)
+}
+
+func parallelDownload(ctx context.Context, ar *mirrorPool, gv globalView) error {
+	parent := ctx
+	eg, ctx := errgroup.WithContext(ctx)
+	downloadChan := make(chan []pkgEntry)
+	for i := 0; i < *downloadConcurrency; i++ {
 		eg.Go(func() error {
-			for p := range downloadChan {
-				if err := downloadPkg(ar, p, gv); err != nil {
-					return fmt.Errorf("downloading %s/src:%s %v: %v", p.suite, p.source, p.version, err)
+			for group := range downloadChan {
+				// All packages of a group share the same .deb file,
+				// which is downloaded and decompressed only once.
+				s := newSharedPkg(ar, len(group))
+				for _, p := range group {
+					key := p.suite + "/" + p.binarypkg
+					if gv.quarantine.skip(stageExtract, key, p.version.String(), time.Now()) {
+						log.Printf("Skipping quarantined package %s %v", key, p.version)
+						liveStatus.packageProcessed()
+						continue
+					}
+					err := s.extract(p, gv)
+					liveStatus.packageProcessed()
+					if err != nil {
+						gv.report.failedPackage(p, err)
+						err = fmt.Errorf("downloading %s/src:%s %v: %v", p.suite, p.source, p.version, err)
+						if err := spendFailure(gv, stageExtract, key, p.version.String(), err); err != nil {
+							s.close()
+							return err
+						}
+						log.Printf("WARNING: %v (package quarantined)", err)
+					}
 				}
+				s.close()
 			}
 			return nil
 		})
 	}
-	for _, p := range gv.pkgs {
+feed:
+	for _, group := range groupPkgs(gv.pkgs) {
 		select {
-		case downloadChan <- *p:
+		case downloadChan <- group:
 		case <-ctx.Done():
-			break
+			break feed
 		}
 	}
 	close(downloadChan)
-	return eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	return parent.Err()
 }
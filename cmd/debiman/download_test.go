@@ -14,6 +14,7 @@ func TestWriteManpage(t *testing.T) {
 		manpage       string
 		want          string
 		wantRefs      []string
+		wantOmitted   []string
 		pkg           pkgEntry
 		contentByPath map[string][]*contentEntry
 	}{
@@ -31,6 +32,7 @@ func TestWriteManpage(t *testing.T) {
 			manpage:       ".so notfound.1\n",
 			want:          "",
 			wantRefs:      nil,
+			wantOmitted:   []string{"notfound.1"},
 			pkg:           pkgEntry{},
 			contentByPath: make(map[string][]*contentEntry),
 		},
@@ -117,10 +119,11 @@ func TestWriteManpage(t *testing.T) {
 		},
 
 		{
-			src:      "/usr/share/man/man1/absolutenotfound.1",
-			manpage:  ".so /usr/share/man/man8/absolute.8\n",
-			want:     "",
-			wantRefs: nil,
+			src:         "/usr/share/man/man1/absolutenotfound.1",
+			manpage:     ".so /usr/share/man/man8/absolute.8\n",
+			want:        "",
+			wantRefs:    nil,
+			wantOmitted: []string{"/usr/share/man/man8/absolute.8"},
 			pkg: pkgEntry{
 				binarypkg: "bash",
 				suite:     "jessie",
@@ -161,7 +164,7 @@ func TestWriteManpage(t *testing.T) {
 			r := strings.NewReader(entry.manpage)
 			var buf bytes.Buffer
 			logger := log.New(os.Stderr, "", log.LstdFlags)
-			refs, err := soElim(logger, entry.src, r, &buf, entry.contentByPath)
+			refs, omitted, err := soElim(logger, entry.src, r, &buf, entry.contentByPath)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -176,6 +179,14 @@ func TestWriteManpage(t *testing.T) {
 					t.Fatalf("soElim() ref differs in entry %d: got %q, want %q", i, got, want)
 				}
 			}
+			if got, want := len(omitted), len(entry.wantOmitted); got != want {
+				t.Fatalf("Unexpected number of soElim() omitted results: got %d, want %d", got, want)
+			}
+			for i := 0; i < len(omitted); i++ {
+				if got, want := omitted[i], entry.wantOmitted[i]; got != want {
+					t.Fatalf("soElim() omitted differs in entry %d: got %q, want %q", i, got, want)
+				}
+			}
 		})
 	}
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stapelberg/debiman/internal/convert"
+	"github.com/stapelberg/debiman/internal/manpage"
+	"github.com/stapelberg/debiman/internal/write"
+	"golang.org/x/sync/errgroup"
+)
+
+// exportStage is the subcommand which exports manpages as a Markdown
+// tree. Unlike stages, it is not part of a full run.
+const exportStage = "export-markdown"
+
+var (
+	exportDir = flag.String("export_dir",
+		"",
+		"Directory to which “debiman export-markdown” writes manpages as Markdown, in the form <suite>/<binarypkg>/<name>.<section>.<lang>.md.")
+
+	exportSuites = flag.String("export_suites",
+		"",
+		"Comma-separated list of suites which “debiman export-markdown” exports. If empty, all suites are exported.")
+
+	exportPkgs = flag.String("export_pkgs",
+		"",
+		"Comma-separated list of binary packages which “debiman export-markdown” exports. If empty, all packages are exported.")
+)
+
+// splitList returns the set of comma-separated entries in list, or nil
+// if list is empty.
+func splitList(list string) map[string]bool {
+	var set map[string]bool
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[e] = true
+	}
+	return set
+}
+
+// setupExport validates -export_dir and makes it absolute, as debiman
+// changes its working directory to -serving_dir.
+func setupExport() error {
+	if *exportDir == "" {
+		return fmt.Errorf("-export_dir must be specified")
+	}
+	abs, err := filepath.Abs(*exportDir)
+	if err != nil {
+		return err
+	}
+	*exportDir = abs
+	return nil
+}
+
+type exportJob struct {
+	src  string
+	dest string
+	meta *manpage.Meta
+}
+
+// exportMarkdown converts the manpages of the packages selected by
+// -export_suites and -export_pkgs to Markdown and writes them to
+// -export_dir.
+func exportMarkdown(gv globalView) error {
+	suites := splitList(*exportSuites)
+	pkgs := splitList(*exportPkgs)
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	exportChan := make(chan exportJob)
+	for i := 0; i < *renderConcurrency; i++ {
+		eg.Go(func() error {
+			converter, err := convert.NewFormatProcess(convert.FormatMarkdown)
+			if err != nil {
+				return err
+			}
+			defer converter.Kill()
+
+			for j := range exportChan {
+				md, err := toMarkdown(converter, j.src, j.meta, gv.xref)
+				if err != nil {
+					log.Printf("WARNING: exporting %q: %v", j.src, err)
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(j.dest), 0755); err != nil {
+					return err
+				}
+				if err := write.Atomically(j.dest, false, func(w io.Writer) error {
+					_, err := io.WriteString(w, md)
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	var exported int
+	eg.Go(func() error {
+		defer close(exportChan)
+		for _, p := range gv.pkgs {
+			if suites != nil && !suites[p.suite] {
+				continue
+			}
+			if pkgs != nil && !pkgs[p.binarypkg] {
+				continue
+			}
+			dir := filepath.Join(*servingDir, p.suite, p.binarypkg)
+			manpages, err := listManpages(dir)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue // The package might not contain any manpages.
+				}
+				return err
+			}
+			for fn, m := range manpages {
+				select {
+				case exportChan <- exportJob{
+					src:  filepath.Join(dir, fn),
+					dest: filepath.Join(*exportDir, m.ServingPath()+".md"),
+					meta: m,
+				}:
+					exported++
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d manpages to %q", exported, *exportDir)
+	return nil
+}
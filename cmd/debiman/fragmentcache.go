@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/stapelberg/debiman/internal/cas"
+	"github.com/stapelberg/debiman/internal/convert"
+	"github.com/stapelberg/debiman/internal/write"
+
+	"golang.org/x/net/html"
+)
+
+var useFragmentCache = flag.Bool("fragment_cache",
+	true,
+	"Cache the HTML fragments which mandoc produces in .fragmentcache/ in -serving_dir, keyed by the manpage source, mandoc and debiman’s converter. Re-rendering after a template change (see -force_rerender) then re-wraps the cached fragments instead of running mandoc again.")
+
+// cachedFragment is the postprocessed output of convertFile.
+type cachedFragment struct {
+	Content string
+	TOC     []string
+	// Refs maps each cross reference which was resolved while
+	// converting the manpage to its URL (empty if unresolved).
+	Refs map[string]string
+}
+
+// fragmentCache stores cachedFragments by the hash of their source (see
+// fragmentKey). Each combination of mandoc and converter version uses
+// its own directory, so that upgrading either invalidates all entries.
+type fragmentCache struct {
+	dir string
+	// store, if non-nil, deduplicates the cached fragments (see
+	// -dedupe).
+	store *cas.Store
+
+	mu sync.Mutex
+	// pages maps each rendered page (a path within -serving_dir) to the
+	// key of its fragment, see prune.
+	pages map[string]string
+}
+
+// openFragmentCache returns the fragment cache of -serving_dir and
+// removes the entries of other mandoc or converter versions. It returns
+// nil if -fragment_cache is not set. Entries are linked into store, if
+// non-nil.
+func openFragmentCache(store *cas.Store) (*fragmentCache, error) {
+	if !*useFragmentCache {
+		return nil, nil
+	}
+	mandocVersion, err := convert.MandocVersion()
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Join(*servingDir, ".fragmentcache")
+	version := fmt.Sprintf("%d-%s", convert.Version, mandocVersion)
+	fis, err := ioutil.ReadDir(root)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range fis {
+		if fi.Name() == version {
+			continue
+		}
+		log.Printf("Removing fragment cache %q of another mandoc or converter version", fi.Name())
+		if err := os.RemoveAll(filepath.Join(root, fi.Name())); err != nil {
+			return nil, err
+		}
+	}
+	c := &fragmentCache{dir: filepath.Join(root, version), store: store}
+	if err := c.loadPages(); err != nil {
+		log.Printf("WARNING: reading the pages of the fragment cache: %v", err)
+		c.pages = make(map[string]string)
+	}
+	return c, nil
+}
+
+func (c *fragmentCache) pagesPath() string {
+	return filepath.Join(c.dir, "pages.gob.gz")
+}
+
+// loadPages reads the pages recorded by the previous run, see prune.
+func (c *fragmentCache) loadPages() error {
+	c.pages = make(map[string]string)
+	f, err := os.Open(c.pagesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return gob.NewDecoder(r).Decode(&c.pages)
+}
+
+// use records that the page dest was rendered from the fragment key.
+func (c *fragmentCache) use(dest, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pages == nil {
+		c.pages = make(map[string]string)
+	}
+	c.pages[dest] = key
+}
+
+// prune removes the entries which are not used by any page, i.e. whose
+// page was re-rendered from a changed source or deleted, and persists
+// the pages for the next run. Entries which were not recorded (e.g.
+// written by an interrupted run) are removed as well.
+func (c *fragmentCache) prune() (removed int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	used := make(map[string]bool, len(c.pages))
+	for dest, key := range c.pages {
+		if _, err := serving.Stat(dest); os.IsNotExist(err) {
+			delete(c.pages, dest)
+			continue
+		}
+		used[key] = true
+	}
+	err = filepath.Walk(c.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(path, ".gob.gz") {
+			return nil
+		}
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		if filepath.Dir(rel) == "." {
+			return nil // e.g. pages.gob.gz
+		}
+		if used[filepath.Dir(rel)+strings.TrimSuffix(filepath.Base(rel), ".gob.gz")] {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return removed, err
+	}
+	return removed, write.Atomically(c.pagesPath(), true, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(c.pages)
+	})
+}
+
+func (c *fragmentCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key[2:]+".gob.gz")
+}
+
+// get returns the cached fragment for key, with its cross references
+// adjusted to resolve (see rewriteRefs).
+func (c *fragmentCache) get(key string, resolve func(ref string) string) (string, []string, error) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	var frag cachedFragment
+	if err := gob.NewDecoder(r).Decode(&frag); err != nil {
+		return "", nil, err
+	}
+	content, err := rewriteRefs(frag.Content, frag.Refs, resolve)
+	if err != nil {
+		return "", nil, err
+	}
+	return content, frag.TOC, nil
+}
+
+// put stores the output of convertFile for key.
+func (c *fragmentCache) put(key string, frag cachedFragment) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return write.Atomically(path, true, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(&frag)
+	})
+}
+
+// fragmentKey returns the hash of the manpage src (a path within
+// -serving_dir) and all files it includes via .so, i.e. of all input
+// which mandoc reads when converting src.
+func fragmentKey(src string) (string, error) {
+	h := sha256.New()
+	if err := hashSource(h, src, make(map[string]bool)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func hashSource(h hash.Hash, src string, seen map[string]bool) error {
+	if seen[src] {
+		return nil
+	}
+	seen[src] = true
+	f, err := serving.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := io.Reader(f)
+	if strings.HasSuffix(src, ".gz") {
+		gzr, err := gzip.NewReader(f)
+		if err == io.EOF {
+			// An empty manpage, see convertFile.
+			fmt.Fprintf(h, "empty\n")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+		r = gzr
+	}
+	var includes []string
+	scanner := bufio.NewScanner(io.TeeReader(r, h))
+	for scanner.Scan() {
+		// soElim rewrote all .so lines to paths within -serving_dir.
+		if line := scanner.Text(); strings.HasPrefix(line, ".so ") {
+			includes = append(includes, strings.TrimSpace(line[len(".so "):]))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for _, include := range includes {
+		fmt.Fprintf(h, "\n.so %s\n", include)
+		if err := hashSource(h, filepath.Join(*servingDir, include), seen); err != nil {
+			if os.IsNotExist(err) {
+				fmt.Fprintf(h, "missing\n")
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteRefs adjusts the cross references in content, an HTML fragment
+// which was converted with refs (see convertFile), to resolve. It
+// returns an error if a cross reference resolves in only one of the
+// contexts: the fragment would be structured differently.
+func rewriteRefs(content string, refs map[string]string, resolve func(ref string) string) (string, error) {
+	var oldnew []string
+	rewritten := make(map[string]string)
+	for ref, url := range refs {
+		other := resolve(ref)
+		if (url == "") != (other == "") {
+			return "", fmt.Errorf("cross reference %q resolves differently", ref)
+		}
+		if url == "" || url == other {
+			continue
+		}
+		if prev, ok := rewritten[url]; ok {
+			if prev != other {
+				return "", fmt.Errorf("cross reference %q resolves differently", ref)
+			}
+			continue
+		}
+		rewritten[url] = other
+		oldnew = append(oldnew,
+			`href="`+html.EscapeString(url)+`"`,
+			`href="`+html.EscapeString(other)+`"`)
+	}
+	return strings.NewReplacer(oldnew...).Replace(content), nil
+}
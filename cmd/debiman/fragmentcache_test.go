@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFragmentKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-fragmentcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flag.Set("serving_dir", dir)
+
+	writeGz := func(path, content string) {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, gzipped(t, content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := filepath.Join(dir, "testing/bash/builtins.7.en.gz")
+	writeGz("testing/bash/builtins.7.en.gz", ".so testing/bash/bash-builtins.7.en.gz\n")
+	writeGz("testing/bash/bash-builtins.7.en.gz", ".TH BASH-BUILTINS 7\n")
+
+	key, err := fragmentKey(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := fragmentKey(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != key {
+		t.Fatalf("fragmentKey() not stable: %q != %q", again, key)
+	}
+
+	writeGz("testing/bash/bash-builtins.7.en.gz", ".TH BASH-BUILTINS 7 2017\n")
+	changed, err := fragmentKey(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == key {
+		t.Fatalf("fragmentKey() unchanged after modifying a file included via .so")
+	}
+}
+
+func TestFragmentCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-fragmentcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &fragmentCache{dir: dir}
+	const key = "0123456789abcdef"
+	if _, _, err := c.get(key, nil); !os.IsNotExist(err) {
+		t.Fatalf("get() of a missing entry: got err %v, want a not-exist error", err)
+	}
+
+	frag := cachedFragment{
+		Content: `<div class="mandoc">See <a href="/testing/i3lock/i3lock.1.en.html">i3lock(1)</a> and x(1).</div>`,
+		TOC:     []string{"NAME", "SEE ALSO"},
+		Refs: map[string]string{
+			"i3lock(1)": "/testing/i3lock/i3lock.1.en.html",
+			"x(1)":      "",
+		},
+	}
+	if err := c.put(key, frag); err != nil {
+		t.Fatal(err)
+	}
+
+	content, toc, err := c.get(key, func(ref string) string {
+		if ref == "i3lock(1)" {
+			return "/unstable/i3lock/i3lock.1.en.html"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<div class="mandoc">See <a href="/unstable/i3lock/i3lock.1.en.html">i3lock(1)</a> and x(1).</div>`
+	if content != want {
+		t.Errorf("get() = %q, want %q", content, want)
+	}
+	if !reflect.DeepEqual(toc, frag.TOC) {
+		t.Errorf("unexpected TOC: got %q, want %q", toc, frag.TOC)
+	}
+
+	// x(1) now resolves, i.e. mandoc’s output needs to be post-processed
+	// differently.
+	if _, _, err := c.get(key, func(ref string) string {
+		return "/unstable/x/" + ref
+	}); err == nil {
+		t.Fatalf("get() unexpectedly succeeded with a cross reference which resolves differently")
+	}
+}
+
+func TestFragmentCachePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-fragmentcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flag.Set("serving_dir", dir)
+
+	live := filepath.Join(dir, "testing/i3-wm/i3.1.en.html.gz")
+	if err := os.MkdirAll(filepath.Dir(live), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(live, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &fragmentCache{dir: filepath.Join(dir, ".fragmentcache", "1-1.14.1")}
+	const (
+		usedKey     = "0123456789abcdef"
+		deletedKey  = "1123456789abcdef"
+		replacedKey = "2123456789abcdef"
+	)
+	for _, key := range []string{usedKey, deletedKey, replacedKey} {
+		if err := c.put(key, cachedFragment{Content: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.use(live, replacedKey)
+	c.use(live, usedKey)
+	c.use(filepath.Join(dir, "testing/i3-wm/i3bar.1.en.html.gz"), deletedKey)
+
+	removed, err := c.prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := removed, 2; got != want {
+		t.Errorf("prune() removed %d entries, want %d", got, want)
+	}
+	for _, tt := range []struct {
+		key  string
+		want bool
+	}{
+		{usedKey, true},
+		{deletedKey, false},
+		{replacedKey, false},
+	} {
+		_, err := os.Stat(c.path(tt.key))
+		if got := err == nil; got != tt.want {
+			t.Errorf("entry %s present = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+
+	reopened := &fragmentCache{dir: c.dir}
+	if err := reopened.loadPages(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{live: usedKey}
+	if !reflect.DeepEqual(reopened.pages, want) {
+		t.Errorf("loadPages() = %v, want %v", reopened.pages, want)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/manpage"
+
+	"pault.ag/go/debian/version"
+)
+
+var (
+	fsTree = flag.String("fs_tree",
+		"",
+		"If non-empty, the root of an unpacked filesystem tree (e.g. an installed system image or the DESTDIR of an upstream build) whose usr/share/man is served as the suite -fs_tree_suite. Manpages are attributed to packages using the dpkg database in var/lib/dpkg, if present.")
+
+	fsTreeSuite = flag.String("fs_tree_suite",
+		"system",
+		"Name of the pseudo-suite containing the manpages from -fs_tree")
+
+	fsTreePackage = flag.String("fs_tree_package",
+		"unpackaged",
+		"Name of the pseudo-package containing the manpages from -fs_tree which do not belong to any package in the dpkg database")
+)
+
+// readDpkgStatus returns the installed packages listed in the dpkg
+// status file at path, keyed by package name.
+func readDpkgStatus(path string) (map[string]*pkgEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	installed := make(map[string]*pkgEntry)
+	fields := make(map[string]string)
+	flush := func() error {
+		defer func() { fields = make(map[string]string) }()
+		status := strings.Fields(fields["Status"])
+		if fields["Package"] == "" || len(status) == 0 || status[len(status)-1] != "installed" {
+			return nil
+		}
+		v, err := version.Parse(fields["Version"])
+		if err != nil {
+			return fmt.Errorf("package %q: %v", fields["Package"], err)
+		}
+		p := &pkgEntry{
+			source:    fields["Source"],
+			binarypkg: fields["Package"],
+			arch:      fields["Architecture"],
+			version:   v,
+			replaces:  parseReplaces(fields["Replaces"]),
+		}
+		if p.source == "" {
+			p.source = p.binarypkg
+		}
+		// e.g. “Source: gcc-defaults (1.150)”
+		if idx := strings.Index(p.source, " "); idx > -1 {
+			p.source = p.source[:idx]
+		}
+		// With multi-arch, a package can be installed for multiple
+		// architectures. Its manpages are shared, so either entry will do.
+		installed[p.binarypkg] = p
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue // continuation line
+		}
+		if idx := strings.Index(line, ":"); idx > -1 {
+			fields[line[:idx]] = strings.TrimSpace(line[idx+1:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return installed, nil
+}
+
+// readDpkgLists returns the package owning each file underneath
+// /usr/share/man, according to the *.list files in dir.
+func readDpkgLists(dir string) (map[string]string, error) {
+	lists, err := filepath.Glob(filepath.Join(dir, "*.list"))
+	if err != nil {
+		return nil, err
+	}
+	owner := make(map[string]string)
+	for _, list := range lists {
+		// e.g. “coreutils.list” or “libc6:amd64.list”
+		pkg := strings.TrimSuffix(filepath.Base(list), ".list")
+		if idx := strings.Index(pkg, ":"); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		b, err := ioutil.ReadFile(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(path, "/usr/share/man/") {
+				owner[path] = pkg
+			}
+		}
+	}
+	return owner, nil
+}
+
+// scanTree finds the manpages underneath usr/share/man in the
+// filesystem tree at root, like scanLocalDebs does for .deb files.
+// Manpages which are not owned by an installed package according to
+// the dpkg database in var/lib/dpkg are attributed to pseudoPkg.
+func scanTree(root, suite, pseudoPkg string) ([]*pkgEntry, []*contentEntry, map[string]*manpage.PkgMeta, error) {
+	manDir := filepath.Join(root, "usr", "share", "man")
+	if _, err := os.Stat(manDir); err != nil {
+		return nil, nil, nil, err
+	}
+
+	dpkgDir := filepath.Join(root, "var", "lib", "dpkg")
+	installed, err := readDpkgStatus(filepath.Join(dpkgDir, "status"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, nil, fmt.Errorf("reading dpkg status: %v", err)
+	}
+	var owner map[string]string
+	if installed != nil {
+		owner, err = readDpkgLists(filepath.Join(dpkgDir, "info"))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("reading dpkg file lists: %v", err)
+		}
+		log.Printf("Attributing manpages in %q to %d installed packages", root, len(installed))
+	}
+
+	pkgs := make(map[string]*pkgEntry)
+	var content []*contentEntry
+	// newest is the modification time of the newest unowned file or
+	// directory, from which the version of pseudoPkg is derived: adding
+	// or deleting a file updates the modification time of its directory.
+	var newest time.Time
+	err = filepath.Walk(manDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.ModTime().After(newest) {
+				newest = info.ModTime()
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(manDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if _, err := manpage.FromManPath(rel, &manpage.PkgMeta{Binarypkg: pseudoPkg, Suite: suite}); err != nil {
+			log.Printf("Skipping %q: %v", path, err)
+			return nil
+		}
+
+		binarypkg := pseudoPkg
+		if o, ok := owner["/usr/share/man/"+rel]; ok && installed[o] != nil {
+			binarypkg = o
+		} else if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		p, ok := pkgs[binarypkg]
+		if !ok {
+			p = &pkgEntry{
+				source:    binarypkg,
+				binarypkg: binarypkg,
+				arch:      "all",
+			}
+			if i := installed[binarypkg]; i != nil && binarypkg != pseudoPkg {
+				*p = *i
+			}
+			p.suite = suite
+			p.tree = root
+			pkgs[binarypkg] = p
+		}
+		p.files = append(p.files, "usr/share/man/"+rel)
+		p.bytes += info.Size()
+		content = append(content, &contentEntry{
+			suite:     suite,
+			arch:      p.arch,
+			binarypkg: binarypkg,
+			filename:  rel,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if p, ok := pkgs[pseudoPkg]; ok {
+		p.version, err = version.Parse(newest.UTC().Format("20060102.150405"))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	names := make([]string, 0, len(pkgs))
+	for binarypkg := range pkgs {
+		names = append(names, binarypkg)
+	}
+	sort.Strings(names)
+	result := make([]*pkgEntry, 0, len(names))
+	latestVersion := make(map[string]*manpage.PkgMeta, len(names))
+	for _, binarypkg := range names {
+		p := pkgs[binarypkg]
+		result = append(result, p)
+		latestVersion[suite+"/"+binarypkg] = &manpage.PkgMeta{
+			Replaces:  p.replaces,
+			Sourcepkg: p.source,
+			Binarypkg: p.binarypkg,
+			Suite:     p.suite,
+			Version:   p.version,
+		}
+	}
+	return result, content, latestVersion, nil
+}
+
+// treeReader provides files of a filesystem tree like a *tar.Reader
+// provides the files of a .deb file, so that downloadPkg can extract
+// both in the same way.
+type treeReader struct {
+	root string
+	// names are the files to provide, relative to root.
+	names []string
+	cur   io.Reader
+}
+
+func newTreeReader(root string, names []string) *treeReader {
+	return &treeReader{root: root, names: names}
+}
+
+// Next advances to the next file. Files which do not exist (e.g. the
+// target of a dangling .so reference) are skipped.
+func (t *treeReader) Next() (*tar.Header, error) {
+	t.cur = nil
+	for len(t.names) > 0 {
+		// Cleaning the name as an absolute path ensures that it cannot
+		// refer to a file outside of root, e.g. via “..”.
+		name := filepath.Clean("/" + t.names[0])
+		t.names = t.names[1:]
+		path := filepath.Join(t.root, name)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		var link string
+		switch {
+		case fi.Mode().IsRegular():
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			t.cur = bytes.NewReader(b)
+		case fi.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return nil, err
+		}
+		header.Name = "." + filepath.ToSlash(name)
+		return header, nil
+	}
+	return nil, io.EOF
+}
+
+func (t *treeReader) Read(p []byte) (int, error) {
+	if t.cur == nil {
+		return 0, io.EOF
+	}
+	return t.cur.Read(p)
+}
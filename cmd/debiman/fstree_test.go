@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeTree creates a filesystem tree containing manpages of the
+// installed package coreutils and an unpackaged manpage.
+func writeTree(t *testing.T, root string) {
+	for path, content := range map[string][]byte{
+		"usr/share/man/man1/ls.1.gz":       gzipped(t, ".TH LS 1\n"),
+		"usr/share/man/man8/custom.8":      []byte(".TH CUSTOM 8\n"),
+		"usr/share/man/index.db":           []byte("man-db cache"),
+		"var/lib/dpkg/info/coreutils.list": []byte("/.\n/bin/ls\n/usr/share/man/man1/ls.1.gz\n/usr/share/man/man1/dir.1.gz\n"),
+		"var/lib/dpkg/info/removed.list":   []byte("/usr/share/man/man8/custom.8\n"),
+		"var/lib/dpkg/status": []byte(`Package: coreutils
+Status: install ok installed
+Architecture: amd64
+Version: 8.26-3
+Replaces: mktemp, realpath
+Description: GNU core utilities
+ This package contains the basic file, shell and text manipulation
+ utilities which are expected to exist on every operating system.
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0-1
+`),
+	} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("ls.1.gz", filepath.Join(root, "usr/share/man/man1/dir.1.gz")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanTree(t *testing.T) {
+	root, err := ioutil.TempDir("", "debiman-fstree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeTree(t, root)
+
+	pkgs, content, latestVersion, err := scanTree(root, "system", "unpackaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(pkgs), 2; got != want {
+		t.Fatalf("unexpected number of packages: got %d, want %d", got, want)
+	}
+
+	coreutils := pkgs[0]
+	if got, want := coreutils.suite+"/"+coreutils.binarypkg, "system/coreutils"; got != want {
+		t.Errorf("unexpected package: got %q, want %q", got, want)
+	}
+	if got, want := coreutils.version.String(), "8.26-3"; got != want {
+		t.Errorf("unexpected version: got %q, want %q", got, want)
+	}
+	if got, want := coreutils.replaces, []string{"mktemp", "realpath"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected replaces: got %q, want %q", got, want)
+	}
+	if got, want := coreutils.files, []string{"usr/share/man/man1/dir.1.gz", "usr/share/man/man1/ls.1.gz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected files: got %q, want %q", got, want)
+	}
+
+	// custom.8 is listed by a package which is no longer installed.
+	unpackaged := pkgs[1]
+	if got, want := unpackaged.suite+"/"+unpackaged.binarypkg, "system/unpackaged"; got != want {
+		t.Errorf("unexpected package: got %q, want %q", got, want)
+	}
+	if got, want := unpackaged.files, []string{"usr/share/man/man8/custom.8"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected files: got %q, want %q", got, want)
+	}
+	if unpackaged.version.String() == "" {
+		t.Errorf("pseudo-package has no version")
+	}
+
+	// index.db is not a manpage.
+	if got, want := len(content), 3; got != want {
+		t.Errorf("unexpected number of manpages: got %d, want %d", got, want)
+	}
+	for _, key := range []string{"system/coreutils", "system/unpackaged"} {
+		if _, ok := latestVersion[key]; !ok {
+			t.Errorf("latestVersion does not contain %s", key)
+		}
+	}
+}
+
+func TestScanTreeWithoutDpkg(t *testing.T) {
+	root, err := ioutil.TempDir("", "debiman-fstree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeTree(t, root)
+	if err := os.RemoveAll(filepath.Join(root, "var")); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs, content, _, err := scanTree(root, "build", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(pkgs), 1; got != want {
+		t.Fatalf("unexpected number of packages: got %d, want %d", got, want)
+	}
+	if got, want := pkgs[0].suite+"/"+pkgs[0].binarypkg, "build/hello"; got != want {
+		t.Errorf("unexpected package: got %q, want %q", got, want)
+	}
+	if got, want := len(content), 3; got != want {
+		t.Errorf("unexpected number of manpages: got %d, want %d", got, want)
+	}
+}
+
+func TestTreeReader(t *testing.T) {
+	root, err := ioutil.TempDir("", "debiman-fstree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeTree(t, root)
+
+	r := newTreeReader(filepath.Join(root, "usr"), []string{
+		"share/man/man8/custom.8",
+		"share/man/man1/dir.1.gz",
+		"share/missing.inc",
+		// Must not escape root.
+		"../var/lib/dpkg/status",
+	})
+	header, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := header.Name, "./share/man/man8/custom.8"; got != want {
+		t.Errorf("unexpected name: got %q, want %q", got, want)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), ".TH CUSTOM 8\n"; got != want {
+		t.Errorf("unexpected content: got %q, want %q", got, want)
+	}
+
+	header, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := header.Linkname, "ls.1.gz"; got != want {
+		t.Errorf("unexpected link target: got %q, want %q", got, want)
+	}
+
+	if header, err := r.Next(); err == nil {
+		t.Errorf("unexpected file %q", header.Name)
+	}
+}
+
+func TestDownloadTree(t *testing.T) {
+	root, err := ioutil.TempDir("", "debiman-fstree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	writeTree(t, root)
+
+	dir, err := ioutil.TempDir("", "debiman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flag.Set("serving_dir", dir)
+
+	pkgs, content, _, err := scanTree(root, "system", "unpackaged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gv := globalView{
+		contentByPath: make(map[string][]*contentEntry),
+		deletions:     &pendingDeletions{path: filepath.Join(dir, "deletions.json"), since: make(map[string]time.Time)},
+		report:        &runReport{},
+		stats:         &stats{},
+	}
+	for _, c := range content {
+		gv.contentByPath[c.filename] = append(gv.contentByPath[c.filename], c)
+	}
+	for _, p := range pkgs {
+		if err := downloadPkg(nil, *p, gv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{
+		"system/coreutils/ls.1.en.gz",
+		"system/coreutils/dir.1.en.gz",
+		"system/unpackaged/custom.8.en.gz",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Error(err)
+		}
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "system/coreutils/dir.1.en.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("dir.1.en.gz is not a symlink")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "system/coreutils/VERSION"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "8.26-3"; got != want {
+		t.Errorf("unexpected VERSION: got %q, want %q", got, want)
+	}
+}
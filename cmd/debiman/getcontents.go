@@ -3,13 +3,13 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"fmt"
 	"io"
-	"log"
 	"os"
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/stapelberg/debiman/internal/distro"
+
 	"pault.ag/go/archive"
 	"pault.ag/go/debian/control"
 )
@@ -58,7 +58,7 @@ func parseContentsEntry(scanner *bufio.Scanner) ([]*contentEntry, error) {
 	return nil, io.EOF
 }
 
-func getContents(ar *archive.Downloader, suite string, component string, archs []string, hashByFilename map[string]*control.SHA256FileHash) ([]*contentEntry, error) {
+func getContents(ar *mirrorPool, suite string, component string, archs []string, hashByFilename map[string]*control.SHA256FileHash) ([]*contentEntry, error) {
 	files := make([]*os.File, len(archs))
 	scanners := make([]*bufio.Scanner, len(archs))
 	contents := make([][]*contentEntry, len(archs))
@@ -70,14 +70,11 @@ func getContents(ar *archive.Downloader, suite string, component string, archs [
 		arch := arch // copy
 		eg.Go(func() error {
 			path := component + "/Contents-" + arch + ".gz"
-			fh, ok := hashByFilename[path]
-			if !ok {
-				return fmt.Errorf("ERROR: expected path %q not found in Release file", path)
+			if component == "" {
+				// Contents files are per suite, not per component.
+				path = "Contents-" + arch + ".gz"
 			}
-
-			log.Printf("getting %q (hash %v)", suite+"/"+path, fh.Hash)
-			fh.Filename = "dists/" + suite + "/" + fh.Filename
-			r, err := ar.TempFile(fh.FileHash)
+			r, err := fetchIndex(ar, "dists/"+suite+"/", suite, path, hashByFilename)
 			if err != nil {
 				return err
 			}
@@ -173,12 +170,14 @@ func getContents(ar *archive.Downloader, suite string, component string, archs [
 	return entries, nil
 }
 
-func getAllContents(ar *archive.Downloader, suite string, release *archive.Release, hashByFilename map[string]*control.SHA256FileHash) ([]*contentEntry, error) {
+func getAllContents(ar *mirrorPool, suite string, components []string, release *archive.Release, hashByFilename map[string]*control.SHA256FileHash) ([]*contentEntry, error) {
 	// We skip archAll, because there is no Contents-all file. The
 	// contents of Architecture: all packages are included in the
 	// architecture-specific Contents-* files.
 
-	var components = [...]string{"main", "contrib"}
+	if !distro.Current().Layout.ContentsPerComponent {
+		components = []string{""}
+	}
 	parts := make([][]*contentEntry, len(components))
 	var sum int
 	for idx, component := range components {
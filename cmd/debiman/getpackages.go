@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/hex"
-	"fmt"
 	"io"
 	"log"
 	"os"
@@ -13,6 +12,7 @@ import (
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/stapelberg/debiman/internal/distro"
 	"github.com/stapelberg/debiman/internal/manpage"
 
 	"pault.ag/go/archive"
@@ -30,6 +30,13 @@ type pkgEntry struct {
 	sha256    []byte
 	bytes     int64
 	replaces  []string
+	// local is true if filename refers to a .deb file in -local_debs
+	// instead of a file in the archive.
+	local bool
+	// tree is the root of the filesystem tree (see -fs_tree) which
+	// contains files, the manpages of this package (relative to tree).
+	tree  string
+	files []string
 }
 
 // TODO(later): containsMans could be a map[string]bool, if only all
@@ -55,7 +62,7 @@ func buildContainsMains(content []*contentEntry, links map[string][]link) map[st
 		idx := strings.Index(key, "/")
 		binarypkg := key[idx+1:]
 		if containsMans[binarypkg] == nil {
-			containsMans[binarypkg] = map[string]bool{mostPopularArchitecture: true}
+			containsMans[binarypkg] = map[string]bool{distro.Current().Layout.PreferredArchitecture: true}
 		}
 	}
 	log.Printf("%d content entries, %d packages\n", len(content), len(containsMans))
@@ -165,7 +172,7 @@ func done(exhausted []bool) bool {
 	return true
 }
 
-func getPackages(ar *archive.Downloader, rd *archive.ReleaseDownloader, suite string, component string, archs []string, hashByFilename map[string]*control.SHA256FileHash, containsMans map[string]map[string]bool) ([]*pkgEntry, map[string]*manpage.PkgMeta, error) {
+func getPackages(ar *mirrorPool, rd *releaseDownloader, suite string, component string, archs []string, hashByFilename map[string]*control.SHA256FileHash, containsMans map[string]map[string]bool) ([]*pkgEntry, map[string]*manpage.PkgMeta, error) {
 	files := make([]*os.File, len(archs))
 	scanners := make([]*bufio.Scanner, len(archs))
 	pkgs := make([]pkgEntry, len(archs))
@@ -178,17 +185,10 @@ func getPackages(ar *archive.Downloader, rd *archive.ReleaseDownloader, suite st
 		eg.Go(func() error {
 			// Prefer gzip over xz because gzip uncompresses faster.
 			path := component + "/binary-" + arch + "/Packages.gz"
-			fh, ok := hashByFilename[path]
-			if !ok {
+			if _, ok := hashByFilename[path]; !ok {
 				path = component + "/binary-" + arch + "/Packages.xz"
-				fh, ok = hashByFilename[path]
-				if !ok {
-					return fmt.Errorf("ERROR: expected path %q not found in Release file", path)
-				}
 			}
-
-			log.Printf("getting %q (hash %v)", suite+"/"+path, fh.Hash)
-			r, err := rd.TempFile(fh.FileHash)
+			r, err := fetchIndex(rd, "", suite, path, hashByFilename)
 			if err != nil {
 				return err
 			}
@@ -280,7 +280,7 @@ func getPackages(ar *archive.Downloader, rd *archive.ReleaseDownloader, suite st
 			if p.version != newest.version {
 				continue
 			}
-			if p.arch == mostPopularArchitecture {
+			if p.arch == distro.Current().Layout.PreferredArchitecture {
 				best = &(pkgs[idx])
 				break
 			}
@@ -323,8 +323,7 @@ func getPackages(ar *archive.Downloader, rd *archive.ReleaseDownloader, suite st
 	return result, latestVersion, nil
 }
 
-func getAllPackages(ar *archive.Downloader, rd *archive.ReleaseDownloader, suite string, release *archive.Release, hashByFilename map[string]*control.SHA256FileHash, containsMans map[string]map[string]bool) ([]*pkgEntry, map[string]*manpage.PkgMeta, error) {
-	var components = [...]string{"main", "contrib"}
+func getAllPackages(ar *mirrorPool, rd *releaseDownloader, suite string, components []string, release *archive.Release, hashByFilename map[string]*control.SHA256FileHash, containsMans map[string]map[string]bool) ([]*pkgEntry, map[string]*manpage.PkgMeta, error) {
 	partsp := make([][]*pkgEntry, len(components))
 	partsl := make([]map[string]*manpage.PkgMeta, len(components))
 	latestVersion := make(map[string]*manpage.PkgMeta)
@@ -3,6 +3,7 @@ package main
 import (
 	"compress/gzip"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -13,17 +14,16 @@ import (
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/stapelberg/debiman/internal/cas"
 	"github.com/stapelberg/debiman/internal/manpage"
 
 	"pault.ag/go/archive"
 	"pault.ag/go/debian/control"
 )
 
-// mostPopularArchitecture is used as preferred architecture when we
-// need to pick an arbitrary architecture. The rationale is that
-// downloading the package for the most popular architecture has the
-// least bad influence on the mirror server’s caches.
-const mostPopularArchitecture = "amd64"
+var syncComponents = flag.String("components",
+	"main,contrib",
+	"Comma-separated list of archive components to synchronize (e.g. main,contrib,non-free,non-free-firmware). Components which are not listed in a suite’s Release file are ignored. If empty, all components of the Release file are synchronized.")
 
 type stats struct {
 	PackagesExtracted uint64
@@ -31,7 +31,10 @@ type stats struct {
 	ManpagesRendered  uint64
 	ManpageBytes      uint64
 	HtmlBytes         uint64
+	TextBytes         uint64
 	IndexBytes        uint64
+	StoreBytes        uint64
+	StoreSavedBytes   uint64
 }
 
 type link struct {
@@ -64,6 +67,45 @@ type globalView struct {
 	// links (from→to pairs).
 	alternatives map[string][]link
 
+	// suiteOrder lists all suites from oldest to newest, as derived
+	// from their Release files (see orderSuites).
+	suiteOrder []string
+
+	// defaultSuite is the suite to which debiman-auxserver redirects
+	// if no suite was specified, typically the current stable release.
+	defaultSuite string
+
+	// deletions tracks files which are no longer present in the
+	// archive and will be deleted after a grace period.
+	deletions *pendingDeletions
+
+	// quarantine tracks packages which failed in previous runs, budget
+	// limits the number of failures tolerated in this run.
+	quarantine *quarantine
+	budget     *budget
+
+	// resumeSince is the start of the interrupted run which this run
+	// resumes (see checkpoint), or zero. Forced re-extraction and
+	// re-rendering skip files written after resumeSince.
+	resumeSince time.Time
+
+	// assets tracks re-rendering manpages after the assets changed.
+	assets *assetState
+	// outputs tracks adding renderings of new formats (e.g. text) to
+	// existing manpages.
+	outputs *assetState
+
+	// report collects problems encountered during this run.
+	report *runReport
+
+	// store, if non-nil, deduplicates extracted and rendered files
+	// (see -dedupe).
+	store *cas.Store
+
+	// fragmentCache, if non-nil, stores converted manpages across runs
+	// (see -fragment_cache). Set by renderAll.
+	fragmentCache *fragmentCache
+
 	stats *stats
 	start time.Time
 }
@@ -151,10 +193,13 @@ func parseAlternativesDir(dir string) (map[string][]link, error) {
 		return nil, err
 	}
 	results := make([]map[string][]link, len(infos))
+	sem := make(chan struct{}, *discoverConcurrency)
 	var eg errgroup.Group
 	for idx, fi := range infos {
 		idx, fi := idx, fi // copy
 		eg.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
 			suite := strings.TrimSuffix(fi.Name(), ".json.gz")
 			res, err := parseAlternativesFile(filepath.Join(dir, fi.Name()), suite)
 			results[idx] = res
@@ -176,6 +221,35 @@ func parseAlternativesDir(dir string) (map[string][]link, error) {
 	return merged, nil
 }
 
+// addXref adds the manpages in content (and the slave alternative
+// links of their packages) to the global view of all manpages, which
+// is required for cross-referencing.
+func (res *globalView) addXref(content []*contentEntry, latestVersion map[string]*manpage.PkgMeta) {
+	knownIssues := make(map[string][]error)
+
+	// TODO(issue): edge case: packages which got renamed between releases
+	for _, c := range content {
+		key := c.suite + "/" + c.binarypkg
+		if err := markPresent(latestVersion, res.xref, c.filename, key); err != nil {
+			knownIssues[key] = append(knownIssues[key], err)
+		}
+	}
+
+	for key, links := range res.alternatives {
+		for _, link := range links {
+			log.Printf("key=%q, link=%v, latest = %v", key, link, latestVersion[key])
+			if err := markPresent(latestVersion, res.xref, strings.TrimPrefix(link.from, "/"), key); err != nil {
+				knownIssues[key] = append(knownIssues[key], err)
+			}
+		}
+	}
+
+	for key, errors := range knownIssues {
+		log.Printf("package %q has errors: %v", key, errors)
+	}
+	res.report.knownIssues(knownIssues)
+}
+
 func markPresent(latestVersion map[string]*manpage.PkgMeta, xref map[string][]*manpage.Meta, filename string, key string) error {
 	if _, ok := latestVersion[key]; !ok {
 		return fmt.Errorf("Could not determine latest version")
@@ -203,13 +277,107 @@ func markPresent(latestVersion map[string]*manpage.PkgMeta, xref map[string][]*m
 	return nil
 }
 
-func buildGlobalView(ar *archive.Downloader, dists []distribution, alternativesDir string, start time.Time) (globalView, error) {
+// releaseComponents returns the components of release (e.g. main,
+// contrib, non-free, non-free-firmware) which are included in the
+// comma-separated filter, in the order of the Release file. An empty
+// filter includes all components.
+func releaseComponents(release *archive.Release, filter string) []string {
+	var include map[string]bool
+	if strings.TrimSpace(filter) != "" {
+		include = make(map[string]bool)
+		for _, c := range strings.Split(filter, ",") {
+			include[strings.TrimSpace(c)] = true
+		}
+	}
+	var components []string
+	for _, c := range release.Components {
+		if include != nil && !include[c] {
+			continue
+		}
+		components = append(components, c)
+	}
+	return components
+}
+
+// suiteIndex contains the parsed indices of a suite.
+type suiteIndex struct {
+	suite         string
+	release       *archive.Release
+	content       []*contentEntry
+	pkgs          []*pkgEntry
+	latestVersion map[string]*manpage.PkgMeta
+}
+
+// loadSuiteIndex downloads and parses the indices of dist, or reads
+// them from the index cache if its Release file did not change.
+func loadSuiteIndex(ar *mirrorPool, dist distribution, alternatives map[string][]link) (suiteIndex, error) {
+	release, rd, err := ar.Release(dist.name)
+	if err != nil {
+		return suiteIndex{}, err
+	}
+
+	si := suiteIndex{release: release}
+	if dist.identifier == fromCodename {
+		si.suite = release.Codename // e.g. “stretch”
+	} else {
+		si.suite = release.Suite // e.g. “stable”
+	}
+	suite := si.suite
+
+	hashByFilename := make(map[string]*control.SHA256FileHash, len(release.SHA256))
+	for idx, fh := range release.SHA256 {
+		// fh.Filename contains e.g. “non-free/source/Sources”
+		hashByFilename[fh.Filename] = &(release.SHA256[idx])
+	}
+
+	components := releaseComponents(release, *syncComponents)
+	log.Printf("Using components %q of suite %q", components, suite)
+
+	archs := make([]string, len(release.Architectures))
+	for idx, arch := range release.Architectures {
+		archs[idx] = arch.String()
+	}
+	cachePath := indexCachePath(suite)
+	cacheKey := indexCacheKey(components, archs, release.SHA256, alternatives)
+
+	stageStart := time.Now()
+	si.content, si.pkgs, si.latestVersion, err = readIndexCache(cachePath, cacheKey)
+	if err == nil {
+		log.Printf("Reusing the parsed indices of suite %q (unchanged Release file hashes)", suite)
+		runMetrics.set("stage_duration_seconds", metricLabels("stage", "indexcache", "suite", suite), time.Since(stageStart).Seconds())
+		return si, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Printf("Not reusing the parsed indices of suite %q: %v", suite, err)
+	}
+	si.content, err = getAllContents(ar, suite, components, release, hashByFilename)
+	if err != nil {
+		return si, err
+	}
+	runMetrics.set("stage_duration_seconds", metricLabels("stage", "contents", "suite", suite), time.Since(stageStart).Seconds())
+
+	// Collect package download work units
+	stageStart = time.Now()
+	si.pkgs, si.latestVersion, err = getAllPackages(ar, rd, suite, components, release, hashByFilename, buildContainsMains(si.content, alternatives))
+	if err != nil {
+		return si, err
+	}
+	runMetrics.set("stage_duration_seconds", metricLabels("stage", "packages", "suite", suite), time.Since(stageStart).Seconds())
+
+	if err := writeIndexCache(cachePath, cacheKey, si.content, si.pkgs, si.latestVersion); err != nil {
+		log.Printf("WARNING: caching the parsed indices of suite %q: %v", suite, err)
+	}
+	return si, nil
+}
+
+func buildGlobalView(ar *mirrorPool, dists []distribution, alternativesDir string, start time.Time) (globalView, error) {
 	var stats stats
 	res := globalView{
 		suites:        make(map[string]bool, len(dists)),
 		idxSuites:     make(map[string]string, len(dists)),
 		contentByPath: make(map[string][]*contentEntry),
 		xref:          make(map[string][]*manpage.Meta),
+		report:        newRunReport(start),
 		stats:         &stats,
 		start:         start,
 	}
@@ -220,77 +388,81 @@ func buildGlobalView(ar *archive.Downloader, dists []distribution, alternativesD
 		return res, err
 	}
 
-	for _, dist := range dists {
-		release, rd, err := ar.Release(dist.name)
-		if err != nil {
-			return res, err
-		}
-
-		var suite string
-		if dist.identifier == fromCodename {
-			suite = release.Codename // e.g. “stretch”
-		} else {
-			suite = release.Suite // e.g. “stable”
-		}
+	// The indices of up to -concurrency_discover suites are downloaded
+	// and parsed at the same time. They are added to the globalView in
+	// the order of dists.
+	indices := make([]suiteIndex, len(dists))
+	sem := make(chan struct{}, *discoverConcurrency)
+	var eg errgroup.Group
+	for idx, dist := range dists {
+		idx, dist := idx, dist // copy
+		eg.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			var err error
+			indices[idx], err = loadSuiteIndex(ar, dist, res.alternatives)
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return res, err
+	}
 
+	var infos []suiteInfo
+	for idx, dist := range dists {
+		si := indices[idx]
+		suite := si.suite
 		res.suites[suite] = true
-		res.idxSuites[release.Suite] = suite
-		res.idxSuites[release.Codename] = suite
+		res.idxSuites[si.release.Suite] = suite
+		res.idxSuites[si.release.Codename] = suite
 		res.idxSuites[dist.name] = suite
+		infos = append(infos, suiteInfoFromRelease(suite, si.release))
 
-		hashByFilename := make(map[string]*control.SHA256FileHash, len(release.SHA256))
-		for idx, fh := range release.SHA256 {
-			// fh.Filename contains e.g. “non-free/source/Sources”
-			hashByFilename[fh.Filename] = &(release.SHA256[idx])
-		}
-
-		content, err := getAllContents(ar, suite, release, hashByFilename)
-		if err != nil {
-			return res, err
-		}
-
-		for _, c := range content {
+		for _, c := range si.content {
 			res.contentByPath[c.filename] = append(res.contentByPath[c.filename], c)
 		}
+		log.Printf("Adding %d packages from suite %q", len(si.pkgs), suite)
+		res.pkgs = append(res.pkgs, si.pkgs...)
 
-		var latestVersion map[string]*manpage.PkgMeta
-		{
-			// Collect package download work units
-			var pkgs []*pkgEntry
-			var err error
-			pkgs, latestVersion, err = getAllPackages(ar, rd, suite, release, hashByFilename, buildContainsMains(content, res.alternatives))
-			if err != nil {
-				return res, err
-			}
-
-			log.Printf("Adding %d packages from suite %q", len(pkgs), suite)
-			res.pkgs = append(res.pkgs, pkgs...)
+		stageStart := time.Now()
+		res.addXref(si.content, si.latestVersion)
+		runMetrics.set("stage_duration_seconds", metricLabels("stage", "xref", "suite", suite), time.Since(stageStart).Seconds())
+	}
+	// addPseudoSuite adds packages which are not part of any archive.
+	addPseudoSuite := func(suite string, pkgs []*pkgEntry, content []*contentEntry, latestVersion map[string]*manpage.PkgMeta) {
+		if !res.suites[suite] {
+			res.suites[suite] = true
+			res.idxSuites[suite] = suite
+			// Without a Release file, the suite is ordered after all
+			// archive suites.
+			infos = append(infos, suiteInfo{name: suite, suite: suite, codename: suite})
 		}
-
-		knownIssues := make(map[string][]error)
-
-		// Build a global view of all the manpages (required for cross-referencing).
-		// TODO(issue): edge case: packages which got renamed between releases
+		res.pkgs = append(res.pkgs, pkgs...)
 		for _, c := range content {
-			key := c.suite + "/" + c.binarypkg
-			if err := markPresent(latestVersion, res.xref, c.filename, key); err != nil {
-				knownIssues[key] = append(knownIssues[key], err)
-			}
+			res.contentByPath[c.filename] = append(res.contentByPath[c.filename], c)
 		}
-
-		for key, links := range res.alternatives {
-			for _, link := range links {
-				log.Printf("key=%q, link=%v, latest = %v", key, link, latestVersion[key])
-				if err := markPresent(latestVersion, res.xref, strings.TrimPrefix(link.from, "/"), key); err != nil {
-					knownIssues[key] = append(knownIssues[key], err)
-				}
-			}
+		res.addXref(content, latestVersion)
+	}
+	if *localDebs != "" {
+		suite := *localSuite
+		pkgs, content, latestVersion, err := scanLocalDebs(*localDebs, suite)
+		if err != nil {
+			return res, fmt.Errorf("reading -local_debs: %v", err)
 		}
-
-		for key, errors := range knownIssues {
-			// TODO: write these to a known-issues file, parse bug numbers from an auxiliary file
-			log.Printf("package %q has errors: %v", key, errors)
+		log.Printf("Adding %d packages from %q as suite %q", len(pkgs), *localDebs, suite)
+		addPseudoSuite(suite, pkgs, content, latestVersion)
+	}
+	if *fsTree != "" {
+		suite := *fsTreeSuite
+		pkgs, content, latestVersion, err := scanTree(*fsTree, suite, *fsTreePackage)
+		if err != nil {
+			return res, fmt.Errorf("reading -fs_tree: %v", err)
 		}
+		log.Printf("Adding %d packages from %q as suite %q", len(pkgs), *fsTree, suite)
+		addPseudoSuite(suite, pkgs, content, latestVersion)
 	}
+
+	res.suiteOrder, res.defaultSuite = orderSuites(infos)
+	log.Printf("suite order: %q, default suite: %q", res.suiteOrder, res.defaultSuite)
 	return res, nil
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"pault.ag/go/archive"
+)
+
+func TestReleaseComponents(t *testing.T) {
+	release := &archive.Release{
+		Components: []string{"main", "contrib", "non-free-firmware", "non-free"},
+	}
+	for _, entry := range []struct {
+		filter string
+		want   []string
+	}{
+		{filter: "main,contrib", want: []string{"main", "contrib"}},
+		{filter: "non-free, main,internal", want: []string{"main", "non-free"}},
+		{filter: "", want: []string{"main", "contrib", "non-free-firmware", "non-free"}},
+	} {
+		if got := releaseComponents(release, entry.filter); !reflect.DeepEqual(got, entry.want) {
+			t.Errorf("releaseComponents(%q) = %v, want %v", entry.filter, got, entry.want)
+		}
+	}
+}
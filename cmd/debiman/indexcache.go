@@ -0,0 +1,131 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/stapelberg/debiman/internal/distro"
+	"github.com/stapelberg/debiman/internal/manpage"
+	"github.com/stapelberg/debiman/internal/write"
+
+	"pault.ag/go/debian/control"
+)
+
+// indexCacheFormat must be increased whenever indexCache or the
+// parsing of Contents and Packages files changes incompatibly.
+const indexCacheFormat = 1
+
+// indexCache is the parsed form of the Contents and Packages files of a
+// suite, i.e. the result of getAllContents and getAllPackages. It is
+// reused while the Release file lists the same files, so that
+// incremental runs need not download and parse unchanged indices.
+type indexCache struct {
+	Format        int
+	Key           string
+	Content       []snapshotContent
+	Pkgs          []snapshotPkg
+	LatestVersion map[string]*manpage.PkgMeta
+}
+
+// indexCachePath returns the path of the index cache of suite.
+func indexCachePath(suite string) string {
+	return filepath.Join(*servingDir, ".indexcache", suite+".gob.gz")
+}
+
+// indexCacheKey identifies all inputs of getAllContents and
+// getAllPackages: the hashes of the Contents and Packages files (as
+// listed in the Release file), the components and architectures, the
+// distribution layout and the packages with alternatives (see
+// buildContainsMains).
+func indexCacheKey(components, archs []string, hashes []control.SHA256FileHash, alternatives map[string][]link) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "format %d\ndebiman %s\nlayout %+v\n", indexCacheFormat, debimanVersion, distro.Current().Layout)
+	fmt.Fprintf(h, "components %q\narchitectures %q\n", components, archs)
+
+	var files []string
+	for _, fh := range hashes {
+		// e.g. “main/Contents-amd64.gz” or “main/binary-amd64/Packages.xz”
+		base := path.Base(fh.Filename)
+		if !strings.HasPrefix(base, "Contents-") && !strings.HasPrefix(base, "Packages") {
+			continue
+		}
+		files = append(files, fh.Filename+" "+fh.Hash)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		fmt.Fprintf(h, "file %s\n", f)
+	}
+
+	keys := make([]string, 0, len(alternatives))
+	for key := range alternatives {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "alternatives %s\n", key)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// readIndexCache returns the cached indices at path if they were
+// written with the same key.
+func readIndexCache(path, key string) ([]*contentEntry, []*pkgEntry, map[string]*manpage.PkgMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer r.Close()
+	var c indexCache
+	if err := gob.NewDecoder(r).Decode(&c); err != nil {
+		return nil, nil, nil, err
+	}
+	if c.Format != indexCacheFormat || c.Key != key {
+		return nil, nil, nil, fmt.Errorf("index files changed")
+	}
+	content := make([]*contentEntry, 0, len(c.Content))
+	for _, e := range c.Content {
+		content = append(content, e.contentEntry())
+	}
+	pkgs := make([]*pkgEntry, 0, len(c.Pkgs))
+	for _, p := range c.Pkgs {
+		pkgs = append(pkgs, p.pkgEntry())
+	}
+	return content, pkgs, c.LatestVersion, nil
+}
+
+// writeIndexCache caches the indices of a suite at path, see
+// readIndexCache.
+func writeIndexCache(path, key string, content []*contentEntry, pkgs []*pkgEntry, latestVersion map[string]*manpage.PkgMeta) error {
+	c := indexCache{
+		Format:        indexCacheFormat,
+		Key:           key,
+		Content:       make([]snapshotContent, 0, len(content)),
+		Pkgs:          make([]snapshotPkg, 0, len(pkgs)),
+		LatestVersion: latestVersion,
+	}
+	for _, e := range content {
+		c.Content = append(c.Content, snapshotContentFrom(e))
+	}
+	for _, p := range pkgs {
+		c.Pkgs = append(c.Pkgs, snapshotPkgFrom(p))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return write.Atomically(path, true, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(&c)
+	})
+}
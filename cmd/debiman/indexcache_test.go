@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stapelberg/debiman/internal/manpage"
+
+	"pault.ag/go/debian/control"
+	"pault.ag/go/debian/version"
+)
+
+func TestIndexCacheKey(t *testing.T) {
+	hashes := []control.SHA256FileHash{
+		{FileHash: control.FileHash{Filename: "main/Contents-amd64.gz", Hash: "c0"}},
+		{FileHash: control.FileHash{Filename: "main/binary-amd64/Packages.xz", Hash: "p0"}},
+		{FileHash: control.FileHash{Filename: "main/i18n/Translation-en.bz2", Hash: "t0"}},
+	}
+	components := []string{"main"}
+	archs := []string{"amd64"}
+	key := indexCacheKey(components, archs, hashes, nil)
+
+	changed := func(modify func(hashes []control.SHA256FileHash)) string {
+		h := append([]control.SHA256FileHash(nil), hashes...)
+		modify(h)
+		return indexCacheKey(components, archs, h, nil)
+	}
+	if changed(func(h []control.SHA256FileHash) { h[2].Hash = "t1" }) != key {
+		t.Errorf("key changed with a file which is neither a Contents nor a Packages file")
+	}
+	if changed(func(h []control.SHA256FileHash) { h[0], h[1] = h[1], h[0] }) != key {
+		t.Errorf("key depends on the order of the Release file")
+	}
+	if changed(func(h []control.SHA256FileHash) { h[0].Hash = "c1" }) == key {
+		t.Errorf("key unchanged with a modified Contents file")
+	}
+	if changed(func(h []control.SHA256FileHash) { h[1].Hash = "p1" }) == key {
+		t.Errorf("key unchanged with a modified Packages file")
+	}
+	if indexCacheKey([]string{"main", "contrib"}, archs, hashes, nil) == key {
+		t.Errorf("key unchanged with different components")
+	}
+	alternatives := map[string][]link{
+		"testing/vim-nox": {{from: "/usr/share/man/man1/editor.1.gz", to: "/usr/share/man/man1/vim.1.gz"}},
+	}
+	if indexCacheKey(components, archs, hashes, alternatives) == key {
+		t.Errorf("key unchanged with different alternatives")
+	}
+}
+
+func TestIndexCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-indexcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".indexcache", "testing.gob.gz")
+
+	if _, _, _, err := readIndexCache(path, "key"); !os.IsNotExist(err) {
+		t.Fatalf("readIndexCache() without cache: got err %v, want a not-exist error", err)
+	}
+
+	v := version.Version{Version: "4.13", Revision: "1"}
+	content := []*contentEntry{
+		{suite: "testing", arch: "amd64", binarypkg: "i3-wm", filename: "man1/i3.1.gz"},
+	}
+	pkgs := []*pkgEntry{
+		{
+			source:    "i3-wm",
+			suite:     "testing",
+			binarypkg: "i3-wm",
+			arch:      "amd64",
+			filename:  "pool/main/i/i3-wm/i3-wm_4.13-1_amd64.deb",
+			version:   v,
+			sha256:    []byte{0xde, 0xad},
+			bytes:     1234,
+		},
+	}
+	latestVersion := map[string]*manpage.PkgMeta{
+		"testing/i3-wm": {
+			Filename:  "pool/main/i/i3-wm/i3-wm_4.13-1_amd64.deb",
+			Sourcepkg: "i3-wm",
+			Binarypkg: "i3-wm",
+			Suite:     "testing",
+			Version:   v,
+		},
+	}
+	if err := writeIndexCache(path, "key", content, pkgs, latestVersion); err != nil {
+		t.Fatal(err)
+	}
+
+	gotContent, gotPkgs, gotLatestVersion, err := readIndexCache(path, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotContent, content) {
+		t.Errorf("unexpected content: got %+v, want %+v", gotContent, content)
+	}
+	if !reflect.DeepEqual(gotPkgs, pkgs) {
+		t.Errorf("unexpected packages: got %+v, want %+v", gotPkgs, pkgs)
+	}
+	if !reflect.DeepEqual(gotLatestVersion, latestVersion) {
+		t.Errorf("unexpected latestVersion: got %+v, want %+v", gotLatestVersion, latestVersion)
+	}
+
+	if _, _, _, err := readIndexCache(path, "other key"); err == nil {
+		t.Errorf("readIndexCache() unexpectedly succeeded with a different key")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/bundled"
+)
+
+var (
+	listenAddr = flag.String("listen",
+		":4414",
+		"host:port on which to serve the live status of the run (/status and /status.json), Prometheus metrics (/metrics) and pprof (/debug/pprof/). Empty disables the listener.")
+
+	listenLocalOnly = flag.Bool("listen_local_only",
+		false,
+		"If true, -listen only accepts connections from localhost, regardless of the host specified in -listen")
+)
+
+// recentErrors is the number of most recent errors shown on the live
+// status page.
+const recentErrors = 10
+
+// runStatus tracks the progress of the current run for the live
+// status endpoint.
+type runStatus struct {
+	// processed is the number of packages processed by the extract
+	// stage (extracted, skipped or failed).
+	processed uint64
+	// queued is the number of manpages queued for rendering.
+	queued uint64
+	// done is the number of queued manpages which were processed
+	// (rendered, failed to render or had only their printable
+	// versions rendered).
+	done uint64
+
+	mu         sync.Mutex
+	start      time.Time
+	stage      string
+	stageStart time.Time
+	walking    bool
+	gv         globalView
+}
+
+var liveStatus runStatus
+
+func (s *runStatus) setStart(start time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.start = start
+}
+
+func (s *runStatus) setStage(stage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stage = stage
+	s.stageStart = time.Now()
+	atomic.StoreUint64(&s.processed, 0)
+	atomic.StoreUint64(&s.queued, 0)
+	atomic.StoreUint64(&s.done, 0)
+}
+
+func (s *runStatus) setGlobalView(gv globalView) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gv = gv
+}
+
+// setWalking records whether the serving directory is still being
+// walked, i.e. whether more manpages can be queued for rendering.
+func (s *runStatus) setWalking(walking bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.walking = walking
+}
+
+// globalView returns the globalView and start time of the current run.
+func (s *runStatus) globalView() (globalView, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gv, s.start
+}
+
+func (s *runStatus) packageProcessed() {
+	atomic.AddUint64(&s.processed, 1)
+}
+
+func (s *runStatus) manpageQueued() {
+	atomic.AddUint64(&s.queued, 1)
+}
+
+func (s *runStatus) manpageDone() {
+	atomic.AddUint64(&s.done, 1)
+}
+
+type statusSnapshot struct {
+	Stage        string    `json:"stage"`
+	Start        time.Time `json:"start"`
+	StageStart   time.Time `json:"stage_start"`
+	StageSeconds float64   `json:"stage_seconds"`
+
+	PackagesDiscovered int    `json:"packages_discovered"`
+	PackagesProcessed  uint64 `json:"packages_processed"`
+	PackagesExtracted  uint64 `json:"packages_extracted"`
+	PackagesRemaining  int    `json:"packages_remaining"`
+
+	RenderQueueDepth  uint64  `json:"render_queue_depth"`
+	ManpagesRendered  uint64  `json:"manpages_rendered"`
+	ManpagesPerSecond float64 `json:"manpages_per_second"`
+
+	// ETASeconds estimates the remaining runtime of the current stage,
+	// or is -1 if no estimate is available yet.
+	ETASeconds float64 `json:"eta_seconds"`
+
+	RecentErrors []string `json:"recent_errors"`
+}
+
+func (s *runStatus) snapshot(now time.Time) statusSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := statusSnapshot{
+		Stage:              s.stage,
+		Start:              s.start,
+		StageStart:         s.stageStart,
+		PackagesDiscovered: len(s.gv.pkgs),
+		PackagesProcessed:  atomic.LoadUint64(&s.processed),
+		ETASeconds:         -1,
+	}
+	if !s.stageStart.IsZero() {
+		snap.StageSeconds = now.Sub(s.stageStart).Seconds()
+	}
+	if s.gv.stats != nil {
+		snap.PackagesExtracted = atomic.LoadUint64(&s.gv.stats.PackagesExtracted)
+		snap.ManpagesRendered = atomic.LoadUint64(&s.gv.stats.ManpagesRendered)
+	}
+	if remaining := snap.PackagesDiscovered - int(snap.PackagesProcessed); remaining > 0 {
+		snap.PackagesRemaining = remaining
+	}
+	done := atomic.LoadUint64(&s.done)
+	if queued := atomic.LoadUint64(&s.queued); queued > done {
+		snap.RenderQueueDepth = queued - done
+	}
+	var donePerSecond float64
+	if snap.StageSeconds > 0 {
+		snap.ManpagesPerSecond = float64(snap.ManpagesRendered) / snap.StageSeconds
+		donePerSecond = float64(done) / snap.StageSeconds
+	}
+
+	switch s.stage {
+	case "extract":
+		if snap.PackagesProcessed > 0 {
+			rate := float64(snap.PackagesProcessed) / snap.StageSeconds
+			snap.ETASeconds = float64(snap.PackagesRemaining) / rate
+		}
+	case "render":
+		// While walking, the number of manpages to render is unknown.
+		if !s.walking && donePerSecond > 0 {
+			snap.ETASeconds = float64(snap.RenderQueueDepth) / donePerSecond
+		}
+	}
+
+	if r := s.gv.report; r != nil {
+		r.mu.Lock()
+		for _, f := range r.FailedPackages {
+			snap.RecentErrors = append(snap.RecentErrors, fmt.Sprintf("%s %s: %s", f.Package, f.Version, f.Error))
+		}
+		for _, f := range r.RenderFailures {
+			snap.RecentErrors = append(snap.RecentErrors, fmt.Sprintf("%s: %s", f.Manpage, f.Error))
+		}
+		r.mu.Unlock()
+		if len(snap.RecentErrors) > recentErrors {
+			snap.RecentErrors = snap.RecentErrors[len(snap.RecentErrors)-recentErrors:]
+		}
+	}
+	return snap
+}
+
+var liveStatusTmpl = mustParseLiveStatusTmpl()
+
+func mustParseLiveStatusTmpl() *template.Template {
+	return template.Must(template.New("livestatus").Parse(bundled.Asset("livestatus.tmpl")))
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	snap := liveStatus.snapshot(time.Now())
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := liveStatusTmpl.Execute(w, snap); err != nil {
+		log.Printf("rendering live status: %v", err)
+	}
+}
+
+func serveStatusJSON(w http.ResponseWriter, r *http.Request) {
+	snap := liveStatus.snapshot(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&snap); err != nil {
+		log.Printf("encoding live status: %v", err)
+	}
+}
+
+// statusListenAddr returns the address on which to listen, see -listen
+// and -listen_local_only.
+func statusListenAddr(addr string, localOnly bool) (string, error) {
+	if !localOnly {
+		return addr, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort("localhost", port), nil
+}
+
+// serveLiveStatus serves the live status and pprof on -listen.
+func serveLiveStatus() error {
+	if *listenAddr == "" {
+		return nil
+	}
+	addr, err := statusListenAddr(*listenAddr, *listenLocalOnly)
+	if err != nil {
+		return fmt.Errorf("parsing -listen: %v", err)
+	}
+	http.HandleFunc("/status", serveStatus)
+	http.HandleFunc("/status.json", serveStatusJSON)
+	http.HandleFunc("/metrics", serveMetrics)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving live status on http://%s/status", ln.Addr())
+	go http.Serve(ln, nil)
+	return nil
+}
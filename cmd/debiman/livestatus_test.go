@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiveStatus(t *testing.T) {
+	start := time.Now()
+	var s runStatus
+	s.setStart(start)
+	gv := globalView{
+		pkgs:   make([]*pkgEntry, 100),
+		stats:  &stats{PackagesExtracted: 20},
+		report: newRunReport(start),
+	}
+	for i := 0; i < recentErrors+5; i++ {
+		gv.report.failedPackage(pkgEntry{suite: "jessie", binarypkg: "i3-wm"}, errors.New("truncated archive"))
+	}
+	s.setGlobalView(gv)
+
+	s.setStage("extract")
+	for i := 0; i < 25; i++ {
+		s.packageProcessed()
+	}
+	snap := s.snapshot(s.stageStart.Add(10 * time.Second))
+	if got, want := snap.PackagesRemaining, 75; got != want {
+		t.Errorf("unexpected remaining packages: got %d, want %d", got, want)
+	}
+	if got, want := snap.ETASeconds, 30.0; got != want {
+		t.Errorf("unexpected ETA: got %v, want %v", got, want)
+	}
+	if got, want := len(snap.RecentErrors), recentErrors; got != want {
+		t.Errorf("unexpected number of recent errors: got %d, want %d", got, want)
+	}
+
+	s.setStage("render")
+	s.setWalking(true)
+	for i := 0; i < 50; i++ {
+		s.manpageQueued()
+	}
+	// 20 manpages were rendered, 5 failed to render and 5 only had
+	// their printable versions rendered.
+	gv.stats.ManpagesRendered = 20
+	for i := 0; i < 30; i++ {
+		s.manpageDone()
+	}
+	snap = s.snapshot(s.stageStart.Add(10 * time.Second))
+	if got, want := snap.RenderQueueDepth, uint64(20); got != want {
+		t.Errorf("unexpected render queue depth: got %d, want %d", got, want)
+	}
+	if got, want := snap.ManpagesPerSecond, 2.0; got != want {
+		t.Errorf("unexpected manpages per second: got %v, want %v", got, want)
+	}
+	if got, want := snap.ETASeconds, -1.0; got != want {
+		t.Errorf("unexpected ETA while walking: got %v, want %v", got, want)
+	}
+	s.setWalking(false)
+	snap = s.snapshot(s.stageStart.Add(10 * time.Second))
+	if got, want := snap.ETASeconds, 20/3.0; got != want {
+		t.Errorf("unexpected ETA: got %v, want %v", got, want)
+	}
+
+	for i := 0; i < 20; i++ {
+		s.manpageDone()
+	}
+	snap = s.snapshot(s.stageStart.Add(20 * time.Second))
+	if got, want := snap.RenderQueueDepth, uint64(0); got != want {
+		t.Errorf("unexpected render queue depth once all manpages were processed: got %d, want %d", got, want)
+	}
+}
+
+func TestLiveStatusHandlers(t *testing.T) {
+	liveStatus.setStage("extract")
+	defer liveStatus.setStage("")
+
+	rec := httptest.NewRecorder()
+	serveStatusJSON(rec, httptest.NewRequest("GET", "/status.json", nil))
+	var snap statusSnapshot
+	if err := json.NewDecoder(rec.Body).Decode(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := snap.Stage, "extract"; got != want {
+		t.Errorf("unexpected stage: got %q, want %q", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	serveStatus(rec, httptest.NewRequest("GET", "/status", nil))
+	if got, want := rec.Body.String(), "<title>debiman: extract</title>"; !strings.Contains(got, want) {
+		t.Errorf("status page does not contain %q: %s", want, got)
+	}
+}
+
+func TestStatusListenAddr(t *testing.T) {
+	for _, tt := range []struct {
+		addr      string
+		localOnly bool
+		want      string
+	}{
+		{addr: ":4414", want: ":4414"},
+		{addr: ":4414", localOnly: true, want: "localhost:4414"},
+		{addr: "[::]:4414", localOnly: true, want: "localhost:4414"},
+	} {
+		got, err := statusListenAddr(tt.addr, tt.localOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("statusListenAddr(%q, %v) = %q, want %q", tt.addr, tt.localOnly, got, tt.want)
+		}
+	}
+}
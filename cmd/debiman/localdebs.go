@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stapelberg/debiman/internal/manpage"
+
+	"pault.ag/go/debian/deb"
+	"pault.ag/go/debian/version"
+)
+
+var (
+	localDebs = flag.String("local_debs",
+		"",
+		"If non-empty, a directory containing .deb files (e.g. internal packages which are not part of any archive) whose manpages are served as the suite -local_suite")
+
+	localSuite = flag.String("local_suite",
+		"local",
+		"Name of the pseudo-suite containing the packages from -local_debs")
+)
+
+// parseReplaces parses the value of a Replaces field, e.g.
+// “systemd (<< 224-2), udev”.
+func parseReplaces(value string) []string {
+	var replaces []string
+	for _, pkg := range strings.Split(value, ",") {
+		pkg = strings.TrimSpace(pkg)
+		if idx := strings.Index(pkg, " "); idx > -1 {
+			pkg = pkg[:idx]
+		}
+		if pkg != "" {
+			replaces = append(replaces, pkg)
+		}
+	}
+	return replaces
+}
+
+// scanLocalDeb reads the control data and the manpage paths of the
+// .deb file at path.
+func scanLocalDeb(path, suite string) (*pkgEntry, []*contentEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, nil, err
+	}
+
+	d, err := deb.Load(f, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading %q: %v", path, err)
+	}
+	p := &pkgEntry{
+		source:    d.Control.Source,
+		suite:     suite,
+		binarypkg: d.Control.Package,
+		arch:      d.Control.Architecture.String(),
+		filename:  path,
+		version:   d.Control.Version,
+		sha256:    h.Sum(nil),
+		bytes:     n,
+		replaces:  parseReplaces(d.Control.Values["Replaces"]),
+		local:     true,
+	}
+	if p.source == "" {
+		p.source = p.binarypkg
+	}
+	// e.g. “Source: gcc-defaults (1.150)”
+	if idx := strings.Index(p.source, " "); idx > -1 {
+		p.source = p.source[:idx]
+	}
+
+	var content []*contentEntry
+	for {
+		header, err := d.Data.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %q: %v", path, err)
+		}
+		if header.Typeflag != tar.TypeReg &&
+			header.Typeflag != tar.TypeRegA &&
+			header.Typeflag != tar.TypeSymlink &&
+			header.Typeflag != tar.TypeLink {
+			continue
+		}
+		if !strings.HasPrefix(header.Name, "./usr/share/man/") {
+			continue
+		}
+		content = append(content, &contentEntry{
+			suite:     suite,
+			arch:      p.arch,
+			binarypkg: p.binarypkg,
+			filename:  strings.TrimPrefix(header.Name, "./usr/share/man/"),
+		})
+	}
+	return p, content, nil
+}
+
+// scanLocalDebs reads all .deb files in dir, like getAllContents and
+// getAllPackages do for the Contents and Packages indices of a suite.
+// If dir contains multiple versions of a package, the newest version
+// is used. Packages without manpages are skipped.
+func scanLocalDebs(dir, suite string) ([]*pkgEntry, []*contentEntry, map[string]*manpage.PkgMeta, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	newest := make(map[string]*pkgEntry)
+	contentByPkg := make(map[string][]*contentEntry)
+	var order []string
+	for _, fi := range fis {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".deb") {
+			continue
+		}
+		p, content, err := scanLocalDeb(filepath.Join(dir, fi.Name()), suite)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(content) == 0 {
+			log.Printf("Skipping %q: no manpages", fi.Name())
+			continue
+		}
+		if prev, ok := newest[p.binarypkg]; ok {
+			if version.Compare(prev.version, p.version) >= 0 {
+				continue
+			}
+		} else {
+			order = append(order, p.binarypkg)
+		}
+		newest[p.binarypkg] = p
+		contentByPkg[p.binarypkg] = content
+	}
+
+	pkgs := make([]*pkgEntry, 0, len(order))
+	var content []*contentEntry
+	latestVersion := make(map[string]*manpage.PkgMeta, len(order))
+	for _, binarypkg := range order {
+		p := newest[binarypkg]
+		pkgs = append(pkgs, p)
+		content = append(content, contentByPkg[binarypkg]...)
+		latestVersion[suite+"/"+binarypkg] = &manpage.PkgMeta{
+			Replaces:  p.replaces,
+			Filename:  filepath.Base(p.filename),
+			Sourcepkg: p.source,
+			Binarypkg: p.binarypkg,
+			Suite:     p.suite,
+			Version:   p.version,
+		}
+	}
+	return pkgs, content, latestVersion, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"pault.ag/go/debian/version"
+)
+
+func TestParseReplaces(t *testing.T) {
+	got := parseReplaces("systemd (<< 224-2), udev,libudev1 (<< 232)")
+	want := []string{"systemd", "udev", "libudev1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseReplaces() = %q, want %q", got, want)
+	}
+}
+
+func TestScanLocalDebs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-localdebs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile("../../testdata/tinymirror/pool/main/i/i3-wm/i3-wm_4.13-1_amd64.deb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "i3-wm_4.13-1_amd64.deb"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Files which are not .deb files are ignored.
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("internal packages"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs, content, latestVersion, err := scanLocalDebs(dir, "internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(pkgs), 1; got != want {
+		t.Fatalf("unexpected number of packages: got %d, want %d", got, want)
+	}
+	p := pkgs[0]
+	if got, want := p.suite+"/"+p.binarypkg, "internal/i3-wm"; got != want {
+		t.Errorf("unexpected package: got %q, want %q", got, want)
+	}
+	if got, want := p.source, "i3-wm"; got != want {
+		t.Errorf("unexpected source package: got %q, want %q", got, want)
+	}
+	if got, want := p.version.String(), "4.13-1"; got != want {
+		t.Errorf("unexpected version: got %q, want %q", got, want)
+	}
+	if !p.local {
+		t.Errorf("package not marked as local")
+	}
+	if got, want := len(content), 14; got != want {
+		t.Errorf("unexpected number of manpages: got %d, want %d", got, want)
+	}
+	var found bool
+	for _, c := range content {
+		found = found || c.filename == "man1/i3.1.gz"
+	}
+	if !found {
+		t.Errorf("man1/i3.1.gz not found in %v", content)
+	}
+	if _, ok := latestVersion["internal/i3-wm"]; !ok {
+		t.Errorf("latestVersion does not contain internal/i3-wm")
+	}
+}
+
+func TestCanSkipLocalDeb(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-localdebs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vPath := filepath.Join(dir, "VERSION")
+
+	p := pkgEntry{
+		binarypkg: "i3-wm",
+		version:   version.Version{Version: "4.13", Revision: "1"},
+		sha256:    []byte{0x01, 0x02},
+		local:     true,
+	}
+	if err := ioutil.WriteFile(vPath, []byte(versionFileContent(p)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !canSkip(p, vPath) {
+		t.Errorf("canSkip() = false for an unchanged local .deb file")
+	}
+
+	rebuilt := p
+	rebuilt.sha256 = []byte{0x03, 0x04}
+	if canSkip(rebuilt, vPath) {
+		t.Errorf("canSkip() = true for a rebuilt local .deb file of the same version")
+	}
+
+	// VERSION files written before hashes were recorded.
+	if err := ioutil.WriteFile(vPath, []byte("4.13-1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if canSkip(p, vPath) {
+		t.Errorf("canSkip() = true for a local .deb file without recorded hash")
+	}
+	archive := p
+	archive.local = false
+	if !canSkip(archive, vPath) {
+		t.Errorf("canSkip() = false for an archive package of the same version")
+	}
+}
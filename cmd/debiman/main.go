@@ -5,18 +5,20 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/net/context"
 
 	_ "net/http/pprof"
 
 	"github.com/stapelberg/debiman/internal/bundled"
 	"github.com/stapelberg/debiman/internal/commontmpl"
+	"github.com/stapelberg/debiman/internal/distro"
+	"github.com/stapelberg/debiman/internal/storage"
 	"github.com/stapelberg/debiman/internal/write"
 
 	"pault.ag/go/archive"
@@ -67,6 +69,10 @@ var (
 		"",
 		"If non-empty, the specified GPG public keyring will be used for validating archive signatures instead of "+archive.DebianArchiveKeyring)
 
+	distributionProfile = flag.String("distribution",
+		"debian",
+		"Distribution profile: debian, ubuntu or the path to a JSON-encoded profile (see internal/distro) specifying the distribution name, suite order, default suite and archive layout")
+
 	showVersion = flag.Bool("version",
 		false,
 		"Show debiman version and exit")
@@ -75,86 +81,306 @@ var (
 // use go build -ldflags "-X main.debimanVersion=<version>" to set the version
 var debimanVersion = "HEAD"
 
-// TODO: handle deleted packages, i.e. packages which are present on
-// disk but not in pkgs
+// stages are the subcommands which can be specified to run only one
+// stage of the pipeline. Without a subcommand, all stages are run in
+// this order.
+var stages = []string{"discover", "extract", "render", "index", "aux"}
+
+func validStage(stage string) bool {
+	for _, s := range stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
 
-// TODO(later): add memory usage estimates to the big structures, set
-// parallelism level according to available memory on the system
-func logic() error {
+func logic(stage string) (err error) {
 	start := time.Now()
 
-	ar := &archive.Downloader{
-		Parallel:            10,
-		MaxTransientRetries: 3,
-		Mirror:              "http://localhost:3142/deb.debian.org/debian",
-		LocalMirror:         *localMirror,
+	// The run report is written even if the run fails, so that
+	// failures can be inspected without reading the logs.
+	var globalView globalView
+	defer func() {
+		if *dryRun || stage == exportStage {
+			return
+		}
+		report := globalView.report
+		if report == nil {
+			report = newRunReport(start)
+		}
+		report.finish(globalView, err)
+		if stage != "" {
+			prev, perr := loadReport(filepath.Join(*servingDir, "report.json"))
+			if perr == nil {
+				report.mergeStage(prev, stage)
+			} else if !os.IsNotExist(perr) {
+				log.Printf("WARNING: not merging the run report with the previous report: %v", perr)
+			}
+		}
+		if rerr := writeReport(*servingDir, report); rerr != nil {
+			log.Printf("writing run report: %v", rerr)
+			if err == nil {
+				err = fmt.Errorf("writing run report: %v", rerr)
+			}
+		}
+	}()
+
+	// SIGINT and SIGTERM stop the run cleanly, so that it can be
+	// resumed (see checkpoint).
+	ctx, cancel := cancelOnSignal(context.Background())
+	defer cancel()
+
+	var cp *checkpoint
+	if stage == "" && !*dryRun {
+		cp, err = loadCheckpoint(filepath.Join(*servingDir, "checkpoint.json"), start)
+		if err != nil {
+			return fmt.Errorf("loading checkpoint: %v", err)
+		}
+		if err := cp.save(); err != nil {
+			return fmt.Errorf("writing checkpoint: %v", err)
+		}
+	}
+
+	// run returns whether stage s should be run and, if so, marks it as
+	// the current stage on the live status page.
+	liveStatus.setStart(start)
+	var stageStart time.Time
+	run := func(s string) bool {
+		if (stage == "" || stage == s) && !cp.completed(s) {
+			liveStatus.setStage(s)
+			stageStart = time.Now()
+			return true
+		}
+		return false
 	}
 
+	completed := func(s string) error {
+		runMetrics.set("stage_duration_seconds", metricLabels("stage", s), time.Since(stageStart).Seconds())
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted: %v", err)
+		}
+		if err := cp.complete(s); err != nil {
+			return fmt.Errorf("writing checkpoint: %v", err)
+		}
+		return nil
+	}
+
+	var archiveKeyring openpgp.EntityList
 	if *keyring != "" {
 		f, err := os.Open(*keyring)
 		if err != nil {
 			return fmt.Errorf("loading -keyring: %v", err)
 		}
 		defer f.Close()
-		ar.Keyring, err = openpgp.ReadKeyRing(f)
+		archiveKeyring, err = openpgp.ReadKeyRing(f)
 		if err != nil {
 			return fmt.Errorf("ReadKeyRing(%s): %v", *keyring, err)
 		}
 	}
 
-	// Stage 1: all Debian packages of all architectures of the
-	// specified suites are discovered.
-	globalView, err := buildGlobalView(ar, distributions(
-		strings.Split(*syncCodenames, ","),
-		strings.Split(*syncSuites, ",")),
-		*alternativesDir,
-		start)
+	if err := setupProxy(); err != nil {
+		return err
+	}
+
+	ar, err := newMirrorPool(strings.Split(*mirrorURLs, ","), *localMirror, archiveKeyring)
 	if err != nil {
-		return fmt.Errorf("gathering packages: %v", err)
+		return err
 	}
 
-	log.Printf("gathered packages of all suites, total %d packages", len(globalView.pkgs))
+	snapshotPath := strings.Replace(*snapshotPath, "<serving_dir>", *servingDir, -1)
+	if run("discover") {
+		// Stage 1: all Debian packages of all architectures of the
+		// specified suites are discovered.
+		planDiscover()
+		globalView, err = buildGlobalView(ar, distributions(
+			strings.Split(*syncCodenames, ","),
+			strings.Split(*syncSuites, ",")),
+			*alternativesDir,
+			start)
+		if err != nil {
+			return fmt.Errorf("gathering packages: %v", err)
+		}
+
+		log.Printf("gathered packages of all suites, total %d packages", len(globalView.pkgs))
+
+		// The snapshot allows the subsequent stages to be run
+		// individually, without accessing the archive again.
+		if !*dryRun {
+			log.Printf("Writing snapshot to %q", snapshotPath)
+			if err := writeSnapshot(snapshotPath, globalView); err != nil {
+				return fmt.Errorf("writing snapshot: %v", err)
+			}
+			if err := completed("discover"); err != nil {
+				return err
+			}
+		}
+	} else {
+		globalView, err = readSnapshot(snapshotPath, start)
+		if err != nil {
+			return fmt.Errorf("loading snapshot (run “debiman discover” first): %v", err)
+		}
+		log.Printf("loaded snapshot %q, total %d packages", snapshotPath, len(globalView.pkgs))
+	}
 
-	// Stage 2: man pages and auxiliary files (e.g. content fragment
-	// files which are included by a number of manpages) are extracted
-	// from the identified Debian packages.
-	if err := parallelDownload(ar, globalView); err != nil {
-		return fmt.Errorf("extracting manpages: %v", err)
+	if *reproducible {
+		sortGlobalView(globalView)
 	}
 
-	log.Printf("Extracted all manpages, now rendering")
+	// Order suites (e.g. on manpage pages) according to their Release
+	// files instead of the static list in the distribution profile.
+	distro.Set(distro.Current().WithSuites(globalView.suiteOrder, globalView.defaultSuite))
+
+	// The globalView is the biggest data structure and is held in
+	// memory during all stages, so the concurrency levels are planned
+	// once its size is known.
+	planStages(globalView)
 
-	// Stage 3: all man pages are rendered into an HTML representation
-	// using mandoc(1), directory index files are rendered, contents
-	// files are rendered.
-	if err := renderAll(globalView); err != nil {
-		return fmt.Errorf("rendering manpages: %v", err)
+	if stage == exportStage {
+		return exportMarkdown(globalView)
 	}
 
-	log.Printf("Rendered all manpages, writing index")
+	globalView.deletions, err = loadPendingDeletions(filepath.Join(*servingDir, "deletions.json"))
+	if err != nil {
+		return fmt.Errorf("loading pending deletions: %v", err)
+	}
 
-	// Stage 4: write the index only after all rendering is complete,
-	// otherwise debiman-auxserver might serve redirects to pages
-	// which cannot be served yet.
-	path := strings.Replace(*indexPath, "<serving_dir>", *servingDir, -1)
-	log.Printf("Writing debiman-auxserver index to %q", path)
-	if err := writeIndex(path, globalView); err != nil {
-		return fmt.Errorf("writing index: %v", err)
+	globalView.quarantine, err = loadQuarantine(filepath.Join(*servingDir, "quarantine.json"))
+	if err != nil {
+		return fmt.Errorf("loading quarantine: %v", err)
+	}
+	globalView.budget = newBudget(*failureBudget)
+	globalView.store = openStore()
+	globalView.assets, err = loadAssetState(filepath.Join(*servingDir, "assets.json"), "changed assets", assetsFingerprint(), start)
+	if err != nil {
+		return fmt.Errorf("loading asset state: %v", err)
+	}
+	globalView.outputs, err = loadAssetState(filepath.Join(*servingDir, "outputs.json"), "new output formats", outputsFingerprint(), start)
+	if err != nil {
+		return fmt.Errorf("loading output state: %v", err)
+	}
+	order := importanceOrder(globalView)
+	globalView.assets.schedule(order, *assetRerenderLimit)
+	globalView.outputs.schedule(order, *assetRerenderLimit)
+	globalView.resumeSince = cp.since()
+	liveStatus.setGlobalView(globalView)
+
+	if *dryRun {
+		return printPlan(globalView)
 	}
 
-	if err := renderAux(*servingDir, globalView); err != nil {
-		return fmt.Errorf("rendering aux files: %v", err)
+	defer func() {
+		q := globalView.quarantine
+		if err == nil {
+			// Only release retried packages from quarantine if the
+			// run was not interrupted while processing them.
+			q.release()
+		}
+		inArchive := make(map[string]bool, len(globalView.pkgs))
+		for _, p := range globalView.pkgs {
+			inArchive[p.suite+"/"+p.binarypkg] = true
+		}
+		q.retain(func(pkg string) bool { return inArchive[pkg] })
+		if qerr := q.save(); qerr != nil {
+			log.Printf("writing quarantine: %v", qerr)
+			if err == nil {
+				err = fmt.Errorf("writing quarantine: %v", qerr)
+			}
+		}
+	}()
+
+	if run("extract") {
+		// Stage 2: man pages and auxiliary files (e.g. content fragment
+		// files which are included by a number of manpages) are extracted
+		// from the identified Debian packages.
+		if err := parallelDownload(ctx, ar, globalView); err != nil {
+			return fmt.Errorf("extracting manpages: %v", err)
+		}
+
+		log.Printf("Extracted all manpages")
+		// Stale files are only deleted in the index stage, which
+		// might run separately (e.g. “debiman index”).
+		if err := globalView.deletions.save(); err != nil {
+			return fmt.Errorf("writing pending deletions: %v", err)
+		}
+		if err := completed("extract"); err != nil {
+			return err
+		}
+	}
+
+	if run("render") {
+		// Stage 3: all man pages are rendered into an HTML representation
+		// using mandoc(1), directory index files are rendered, contents
+		// files are rendered.
+		if err := renderAll(ctx, globalView); err != nil {
+			return fmt.Errorf("rendering manpages: %v", err)
+		}
+
+		log.Printf("Rendered all manpages")
+		if err := completed("render"); err != nil {
+			return err
+		}
 	}
 
+	if run("index") {
+		// Stage 4: write the index only after all rendering is complete,
+		// otherwise debiman-auxserver might serve redirects to pages
+		// which cannot be served yet.
+		path := strings.Replace(*indexPath, "<serving_dir>", *servingDir, -1)
+		log.Printf("Writing debiman-auxserver index to %q", path)
+		if err := writeIndex(path, globalView); err != nil {
+			return fmt.Errorf("writing index: %v", err)
+		}
+
+		// Packages and files which are no longer in the archive are not
+		// part of the index we just wrote and can be deleted once the
+		// grace period for the old index expired.
+		if err := cleanup(globalView, time.Now()); err != nil {
+			return fmt.Errorf("deleting obsolete files: %v", err)
+		}
+		if globalView.store != nil {
+			if err := collectStore(globalView.store, globalView); err != nil {
+				return fmt.Errorf("collecting unused objects: %v", err)
+			}
+		}
+		if err := completed("index"); err != nil {
+			return err
+		}
+	}
+
+	if run("aux") {
+		if err := renderAux(*servingDir, globalView); err != nil {
+			return fmt.Errorf("rendering aux files: %v", err)
+		}
+		if err := completed("aux"); err != nil {
+			return err
+		}
+	}
+
+	if err := cp.remove(); err != nil {
+		return fmt.Errorf("removing checkpoint: %v", err)
+	}
+	liveStatus.setStage("done")
+
 	fmt.Printf("total number of packages: %d\n", len(globalView.pkgs))
 	fmt.Printf("packages extracted:       %d\n", globalView.stats.PackagesExtracted)
 	fmt.Printf("packages deleted:         %d\n", globalView.stats.PackagesDeleted)
 	fmt.Printf("manpages rendered:        %d\n", globalView.stats.ManpagesRendered)
 	fmt.Printf("total manpage bytes:      %d\n", globalView.stats.ManpageBytes)
 	fmt.Printf("total HTML bytes:         %d\n", globalView.stats.HtmlBytes)
+	fmt.Printf("total text bytes:         %d\n", globalView.stats.TextBytes)
 	fmt.Printf("auxserver index bytes:    %d\n", globalView.stats.IndexBytes)
+	if globalView.store != nil {
+		fmt.Printf("deduplicated bytes saved: %d\n", globalView.stats.StoreSavedBytes)
+	}
 	fmt.Printf("wall-clock runtime (s):   %d\n", int(time.Now().Sub(start).Seconds()))
 
+	if stage != "" {
+		// The metrics describe a full run; a partial run would
+		// overwrite them with misleading values.
+		return nil
+	}
+
 	return write.Atomically(filepath.Join(*servingDir, "metrics.txt"), false, func(w io.Writer) error {
 		if err := writeMetrics(w, globalView, start); err != nil {
 			return fmt.Errorf("writing metrics: %v", err)
@@ -164,15 +390,32 @@ func logic() error {
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] [%s|%s]\n", os.Args[0], strings.Join(stages, "|"), exportStage)
+		fmt.Fprintf(os.Stderr, "Without a subcommand, all stages are run. %s writes manpages as Markdown to -export_dir.\n", exportStage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	stage := flag.Arg(0)
+	if flag.NArg() > 1 || (stage != "" && stage != exportStage && !validStage(stage)) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	if *showVersion {
 		fmt.Printf("debiman %s\n", debimanVersion)
 		return
 	}
 
+	profile, err := distro.Load(*distributionProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	distro.Set(profile)
+
 	if *injectAssets != "" {
 		if err := bundled.Inject(*injectAssets); err != nil {
 			log.Fatal(err)
@@ -188,8 +431,32 @@ func main() {
 		manpageTmpl = mustParseManpageTmpl()
 		manpageerrorTmpl = mustParseManpageerrorTmpl()
 		manpagefooterextraTmpl = mustParseManpagefooterextraTmpl()
+		statusTmpl = mustParseStatusTmpl()
+		liveStatusTmpl = mustParseLiveStatusTmpl()
+	}
+
+	if *reproducible {
+		if err := setupReproducible(); err != nil {
+			log.Fatal(err)
+		}
 	}
 
+	if err := setupPrinting(); err != nil {
+		log.Fatal(err)
+	}
+
+	if stage == exportStage {
+		if err := setupExport(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	st, err := storage.Open(*storageURL, *servingDir)
+	if err != nil {
+		log.Fatalf("-storage: %v", err)
+	}
+	serving = st
+
 	// All of our .so references are relative to *servingDir. For
 	// mandoc(1) to find the files, we need to change the working
 	// directory now.
@@ -197,9 +464,11 @@ func main() {
 		log.Fatal(err)
 	}
 
-	go http.ListenAndServe(":4414", nil)
+	if err := serveLiveStatus(); err != nil {
+		log.Printf("WARNING: not serving live status: %v", err)
+	}
 
-	if err := logic(); err != nil {
+	if err := logic(stage); err != nil {
 		log.Fatal(err)
 	}
 }
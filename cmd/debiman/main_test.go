@@ -15,7 +15,15 @@ func TestEndToEnd(t *testing.T) {
 	defer os.RemoveAll(dir)
 	flag.Set("serving_dir", dir)
 	flag.Set("local_mirror", "../../testdata/tinymirror")
-	if err := logic(); err != nil {
+	if err := logic(""); err != nil {
 		t.Fatal(err)
 	}
+	// Individual stages must work offline from the snapshot which was
+	// written by the full run.
+	flag.Set("local_mirror", "/nonexistent")
+	for _, stage := range []string{"render", "index", "aux"} {
+		if err := logic(stage); err != nil {
+			t.Fatalf("logic(%q): %v", stage, err)
+		}
+	}
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+
+	"pault.ag/go/archive"
+	"pault.ag/go/debian/control"
+)
+
+var (
+	mirrorURLs = flag.String("mirrors",
+		"http://localhost:3142/deb.debian.org/debian",
+		"Comma-separated list of Debian mirror URLs. Files are downloaded from the healthiest mirror; failed downloads are retried on the next mirror. Ignored if -local_mirror is set.")
+
+	httpProxy = flag.String("proxy",
+		"",
+		"If non-empty, the URL of an HTTP proxy to use for accessing the mirrors (e.g. http://localhost:3128). If empty, the http_proxy environment variable is respected.")
+)
+
+// setupProxy configures the HTTP client used for archive access to use
+// -proxy.
+func setupProxy() error {
+	if *httpProxy == "" {
+		return nil
+	}
+	u, err := url.Parse(*httpProxy)
+	if err != nil {
+		return fmt.Errorf("parsing -proxy: %v", err)
+	}
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("http.DefaultTransport is not a *http.Transport")
+	}
+	t.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// mirror is one Debian mirror of a mirrorPool.
+type mirror struct {
+	url string
+	ar  *archive.Downloader
+
+	mu sync.Mutex
+	// failures is the number of consecutive failed downloads.
+	failures int
+	// rds contains a ReleaseDownloader per suite, obtained lazily so
+	// that mirrors which are never needed are never contacted.
+	rds map[string]*archive.ReleaseDownloader
+}
+
+func (m *mirror) health() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.failures
+}
+
+func (m *mirror) record(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failures++
+	} else {
+		m.failures = 0
+	}
+}
+
+// releaseDownloader returns the ReleaseDownloader of this mirror for
+// suite, verifying the Release file of this mirror if necessary.
+func (m *mirror) releaseDownloader(suite string) (*archive.ReleaseDownloader, error) {
+	m.mu.Lock()
+	rd, ok := m.rds[suite]
+	m.mu.Unlock()
+	if ok {
+		return rd, nil
+	}
+	_, rd, err := m.ar.Release(suite)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.rds[suite] = rd
+	m.mu.Unlock()
+	return rd, nil
+}
+
+// mirrorPool downloads files from a number of equivalent Debian
+// mirrors. Mirrors are tried in order of their health (mirrors with
+// fewer consecutive failures first, ties broken by the order of
+// -mirrors), so that a broken mirror is quickly moved out of the way.
+type mirrorPool struct {
+	mirrors []*mirror
+}
+
+// newMirrorPool returns a mirrorPool with one archive.Downloader per
+// mirror URL. If localMirror is non-empty, the pool consists of just
+// the local mirror.
+func newMirrorPool(urls []string, localMirror string, keyring openpgp.EntityList) (*mirrorPool, error) {
+	if localMirror != "" {
+		urls = []string{localMirror}
+	}
+	p := &mirrorPool{}
+	for _, u := range urls {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		p.mirrors = append(p.mirrors, &mirror{
+			url: u,
+			ar: &archive.Downloader{
+				Parallel:            10,
+				MaxTransientRetries: 3,
+				Mirror:              u,
+				LocalMirror:         localMirror,
+				Keyring:             keyring,
+			},
+			rds: make(map[string]*archive.ReleaseDownloader),
+		})
+	}
+	if len(p.mirrors) == 0 {
+		return nil, fmt.Errorf("no mirrors specified")
+	}
+	return p, nil
+}
+
+// byHealth returns the mirrors in the order in which they should be
+// tried.
+func (p *mirrorPool) byHealth() []*mirror {
+	sorted := make([]*mirror, len(p.mirrors))
+	copy(sorted, p.mirrors)
+	health := make(map[*mirror]int, len(sorted))
+	for _, m := range sorted {
+		health[m] = m.health()
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return health[sorted[i]] < health[sorted[j]]
+	})
+	return sorted
+}
+
+// try calls fn for each mirror until it succeeds.
+func (p *mirrorPool) try(what string, fn func(m *mirror) (*os.File, error)) (*os.File, error) {
+	var errs []string
+	for _, m := range p.byHealth() {
+		f, err := fn(m)
+		m.record(err)
+		if err != nil {
+			log.Printf("WARNING: %s from mirror %s failed: %v", what, m.url, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", m.url, err))
+			continue
+		}
+		log.Printf("%s served by mirror %s", what, m.url)
+		return f, nil
+	}
+	return nil, fmt.Errorf("%s: all mirrors failed: %s", what, strings.Join(errs, "; "))
+}
+
+// TempFile downloads the file described by fh into a temporary file,
+// like archive.Downloader.TempFile.
+func (p *mirrorPool) TempFile(fh control.FileHash) (*os.File, error) {
+	return p.try(fh.Filename, func(m *mirror) (*os.File, error) {
+		return m.ar.TempFile(fh)
+	})
+}
+
+// Release returns the Release file of suite from the healthiest mirror
+// which serves a valid Release file.
+func (p *mirrorPool) Release(suite string) (*archive.Release, *releaseDownloader, error) {
+	var errs []string
+	for _, m := range p.byHealth() {
+		release, rd, err := m.ar.Release(suite)
+		m.record(err)
+		if err != nil {
+			log.Printf("WARNING: Release file of %q from mirror %s failed: %v", suite, m.url, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", m.url, err))
+			continue
+		}
+		m.mu.Lock()
+		m.rds[suite] = rd
+		m.mu.Unlock()
+		log.Printf("Release file of %q served by mirror %s", suite, m.url)
+		return release, &releaseDownloader{pool: p, suite: suite}, nil
+	}
+	return nil, nil, fmt.Errorf("Release file of %q: all mirrors failed: %s", suite, strings.Join(errs, "; "))
+}
+
+// releaseDownloader downloads files referenced by the Release file of
+// a suite, like archive.ReleaseDownloader, but from any mirror of the
+// pool.
+type releaseDownloader struct {
+	pool  *mirrorPool
+	suite string
+}
+
+func (r *releaseDownloader) TempFile(fh control.FileHash) (*os.File, error) {
+	return r.pool.try(fh.Filename, func(m *mirror) (*os.File, error) {
+		rd, err := m.releaseDownloader(r.suite)
+		if err != nil {
+			return nil, err
+		}
+		f, err := rd.TempFile(fh)
+		if err != nil {
+			return nil, err
+		}
+		countDownload(r.suite, f)
+		return f, nil
+	})
+}
+
+// countDownload adds the size of the downloaded file f to the
+// downloaded_bytes_total metric.
+func countDownload(suite string, f *os.File) {
+	st, err := f.Stat()
+	if err != nil {
+		return
+	}
+	runMetrics.add("downloaded_bytes_total", metricLabels("suite", suite), float64(st.Size()))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestMirrorFailover(t *testing.T) {
+	p, err := newMirrorPool([]string{"http://a.example", " http://b.example", ""}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(p.mirrors), 2; got != want {
+		t.Fatalf("unexpected number of mirrors: got %d, want %d", got, want)
+	}
+
+	var tried []string
+	broken := map[string]bool{"http://a.example": true}
+	fetch := func(m *mirror) (*os.File, error) {
+		tried = append(tried, m.url)
+		if broken[m.url] {
+			return nil, errors.New("connection refused")
+		}
+		return nil, nil
+	}
+
+	if _, err := p.try("dists/testing/Release", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tried), 2; got != want {
+		t.Fatalf("unexpected number of attempts: got %d (%v), want %d", got, tried, want)
+	}
+
+	// The broken mirror must now be tried last.
+	tried = nil
+	if _, err := p.try("dists/testing/Release", fetch); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tried, []string{"http://b.example"}; len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("unexpected attempts: got %v, want %v", got, want)
+	}
+
+	broken["http://b.example"] = true
+	if _, err := p.try("dists/testing/Release", fetch); err == nil {
+		t.Fatalf("try() unexpectedly succeeded with all mirrors broken")
+	}
+
+	// A local mirror replaces all other mirrors.
+	p, err = newMirrorPool([]string{"http://a.example"}, "/srv/mirrors/debian", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(p.mirrors), 1; got != want {
+		t.Fatalf("unexpected number of mirrors: got %d, want %d", got, want)
+	}
+}
@@ -11,6 +11,9 @@ import (
 )
 
 func maybeSetLinkMtime(destPath string, t time.Time) error {
+	if !servingLocally() {
+		return nil
+	}
 	ts := unix.NsecToTimespec(t.UnixNano())
 	dir, err := os.Open(filepath.Dir(destPath))
 	if err != nil {
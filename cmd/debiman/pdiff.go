@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/stapelberg/debiman/internal/write"
+
+	"pault.ag/go/debian/control"
+)
+
+var pdiffs = flag.Bool("pdiffs",
+	false,
+	"If true, the uncompressed Packages and Contents files are kept in <serving_dir>/.pdiff/ and updated using the pdiffs (.diff/Index) listed in the Release file, falling back to downloading the full files. The copies take several GB and must not be served: deny access to .pdiff/ in your web server configuration")
+
+// tempFiler downloads files referenced by a Release file, see
+// mirrorPool.TempFile and releaseDownloader.TempFile.
+type tempFiler interface {
+	TempFile(fh control.FileHash) (*os.File, error)
+}
+
+// pdiffFile is an entry of a .diff/Index file.
+type pdiffFile struct {
+	hash string
+	size int64
+	name string
+}
+
+// pdiffIndex is a parsed .diff/Index file, see
+// https://wiki.debian.org/DebianRepository/Format#indices-pdiff
+type pdiffIndex struct {
+	current pdiffFile
+	// history contains the hashes of previous versions of the index
+	// file, and the name of the patch to apply to each version.
+	history []pdiffFile
+	// patches contains the hashes of the uncompressed patches, by name.
+	patches map[string]pdiffFile
+	// download contains the hashes of the compressed patches, by name
+	// of the uncompressed patch.
+	download map[string]pdiffFile
+	// merged is true if each patch updates its version to the current
+	// version instead of to the next version.
+	merged bool
+}
+
+func parsePdiffFile(value string, withName bool) (pdiffFile, error) {
+	fields := strings.Fields(value)
+	if (withName && len(fields) != 3) || (!withName && len(fields) != 2) {
+		return pdiffFile{}, fmt.Errorf("malformed entry %q", value)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return pdiffFile{}, fmt.Errorf("malformed entry %q: %v", value, err)
+	}
+	f := pdiffFile{hash: fields[0], size: size}
+	if withName {
+		f.name = fields[2]
+	}
+	return f, nil
+}
+
+func parsePdiffIndex(r io.Reader) (*pdiffIndex, error) {
+	idx := &pdiffIndex{
+		patches:  make(map[string]pdiffFile),
+		download: make(map[string]pdiffFile),
+	}
+	var field string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			colon := strings.Index(line, ":")
+			if colon == -1 {
+				return nil, fmt.Errorf("malformed line %q", line)
+			}
+			field = line[:colon]
+			value := strings.TrimSpace(line[colon+1:])
+			switch field {
+			case "SHA256-Current":
+				f, err := parsePdiffFile(value, false)
+				if err != nil {
+					return nil, err
+				}
+				idx.current = f
+			case "X-Patch-Precedence":
+				idx.merged = value == "merged"
+			}
+			continue
+		}
+		// Continuation line of a multi-line field.
+		switch field {
+		case "SHA256-History", "SHA256-Patches", "SHA256-Download":
+			f, err := parsePdiffFile(line, true)
+			if err != nil {
+				return nil, err
+			}
+			switch field {
+			case "SHA256-History":
+				idx.history = append(idx.history, f)
+			case "SHA256-Patches":
+				idx.patches[f.name] = f
+			case "SHA256-Download":
+				idx.download[strings.TrimSuffix(f.name, ".gz")] = f
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if idx.current.hash == "" {
+		return nil, fmt.Errorf("SHA256-Current missing")
+	}
+	return idx, nil
+}
+
+// patchesFrom returns the names of the patches which update the version
+// of the index file with the specified hash to the current version.
+func (idx *pdiffIndex) patchesFrom(hash string) ([]string, error) {
+	for i, h := range idx.history {
+		if h.hash != hash {
+			continue
+		}
+		if idx.merged {
+			return []string{h.name}, nil
+		}
+		names := make([]string, 0, len(idx.history)-i)
+		for _, h := range idx.history[i:] {
+			names = append(names, h.name)
+		}
+		return names, nil
+	}
+	return nil, fmt.Errorf("version %s not found in pdiff history", hash)
+}
+
+// edCommand is a command of an ed-style patch, as produced by diff --ed.
+type edCommand struct {
+	op         byte // a (append), i (insert), c (change) or d (delete)
+	start, end int  // 1-based, inclusive
+	lines      [][]byte
+}
+
+// copyUntil returns the number of input lines which precede the
+// command's change.
+func (c *edCommand) copyUntil() int {
+	switch c.op {
+	case 'a':
+		return c.end
+	default:
+		return c.start - 1
+	}
+}
+
+// parseEdPatch parses an ed-style patch. The commands are returned in
+// ascending order, i.e. in the reverse order of the patch.
+func parseEdPatch(r io.Reader) ([]*edCommand, error) {
+	var cmds []*edCommand
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			continue
+		}
+		op := line[len(line)-1]
+		if op != 'a' && op != 'i' && op != 'c' && op != 'd' {
+			return nil, fmt.Errorf("unsupported ed command %q", line)
+		}
+		addr := strings.SplitN(line[:len(line)-1], ",", 2)
+		cmd := &edCommand{op: op}
+		if cmd.start, err = strconv.Atoi(addr[0]); err != nil {
+			return nil, fmt.Errorf("malformed ed command %q", line)
+		}
+		cmd.end = cmd.start
+		if len(addr) == 2 {
+			if cmd.end, err = strconv.Atoi(addr[1]); err != nil {
+				return nil, fmt.Errorf("malformed ed command %q", line)
+			}
+		}
+		if cmd.end < cmd.start {
+			return nil, fmt.Errorf("malformed ed command %q", line)
+		}
+		if op != 'd' {
+			for {
+				text, err := br.ReadBytes('\n')
+				if err != nil {
+					return nil, fmt.Errorf("unterminated ed command %q", line)
+				}
+				if string(text) == ".\n" {
+					break
+				}
+				cmd.lines = append(cmd.lines, text)
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	// diff --ed lists the commands from the end of the file to the
+	// beginning, so that line numbers remain valid.
+	for i, j := 0, len(cmds)-1; i < j; i, j = i+1, j-1 {
+		cmds[i], cmds[j] = cmds[j], cmds[i]
+	}
+	return cmds, nil
+}
+
+// applyEdPatch writes the result of applying cmds (see parseEdPatch) to
+// r to w, without reading r into memory: Contents files are large.
+func applyEdPatch(w io.Writer, r io.Reader, cmds []*edCommand) error {
+	br := bufio.NewReader(r)
+	var line int // number of input lines consumed
+	advance := func(until int, keep bool) error {
+		for line < until {
+			text, err := br.ReadSlice('\n')
+			if err != nil && err != bufio.ErrBufferFull {
+				if err == io.EOF && len(text) > 0 {
+					err = nil // last line without trailing newline
+				} else {
+					return fmt.Errorf("patch refers to line %d, but the file ends at line %d", until, line)
+				}
+			}
+			if keep {
+				if _, err := w.Write(text); err != nil {
+					return err
+				}
+			}
+			if err == bufio.ErrBufferFull {
+				continue // same line
+			}
+			line++
+		}
+		return nil
+	}
+	for _, cmd := range cmds {
+		until := cmd.copyUntil()
+		if until < line {
+			return fmt.Errorf("ed commands out of order")
+		}
+		if err := advance(until, true); err != nil {
+			return err
+		}
+		if cmd.op == 'c' || cmd.op == 'd' {
+			if err := advance(cmd.end, false); err != nil {
+				return err
+			}
+		}
+		for _, text := range cmd.lines {
+			if _, err := w.Write(text); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := io.Copy(w, br)
+	return err
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// downloadPatch downloads and parses the patch name of the index file
+// base (e.g. main/binary-amd64/Packages).
+func downloadPatch(dl tempFiler, prefix, base string, idx *pdiffIndex, name string) ([]*edCommand, error) {
+	d, ok := idx.download[name]
+	if !ok {
+		return nil, fmt.Errorf("patch %q not listed in SHA256-Download", name)
+	}
+	f, err := dl.TempFile(control.FileHash{
+		Filename:  prefix + base + ".diff/" + d.name,
+		Algorithm: "sha256",
+		Hash:      d.hash,
+		Size:      d.size,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	// TempFile verified the compressed patch, so verifying the
+	// uncompressed patch is just a safeguard.
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := idx.patches[name]; ok {
+		if got := fmt.Sprintf("%x", sha256.Sum256(b)); got != p.hash {
+			return nil, fmt.Errorf("patch %q: SHA256 mismatch: got %s, want %s", name, got, p.hash)
+		}
+	}
+	return parseEdPatch(bytes.NewReader(b))
+}
+
+// updateByPdiff updates the uncompressed index file at local to the
+// version listed in the Release file, using the pdiffs of the index
+// file base (e.g. main/binary-amd64/Packages).
+func updateByPdiff(dl tempFiler, prefix, base, local string, hashByFilename map[string]*control.SHA256FileHash) error {
+	fh, ok := hashByFilename[base+".diff/Index"]
+	if !ok {
+		return fmt.Errorf("no pdiffs listed in the Release file")
+	}
+	hash, err := sha256File(local)
+	if err != nil {
+		return err
+	}
+
+	indexFh := fh.FileHash // copy
+	indexFh.Filename = prefix + indexFh.Filename
+	f, err := dl.TempFile(indexFh)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	idx, err := parsePdiffIndex(f)
+	if err != nil {
+		return fmt.Errorf("parsing %s.diff/Index: %v", base, err)
+	}
+	if hash == idx.current.hash {
+		return nil // already up to date
+	}
+	names, err := idx.patchesFrom(hash)
+	if err != nil {
+		return err
+	}
+
+	cur := local
+	for _, name := range names {
+		cmds, err := downloadPatch(dl, prefix, base, idx, name)
+		if err != nil {
+			return err
+		}
+		next, err := applyEdPatchFile(cur, cmds)
+		if cur != local {
+			os.Remove(cur)
+		}
+		if err != nil {
+			return fmt.Errorf("applying patch %q: %v", name, err)
+		}
+		cur = next
+	}
+	got, err := sha256File(cur)
+	if err != nil {
+		os.Remove(cur)
+		return err
+	}
+	if want := idx.current.hash; got != want {
+		os.Remove(cur)
+		return fmt.Errorf("SHA256 mismatch after patching: got %s, want %s", got, want)
+	}
+	log.Printf("updated %s by applying %d pdiffs", base, len(names))
+	return os.Rename(cur, local)
+}
+
+// applyEdPatchFile applies cmds to the file at path and returns the
+// path of the result, a temporary file next to path.
+func applyEdPatchFile(path string, cmds []*edCommand) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(path), ".patched-")
+	if err != nil {
+		return "", err
+	}
+	bw := bufio.NewWriter(out)
+	if err := applyEdPatch(bw, in, cmds); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := bw.Flush(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// openLink returns a hard link to path, opened for reading. Like a file
+// returned by TempFile, the caller removes the link after use.
+func openLink(path string) (*os.File, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".use-")
+	if err != nil {
+		return nil, err
+	}
+	name := tmp.Name()
+	tmp.Close()
+	if err := os.Remove(name); err != nil {
+		return nil, err
+	}
+	if err := os.Link(path, name); err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// fetchIndex returns the uncompressed contents of the index file path
+// (e.g. main/binary-amd64/Packages.xz) of suite in a temporary file.
+// prefix is prepended to the file names of the Release file before
+// downloading. With -pdiffs, a local copy of the index file is updated
+// using pdiffs instead of downloading the full file, if possible.
+func fetchIndex(dl tempFiler, prefix, suite, path string, hashByFilename map[string]*control.SHA256FileHash) (*os.File, error) {
+	fh, ok := hashByFilename[path]
+	if !ok {
+		return nil, fmt.Errorf("ERROR: expected path %q not found in Release file", path)
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".xz")
+	local := filepath.Join(*servingDir, ".pdiff", suite, base)
+	if *pdiffs {
+		if _, err := os.Stat(local); err == nil {
+			err := updateByPdiff(dl, prefix, base, local, hashByFilename)
+			if err == nil {
+				return openLink(local)
+			}
+			log.Printf("updating %q using pdiffs failed, downloading the full file: %v", suite+"/"+base, err)
+		}
+	}
+
+	log.Printf("getting %q (hash %v)", suite+"/"+path, fh.Hash)
+	full := fh.FileHash // copy
+	full.Filename = prefix + full.Filename
+	f, err := dl.TempFile(full)
+	if err != nil {
+		return nil, err
+	}
+	if !*pdiffs {
+		return f, nil
+	}
+	// The local copy is an optimization only, so errors are not fatal.
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		log.Printf("WARNING: keeping a local copy of %q: %v", suite+"/"+base, err)
+	} else if err := write.Atomically(local, false, func(w io.Writer) error {
+		_, err := io.Copy(w, f)
+		return err
+	}); err != nil {
+		log.Printf("WARNING: keeping a local copy of %q: %v", suite+"/"+base, err)
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		os.Remove(f.Name())
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
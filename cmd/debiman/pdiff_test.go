@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"pault.ag/go/debian/control"
+)
+
+func TestApplyEdPatch(t *testing.T) {
+	const in = "one\ntwo\nthree\nfour\nfive\n"
+	// As produced by diff --ed: from the end of the file to the beginning.
+	const patch = "5a\nsix\n.\n3,4c\nTHREE\n.\n1d\n0a\nzero\n.\n"
+	cmds, err := parseEdPatch(strings.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := applyEdPatch(&buf, strings.NewReader(in), cmds); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "zero\ntwo\nTHREE\nfive\nsix\n"; got != want {
+		t.Fatalf("applyEdPatch() = %q, want %q", got, want)
+	}
+
+	cmds, err = parseEdPatch(strings.NewReader("10d\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEdPatch(&buf, strings.NewReader(in), cmds); err == nil {
+		t.Fatalf("applyEdPatch() unexpectedly succeeded with a patch referring to a non-existing line")
+	}
+
+	if _, err := parseEdPatch(strings.NewReader("1,2s/foo/bar/\n")); err == nil {
+		t.Fatalf("parseEdPatch() unexpectedly succeeded with an unsupported command")
+	}
+}
+
+func sha256Hex(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+// fakeArchive serves files from memory, like a mirror whose TempFile
+// method verifies hashes and uncompresses files.
+type fakeArchive struct {
+	files map[string]string
+	// requested contains the names of all requested files.
+	requested []string
+}
+
+func (a *fakeArchive) TempFile(fh control.FileHash) (*os.File, error) {
+	a.requested = append(a.requested, fh.Filename)
+	content, ok := a.files[fh.Filename]
+	if !ok {
+		return nil, fmt.Errorf("%s: not found", fh.Filename)
+	}
+	if got, want := sha256Hex(content), fh.Hash; got != want {
+		return nil, fmt.Errorf("%s: SHA256 mismatch: got %s, want %s", fh.Filename, got, want)
+	}
+	f, err := ioutil.TempFile("", "debiman-fakearchive")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func TestFetchIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-pdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer flag.Set("serving_dir", *servingDir)
+	flag.Set("serving_dir", dir)
+	defer flag.Set("pdiffs", "false")
+	flag.Set("pdiffs", "true")
+
+	const (
+		v1 = "Package: a\n\nPackage: b\n"
+		v2 = "Package: a\n\nPackage: b\n\nPackage: c\n"
+		v3 = "Package: b\n\nPackage: c\n"
+	)
+	const (
+		p1 = "3a\n\nPackage: c\n.\n"
+		p2 = "1,2d\n"
+	)
+	index := fmt.Sprintf(`SHA256-Current: %s %d
+SHA256-History:
+ %s %d T-1
+ %s %d T-2
+SHA256-Patches:
+ %s %d T-1
+ %s %d T-2
+SHA256-Download:
+ %s %d T-1.gz
+ %s %d T-2.gz
+`,
+		sha256Hex(v3), len(v3),
+		sha256Hex(v1), len(v1),
+		sha256Hex(v2), len(v2),
+		sha256Hex(p1), len(p1),
+		sha256Hex(p2), len(p2),
+		sha256Hex(p1), len(p1),
+		sha256Hex(p2), len(p2))
+
+	const path = "main/binary-amd64/Packages.xz"
+	a := &fakeArchive{
+		files: map[string]string{
+			path:                                     v3,
+			"main/binary-amd64/Packages.diff/Index":  index,
+			"main/binary-amd64/Packages.diff/T-1.gz": p1,
+			"main/binary-amd64/Packages.diff/T-2.gz": p2,
+		},
+	}
+	hashByFilename := map[string]*control.SHA256FileHash{
+		path:                                    {FileHash: control.FileHash{Filename: path, Hash: sha256Hex(v3)}},
+		"main/binary-amd64/Packages.diff/Index": {FileHash: control.FileHash{Filename: "main/binary-amd64/Packages.diff/Index", Hash: sha256Hex(index)}},
+	}
+	local := filepath.Join(dir, ".pdiff", "unstable", "main/binary-amd64/Packages")
+
+	fetch := func(want string) []string {
+		a.requested = nil
+		f, err := fetchIndex(a, "", "unstable", path, hashByFilename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want {
+			t.Fatalf("fetchIndex() = %q, want %q", got, want)
+		}
+		return a.requested
+	}
+
+	t.Run("Initial", func(t *testing.T) {
+		if got, want := fetch(v3), []string{path}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected downloads: got %q, want %q", got, want)
+		}
+		b, err := ioutil.ReadFile(local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), v3; got != want {
+			t.Fatalf("unexpected local copy: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("UpToDate", func(t *testing.T) {
+		if got, want := fetch(v3), []string{"main/binary-amd64/Packages.diff/Index"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected downloads: got %q, want %q", got, want)
+		}
+		// The returned file must not be the local copy itself.
+		if _, err := os.Stat(local); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Patch", func(t *testing.T) {
+		if err := ioutil.WriteFile(local, []byte(v1), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"main/binary-amd64/Packages.diff/Index",
+			"main/binary-amd64/Packages.diff/T-1.gz",
+			"main/binary-amd64/Packages.diff/T-2.gz",
+		}
+		if got := fetch(v3); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected downloads: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		// A local copy which is not in the pdiff history.
+		if err := ioutil.WriteFile(local, []byte("Package: z\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"main/binary-amd64/Packages.diff/Index", path}
+		if got := fetch(v3); !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected downloads: got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("FallbackOnCorruptPatch", func(t *testing.T) {
+		if err := ioutil.WriteFile(local, []byte(v2), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// A patch which does not match its hash in the pdiff index.
+		a.files["main/binary-amd64/Packages.diff/T-2.gz"] = "1d\n"
+		defer func() { a.files["main/binary-amd64/Packages.diff/T-2.gz"] = p2 }()
+		got := fetch(v3)
+		if last := got[len(got)-1]; last != path {
+			t.Fatalf("full file not downloaded after a corrupt patch: %q", got)
+		}
+	})
+
+	t.Run("FallbackOnMismatch", func(t *testing.T) {
+		if err := ioutil.WriteFile(local, []byte(v2), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// A patch which matches its hash, but does not result in the
+		// current version.
+		const bad = "1d\n"
+		index := strings.Replace(index, sha256Hex(p2)+" "+fmt.Sprint(len(p2)), sha256Hex(bad)+" "+fmt.Sprint(len(bad)), -1)
+		a.files["main/binary-amd64/Packages.diff/Index"] = index
+		a.files["main/binary-amd64/Packages.diff/T-2.gz"] = bad
+		hashByFilename["main/binary-amd64/Packages.diff/Index"].Hash = sha256Hex(index)
+		got := fetch(v3)
+		if last := got[len(got)-1]; last != path {
+			t.Fatalf("full file not downloaded after a mismatch: %q", got)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	dryRun = flag.Bool("dry_run",
+		false,
+		"Discover packages, then print what would be extracted, rendered and deleted without writing anything to -serving_dir")
+
+	dryRunJSON = flag.String("dry_run_json",
+		"",
+		"If non-empty, path to which the -dry_run plan is written in JSON format, in addition to the human-readable output on stdout")
+)
+
+type plannedPackage struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+}
+
+type plannedRender struct {
+	Manpage string `json:"manpage"`
+	Reason  string `json:"reason"`
+}
+
+type plannedDeletion struct {
+	Path  string    `json:"path"`
+	Since time.Time `json:"since"`
+	Due   time.Time `json:"due"`
+}
+
+// plan describes what a debiman run would do, see -dry_run.
+type plan struct {
+	Extract []plannedPackage `json:"extract"`
+	Skip    []plannedPackage `json:"skip"`
+
+	// Render contains the manpages which are currently extracted and
+	// would be re-rendered. Manpages of the packages in Extract will
+	// be rendered in addition.
+	Render []plannedRender `json:"render"`
+
+	// Delete contains the paths which would be deleted by this run,
+	// Pending the paths which will be deleted by a later run.
+	Delete  []string          `json:"delete"`
+	Pending []plannedDeletion `json:"pending_deletions"`
+}
+
+// planExtract determines which packages would be extracted (see
+// downloadPkg).
+func planExtract(gv globalView, pl *plan) {
+	for _, p := range gv.pkgs {
+		pp := plannedPackage{
+			Package: p.suite + "/" + p.binarypkg,
+			Version: p.version.String(),
+		}
+		vPath := filepath.Join(*servingDir, p.suite, p.binarypkg, "VERSION")
+		if !*forceReextract && canSkip(*p, vPath) {
+			pl.Skip = append(pl.Skip, pp)
+		} else {
+			pl.Extract = append(pl.Extract, pp)
+		}
+	}
+	sort.Slice(pl.Extract, func(i, j int) bool { return pl.Extract[i].Package < pl.Extract[j].Package })
+	sort.Slice(pl.Skip, func(i, j int) bool { return pl.Skip[i].Package < pl.Skip[j].Package })
+}
+
+// planRender determines which manpages would be rendered, using the
+// same logic as renderAll.
+func planRender(gv globalView, pl *plan) error {
+	eg, ctx := errgroup.WithContext(context.Background())
+	renderChan := make(chan renderJob)
+	eg.Go(func() error {
+		for r := range renderChan {
+			manpage, err := filepath.Rel(*servingDir, r.dest)
+			if err != nil {
+				return err
+			}
+			pl.Render = append(pl.Render, plannedRender{
+				Manpage: manpage,
+				Reason:  r.reason,
+			})
+		}
+		return nil
+	})
+	err := walkContents(ctx, renderChan, renderWhitelist(), gv)
+	close(renderChan)
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	sort.Slice(pl.Render, func(i, j int) bool { return pl.Render[i].Manpage < pl.Render[j].Manpage })
+	return nil
+}
+
+// planDeletions determines which paths would be deleted (see
+// cleanup), without persisting any pending deletions.
+func planDeletions(gv globalView, pl *plan, now time.Time) error {
+	var err error
+	pl.Delete, err = planCleanup(gv, gv.deletions, now)
+	if err != nil {
+		return err
+	}
+	due := make(map[string]bool, len(pl.Delete))
+	for _, path := range pl.Delete {
+		due[path] = true
+	}
+	for path, since := range gv.deletions.since {
+		if due[path] {
+			continue
+		}
+		pl.Pending = append(pl.Pending, plannedDeletion{
+			Path:  path,
+			Since: since,
+			Due:   since.Add(*deleteGracePeriod),
+		})
+	}
+	sort.Slice(pl.Pending, func(i, j int) bool { return pl.Pending[i].Path < pl.Pending[j].Path })
+	return nil
+}
+
+func (pl *plan) writeText(w io.Writer) error {
+	reasons := make(map[string]int)
+	for _, r := range pl.Render {
+		reasons[r.Reason]++
+	}
+	sorted := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		sorted = append(sorted, reason)
+	}
+	sort.Strings(sorted)
+
+	fmt.Fprintf(w, "packages to extract:      %d\n", len(pl.Extract))
+	fmt.Fprintf(w, "packages to skip:         %d\n", len(pl.Skip))
+	fmt.Fprintf(w, "manpages to re-render:    %d\n", len(pl.Render))
+	for _, reason := range sorted {
+		fmt.Fprintf(w, "  %-22s  %d\n", reason+":", reasons[reason])
+	}
+	fmt.Fprintf(w, "paths to delete:          %d\n", len(pl.Delete))
+	fmt.Fprintf(w, "pending deletions:        %d\n", len(pl.Pending))
+
+	fmt.Fprintf(w, "\nExtract:\n")
+	for _, p := range pl.Extract {
+		fmt.Fprintf(w, "  %s %s\n", p.Package, p.Version)
+	}
+	fmt.Fprintf(w, "\nSkip (up to date):\n")
+	for _, p := range pl.Skip {
+		fmt.Fprintf(w, "  %s %s\n", p.Package, p.Version)
+	}
+	fmt.Fprintf(w, "\nRe-render:\n")
+	for _, r := range pl.Render {
+		fmt.Fprintf(w, "  %s (%s)\n", r.Manpage, r.Reason)
+	}
+	fmt.Fprintf(w, "\nDelete:\n")
+	for _, path := range pl.Delete {
+		fmt.Fprintf(w, "  %s\n", path)
+	}
+	fmt.Fprintf(w, "\nPending deletion:\n")
+	for _, d := range pl.Pending {
+		fmt.Fprintf(w, "  %s (due %s)\n", d.Path, d.Due.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// printPlan prints what a run would do with gv, see -dry_run.
+func printPlan(gv globalView) error {
+	var pl plan
+	planExtract(gv, &pl)
+	if err := planRender(gv, &pl); err != nil {
+		return fmt.Errorf("planning rendering: %v", err)
+	}
+	if err := planDeletions(gv, &pl, time.Now()); err != nil {
+		return fmt.Errorf("planning deletions: %v", err)
+	}
+
+	if err := pl.writeText(os.Stdout); err != nil {
+		return err
+	}
+
+	if *dryRunJSON == "" {
+		return nil
+	}
+	f, err := os.Create(*dryRunJSON)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&pl); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"pault.ag/go/debian/version"
+)
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flag.Set("serving_dir", dir)
+	flag.Set("dry_run", "true")
+	defer flag.Set("dry_run", "false")
+
+	old := time.Now().Add(-1 * time.Hour)
+	for _, f := range []struct {
+		path    string
+		content string
+		modTime time.Time
+	}{
+		{path: "testing/i3-wm/VERSION", content: "4.13-1"},
+		{path: "testing/i3-wm/i3.1.en.gz"},
+		{path: "testing/i3-wm/i3-msg.1.en.gz"},
+		{path: "testing/i3-wm/i3-msg.1.en.html.gz", modTime: old},
+		{path: "testing/i3-wm/i3bar.1.en.gz", modTime: old},
+		{path: "testing/i3-wm/i3bar.1.en.html.gz"},
+		{path: "testing/i3-wm/i3bar.1.en.txt.gz"},
+		{path: "testing/i3-wm/i3-dump-log.1.en.gz", modTime: old},
+		{path: "testing/i3-wm/i3-dump-log.1.en.html.gz"},
+		// Hardlinked to an older identical file (see -dedupe), but
+		// extracted (see VERSION) after the HTML page was rendered.
+		{path: "testing/i3-wm/i3-input.1.en.gz", modTime: old.Add(-1 * time.Hour)},
+		{path: "testing/i3-wm/i3-input.1.en.html.gz", modTime: old},
+		{path: "testing/i3-wm/i3-input.1.en.txt.gz", modTime: old.Add(-1 * time.Hour)},
+		{path: "testing/cron/VERSION", content: "3.0pl1-127"},
+	} {
+		path := filepath.Join(dir, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !f.modTime.IsZero() {
+			if err := os.Chtimes(path, f.modTime, f.modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	gv := globalView{
+		pkgs: []*pkgEntry{
+			{suite: "testing", binarypkg: "i3-wm", version: version.Version{Version: "4.13", Revision: "1"}},
+			{suite: "testing", binarypkg: "cron", version: version.Version{Version: "3.0pl1", Revision: "128"}},
+		},
+		suites: map[string]bool{"testing": true},
+		stats:  &stats{},
+		start:  time.Now(),
+	}
+
+	var pl plan
+	planExtract(gv, &pl)
+	if got, want := pl.Extract, []plannedPackage{{Package: "testing/cron", Version: "3.0pl1-128"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected packages to extract: got %v, want %v", got, want)
+	}
+	if got, want := pl.Skip, []plannedPackage{{Package: "testing/i3-wm", Version: "4.13-1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected packages to skip: got %v, want %v", got, want)
+	}
+
+	if err := planRender(gv, &pl); err != nil {
+		t.Fatal(err)
+	}
+	want := []plannedRender{
+		{Manpage: "testing/i3-wm/i3-dump-log.1.en.html.gz", Reason: reasonMissingText},
+		{Manpage: "testing/i3-wm/i3-input.1.en.html.gz", Reason: reasonOutdated},
+		{Manpage: "testing/i3-wm/i3-msg.1.en.html.gz", Reason: reasonOutdated},
+		{Manpage: "testing/i3-wm/i3.1.en.html.gz", Reason: reasonMissing},
+	}
+	if got := pl.Render; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected manpages to render: got %v, want %v", got, want)
+	}
+
+	// A dry run must not write anything.
+	for _, path := range []string{
+		"sitemapindex.xml.gz",
+		"testing/sitemap.xml.gz",
+		"testing/i3-wm/index.html.gz",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+			t.Errorf("%q unexpectedly written during dry run: %v", path, err)
+		}
+	}
+}
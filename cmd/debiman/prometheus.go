@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"html/template"
 	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,25 +35,50 @@ manpages_rendered {{ .Stats.ManpagesRendered }}
 # TYPE manpage_bytes gauge
 manpage_bytes{format="man"} {{ .Stats.ManpageBytes }}
 manpage_bytes{format="html"} {{ .Stats.HtmlBytes }}
+manpage_bytes{format="txt"} {{ .Stats.TextBytes }}
 
 # HELP index_bytes Total number of bytes used for the auxserver index.
 # TYPE index_bytes gauge
 index_bytes {{ .Stats.IndexBytes }}
 
+{{ if .Stats.StoreBytes }}
+# HELP store_bytes Total number of bytes used by the content-addressed store (see -dedupe).
+# TYPE store_bytes gauge
+store_bytes {{ .Stats.StoreBytes }}
+
+# HELP store_saved_bytes Number of bytes saved by hardlinking identical files to the content-addressed store.
+# TYPE store_saved_bytes gauge
+store_saved_bytes {{ .Stats.StoreSavedBytes }}
+{{ end }}
+
 # HELP runtime Wall-clock runtime in seconds.
 # TYPE runtime gauge
 runtime {{ .Seconds }}
 
+{{ if .LastSuccessfulRun }}
 # HELP last_successful_run Last successful run in seconds since the epoch.
 # TYPE last_successful_run gauge
 last_successful_run {{ .LastSuccessfulRun }}
+{{ end }}
 `
 
 var metricsTmpl = template.Must(template.New("metrics").Parse(metricsTmplContent))
 
+// writeMetrics writes the metrics of a successful run to w, in the
+// format of the node_exporter textfile collector.
 func writeMetrics(w io.Writer, gv globalView, start time.Time) error {
 	now := time.Now()
-	return metricsTmpl.Execute(w, struct {
+	return writeMetricsAt(w, gv, start, now, now.Unix())
+}
+
+// writeMetricsAt writes the metrics of the run which started at start
+// as of now. lastSuccessfulRun is omitted if zero.
+func writeMetricsAt(w io.Writer, gv globalView, start, now time.Time, lastSuccessfulRun int64) error {
+	st := gv.stats
+	if st == nil {
+		st = &stats{}
+	}
+	if err := metricsTmpl.Execute(w, struct {
 		Packages          int
 		Stats             *stats
 		Now               time.Time
@@ -53,9 +86,214 @@ func writeMetrics(w io.Writer, gv globalView, start time.Time) error {
 		LastSuccessfulRun int64
 	}{
 		Packages:          len(gv.pkgs),
-		Stats:             gv.stats,
+		Stats:             st,
 		Now:               now,
 		Seconds:           int(now.Sub(start).Seconds()),
-		LastSuccessfulRun: now.Unix(),
-	})
+		LastSuccessfulRun: lastSuccessfulRun,
+	}); err != nil {
+		return err
+	}
+	return runMetrics.writeTo(w)
+}
+
+// serveMetrics serves the metrics of the current run, see -listen.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	gv, start := liveStatus.globalView()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := writeMetricsAt(w, gv, start, time.Now(), 0); err != nil {
+		log.Printf("writing metrics: %v", err)
+	}
+}
+
+// metricType is a Prometheus metric type.
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+type metricFamily struct {
+	typ     metricType
+	help    string
+	buckets []float64 // histograms only
+
+	// values maps from the rendered label set (e.g. {suite="sid"}) to
+	// the value of a counter or gauge, or to a histogram.
+	values     map[string]float64
+	histograms map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// metricsRegistry collects the metrics of a run in memory, exposed in
+// the Prometheus text format (see writeTo).
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+// describe registers a metric. Metrics must be registered before use.
+func (r *metricsRegistry) describe(name string, typ metricType, help string, buckets ...float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families[name] = &metricFamily{
+		typ:        typ,
+		help:       help,
+		buckets:    buckets,
+		values:     make(map[string]float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+func (r *metricsRegistry) family(name string) *metricFamily {
+	f, ok := r.families[name]
+	if !ok {
+		panic(fmt.Sprintf("BUG: metric %q not registered", name))
+	}
+	return f
+}
+
+// add adds v to the counter or gauge name.
+func (r *metricsRegistry) add(name, labels string, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.family(name).values[labels] += v
+}
+
+// set sets the gauge name to v.
+func (r *metricsRegistry) set(name, labels string, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.family(name).values[labels] = v
+}
+
+// observe adds v to the histogram name.
+func (r *metricsRegistry) observe(name, labels string, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name)
+	h, ok := f.histograms[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(f.buckets))}
+		f.histograms[labels] = h
+	}
+	for idx, le := range f.buckets {
+		if v <= le {
+			h.counts[idx]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metricLabels renders label name/value pairs, e.g.
+// metricLabels("suite", "sid") returns {suite="sid"}.
+func metricLabels(kv ...string) string {
+	if len(kv) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, kv[i]+"="+strconv.Quote(kv[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds the label name=value to the rendered label set
+// labels.
+func withLabel(labels, name, value string) string {
+	l := name + "=" + strconv.Quote(value)
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + l + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeTo writes all metrics with at least one value in the
+// Prometheus text format, sorted by name and labels.
+func (r *metricsRegistry) writeTo(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.families))
+	for name, f := range r.families {
+		if len(f.values) > 0 || len(f.histograms) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(bw, "\n# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.typ)
+		if f.typ != histogramType {
+			labels := make([]string, 0, len(f.values))
+			for l := range f.values {
+				labels = append(labels, l)
+			}
+			sort.Strings(labels)
+			for _, l := range labels {
+				fmt.Fprintf(bw, "%s%s %s\n", name, l, formatFloat(f.values[l]))
+			}
+			continue
+		}
+		labels := make([]string, 0, len(f.histograms))
+		for l := range f.histograms {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		for _, l := range labels {
+			h := f.histograms[l]
+			var cumulative uint64
+			for idx, le := range f.buckets {
+				cumulative += h.counts[idx]
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", name, withLabel(l, "le", formatFloat(le)), cumulative)
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", name, withLabel(l, "le", "+Inf"), h.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", name, l, formatFloat(h.sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", name, l, h.count)
+		}
+	}
+	return bw.Flush()
+}
+
+// runMetrics contains the detailed metrics of the current run.
+var runMetrics = newMetricsRegistry()
+
+func init() {
+	runMetrics.describe("stage_duration_seconds", gaugeType,
+		"Wall-clock duration of each stage in seconds. Stages which are run per suite (contents, packages, xref) have a suite label.")
+	runMetrics.describe("downloaded_bytes_total", counterType,
+		"Number of bytes downloaded from the mirrors (index files and packages), by suite.")
+	runMetrics.describe("mandoc_render_duration_seconds", histogramType,
+		"Latency of converting a manpage to HTML using mandoc, by suite.",
+		0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+	runMetrics.describe("render_failures_total", counterType,
+		"Number of manpages which could not be rendered (an error page was written instead), by suite.")
+	runMetrics.describe("renders_reused_total", counterType,
+		"Number of manpages whose rendered HTML was re-used instead of running mandoc, by suite.")
+	runMetrics.describe("variants_invalidated_total", counterType,
+		"Number of manpage variants (other languages, suites, sections) which were re-rendered because a related manpage changed, by suite.")
+	runMetrics.describe("manpages_rendered_total", counterType,
+		"Number of manpages rendered to HTML, by suite.")
+	runMetrics.describe("packages_extracted_total", counterType,
+		"Number of packages from which manpages were extracted, by suite.")
+	runMetrics.describe("files_deduplicated_total", counterType,
+		"Number of extracted or rendered files which were replaced by a hardlink to the content-addressed store (see -dedupe), by suite.")
+	runMetrics.describe("files_hardlinked_total", counterType,
+		"Number of extracted files which were hardlinked to the identical file of the same package version in another suite, by suite.")
 }
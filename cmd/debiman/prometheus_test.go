@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	r := newMetricsRegistry()
+	r.describe("stage_duration_seconds", gaugeType, "Duration.")
+	r.describe("downloaded_bytes_total", counterType, "Bytes.")
+	r.describe("mandoc_render_duration_seconds", histogramType, "Latency.", 0.1, 1)
+	r.describe("unused_total", counterType, "Never written.")
+
+	r.set("stage_duration_seconds", metricLabels("stage", "render"), 12.5)
+	r.set("stage_duration_seconds", metricLabels("stage", "contents", "suite", "sid"), 3)
+	r.add("downloaded_bytes_total", metricLabels("suite", "sid"), 100)
+	r.add("downloaded_bytes_total", metricLabels("suite", "sid"), 50)
+	for _, v := range []float64{0.05, 0.5, 0.7, 3} {
+		r.observe("mandoc_render_duration_seconds", metricLabels("suite", "sid"), v)
+	}
+
+	var buf bytes.Buffer
+	if err := r.writeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `
+# HELP downloaded_bytes_total Bytes.
+# TYPE downloaded_bytes_total counter
+downloaded_bytes_total{suite="sid"} 150
+
+# HELP mandoc_render_duration_seconds Latency.
+# TYPE mandoc_render_duration_seconds histogram
+mandoc_render_duration_seconds_bucket{suite="sid",le="0.1"} 1
+mandoc_render_duration_seconds_bucket{suite="sid",le="1"} 3
+mandoc_render_duration_seconds_bucket{suite="sid",le="+Inf"} 4
+mandoc_render_duration_seconds_sum{suite="sid"} 4.25
+mandoc_render_duration_seconds_count{suite="sid"} 4
+
+# HELP stage_duration_seconds Duration.
+# TYPE stage_duration_seconds gauge
+stage_duration_seconds{stage="contents",suite="sid"} 3
+stage_duration_seconds{stage="render"} 12.5
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("unexpected metrics: got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteMetricsOmitsLastSuccessfulRun(t *testing.T) {
+	var buf bytes.Buffer
+	gv := globalView{stats: &stats{}}
+	start := time.Now()
+	if err := writeMetricsAt(&buf, gv, start, start, 0); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "last_successful_run") {
+		t.Fatalf("metrics of a run in progress contain last_successful_run:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/write"
+)
+
+var (
+	failureBudget = flag.Int("failure_budget",
+		50,
+		"Number of packages which may fail to extract or render before the run is aborted. Failing packages are quarantined (see quarantine.json in -serving_dir) and retried with exponential backoff on later runs. 0 aborts the run on the first failure.")
+
+	quarantineBackoff = flag.Duration("quarantine_backoff",
+		6*time.Hour,
+		"How long a failing package is skipped before it is retried. The duration doubles with every consecutive failure, up to one week. A new package version is always retried right away.")
+)
+
+const maxQuarantineBackoff = 7 * 24 * time.Hour
+
+// Stages in which a package can fail, see quarantine.
+const (
+	stageExtract = "extract"
+	stageRender  = "render"
+)
+
+// budget limits the number of failures tolerated within a run. The
+// nil budget tolerates no failures.
+type budget struct {
+	limit int32
+	spent int32
+}
+
+func newBudget(limit int) *budget {
+	return &budget{limit: int32(limit)}
+}
+
+// spend records a failure and returns whether the run can continue.
+func (b *budget) spend() bool {
+	if b == nil {
+		return false
+	}
+	return atomic.AddInt32(&b.spent, 1) <= b.limit
+}
+
+type quarantineEntry struct {
+	Stage       string    `json:"stage"`
+	Package     string    `json:"package"` // <suite>/<binarypkg>
+	Version     string    `json:"version"`
+	Error       string    `json:"error"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	RetryAfter  time.Time `json:"retry_after"`
+}
+
+// quarantine tracks packages which failed to extract or render, so
+// that later runs skip them instead of failing over and over again.
+// Quarantined packages are retried once their backoff expired, and
+// released from quarantine once they were processed successfully.
+type quarantine struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*quarantineEntry
+	// retried contains the keys of quarantined entries which were
+	// retried in this run.
+	retried map[string]bool
+	// failed contains the keys of entries which failed in this run.
+	failed map[string]bool
+}
+
+func quarantineKey(stage, pkg string) string {
+	return stage + ":" + pkg
+}
+
+func loadQuarantine(path string) (*quarantine, error) {
+	q := &quarantine{
+		path:    path,
+		entries: make(map[string]*quarantineEntry),
+		retried: make(map[string]bool),
+		failed:  make(map[string]bool),
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*quarantineEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		q.entries[quarantineKey(e.Stage, e.Package)] = e
+	}
+	return q, nil
+}
+
+// skip returns whether pkg should be skipped in stage because it is
+// quarantined. Versions other than the quarantined one are retried.
+func (q *quarantine) skip(stage, pkg, version string, now time.Time) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := quarantineKey(stage, pkg)
+	e, ok := q.entries[key]
+	if !ok {
+		return false
+	}
+	if e.Version == version && now.Before(e.RetryAfter) {
+		return true
+	}
+	q.retried[key] = true
+	return false
+}
+
+// fail records that pkg failed in stage.
+func (q *quarantine) fail(stage, pkg, version string, err error, now time.Time) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	key := quarantineKey(stage, pkg)
+	e, ok := q.entries[key]
+	if !ok || e.Version != version {
+		e = &quarantineEntry{
+			Stage:   stage,
+			Package: pkg,
+			Version: version,
+		}
+		q.entries[key] = e
+	}
+	if q.failed[key] {
+		// Only the first failure of a run counts, e.g. when multiple
+		// manpages of the same package fail to render.
+		return
+	}
+	q.failed[key] = true
+	e.Error = err.Error()
+	e.Failures++
+	e.LastFailure = now
+	backoff := *quarantineBackoff
+	for i := 1; i < e.Failures && backoff < maxQuarantineBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxQuarantineBackoff {
+		backoff = maxQuarantineBackoff
+	}
+	e.RetryAfter = now.Add(backoff)
+}
+
+// release removes all retried entries which did not fail again.
+func (q *quarantine) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key := range q.retried {
+		if !q.failed[key] {
+			delete(q.entries, key)
+		}
+	}
+}
+
+// retain removes all entries for which keep returns false, e.g. for
+// packages which are no longer in the archive.
+func (q *quarantine) retain(keep func(pkg string) bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for key, e := range q.entries {
+		if !keep(e.Package) {
+			delete(q.entries, key)
+		}
+	}
+}
+
+func (q *quarantine) list() []*quarantineEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]*quarantineEntry, 0, len(q.entries))
+	for _, e := range q.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Package == entries[j].Package {
+			return entries[i].Stage < entries[j].Stage
+		}
+		return entries[i].Package < entries[j].Package
+	})
+	return entries
+}
+
+func (q *quarantine) save() error {
+	entries := q.list()
+	return write.Atomically(q.path, false, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	})
+}
+
+// spendFailure quarantines pkg and returns an error if the failure
+// budget of the run is exhausted.
+func spendFailure(gv globalView, stage, pkg, version string, err error) error {
+	gv.quarantine.fail(stage, pkg, version, err, time.Now())
+	if !gv.budget.spend() {
+		return fmt.Errorf("failure budget (-failure_budget=%d) exhausted: %v", *failureBudget, err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuarantine(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "debiman-quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "quarantine.json")
+
+	q, err := loadQuarantine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	failure := errors.New("truncated archive")
+	q.fail(stageExtract, "jessie/i3-wm", "4.8-2", failure, now)
+	// A second failure within the same run does not extend the backoff.
+	q.fail(stageExtract, "jessie/i3-wm", "4.8-2", failure, now)
+	if err := q.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Next run: the package is skipped until the backoff expired.
+	q, err = loadQuarantine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.skip(stageExtract, "jessie/i3-wm", "4.8-2", now.Add(*quarantineBackoff-time.Minute)) {
+		t.Fatalf("quarantined package not skipped")
+	}
+	if q.skip(stageRender, "jessie/i3-wm", "4.8-2", now) {
+		t.Fatalf("package skipped in a stage in which it did not fail")
+	}
+	if q.skip(stageExtract, "jessie/i3-wm", "4.8-3", now) {
+		t.Fatalf("new package version skipped")
+	}
+
+	// Retry after the backoff expired, which fails again: the backoff
+	// doubles.
+	retry := now.Add(*quarantineBackoff)
+	if q.skip(stageExtract, "jessie/i3-wm", "4.8-2", retry) {
+		t.Fatalf("package skipped after the backoff expired")
+	}
+	q.fail(stageExtract, "jessie/i3-wm", "4.8-2", failure, retry)
+	q.release()
+	entries := q.list()
+	if got, want := len(entries), 1; got != want {
+		t.Fatalf("unexpected number of quarantine entries: got %d, want %d", got, want)
+	}
+	e := entries[0]
+	if got, want := e.Failures, 2; got != want {
+		t.Fatalf("unexpected number of failures: got %d, want %d", got, want)
+	}
+	if got, want := e.RetryAfter, retry.Add(2**quarantineBackoff); !got.Equal(want) {
+		t.Fatalf("unexpected retry time: got %v, want %v", got, want)
+	}
+
+	// A successful retry releases the package from quarantine.
+	q, err = loadQuarantine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.fail(stageExtract, "jessie/i3-wm", "4.8-2", failure, now)
+	q, err = loadQuarantine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.skip(stageExtract, "jessie/i3-wm", "4.8-3", now) {
+		t.Fatalf("new package version skipped")
+	}
+	q.release()
+	if got := len(q.list()); got != 0 {
+		t.Fatalf("package not released from quarantine: %+v", q.list())
+	}
+}
+
+func TestQuarantineBackoffLimit(t *testing.T) {
+	var q quarantine
+	q.entries = make(map[string]*quarantineEntry)
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		q.failed = make(map[string]bool)
+		q.fail(stageRender, "jessie/i3-wm", "4.8-2", errors.New("disk full"), now)
+	}
+	e := q.entries[quarantineKey(stageRender, "jessie/i3-wm")]
+	if got, want := e.RetryAfter, now.Add(maxQuarantineBackoff); !got.Equal(want) {
+		t.Fatalf("unexpected retry time: got %v, want %v", got, want)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	var nilBudget *budget
+	if nilBudget.spend() {
+		t.Fatalf("nil budget tolerates failures")
+	}
+	b := newBudget(2)
+	for i := 0; i < 2; i++ {
+		if !b.spend() {
+			t.Fatalf("failure %d exhausted a budget of 2", i+1)
+		}
+	}
+	if b.spend() {
+		t.Fatalf("budget of 2 tolerates 3 failures")
+	}
+}
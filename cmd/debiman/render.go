@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -15,14 +14,13 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/stapelberg/debiman/internal/commontmpl"
 	"github.com/stapelberg/debiman/internal/convert"
 	"github.com/stapelberg/debiman/internal/manpage"
 	"github.com/stapelberg/debiman/internal/sitemap"
-	"github.com/stapelberg/debiman/internal/write"
+	"github.com/stapelberg/debiman/internal/storage"
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 )
@@ -30,11 +28,11 @@ import (
 var (
 	manwalkConcurrency = flag.Int("concurrency_manwalk",
 		1000, // below the default 1024 open file descriptor limit
-		"Concurrency level for walking through binary package man directories (ulimit -n must be higher!)")
+		"Concurrency level for walking through binary package man directories (ulimit -n must be higher!). If not specified, planned according to ulimit -n.")
 
 	renderConcurrency = flag.Int("concurrency_render",
 		5,
-		"Concurrency level for rendering manpages using mandoc")
+		"Concurrency level for rendering manpages using mandoc. If not specified, planned according to the available CPUs and memory.")
 
 	gzipLevel = flag.Int("gzip",
 		9,
@@ -105,62 +103,42 @@ const (
 func listManpages(dir string) (map[string]*manpage.Meta, error) {
 	manpageByName := make(map[string]*manpage.Meta)
 
-	files, err := os.Open(dir)
+	names, err := serving.ReadDirNames(dir)
 	if err != nil {
+		// We avoid an additional stat syscalls for each
+		// binary package directory by just optimistically
+		// calling readdir and handling the ENOTDIR error.
+		if storage.IsNotDir(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
-	defer files.Close()
 
-	var predictedEof bool
-	for {
-		if predictedEof {
-			break
+	for _, fn := range names {
+		if !strings.HasSuffix(fn, ".gz") ||
+			renderedSuffix(fn) != "" {
+			continue
 		}
+		full := filepath.Join(dir, fn)
 
-		names, err := files.Readdirnames(2048)
+		m, err := manpage.FromServingPath(*servingDir, full)
 		if err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				// We avoid an additional stat syscalls for each
-				// binary package directory by just optimistically
-				// calling readdir and handling the ENOTDIR error.
-				if sce, ok := err.(*os.SyscallError); ok && sce.Err == syscall.ENOTDIR {
-					return nil, nil
-				}
-				return nil, err
-			}
+			// If we run into this case, our code cannot correctly
+			// interpret the result of ServingPath().
+			log.Printf("BUG: cannot parse manpage from serving path %q: %v", full, err)
+			continue
 		}
 
-		// When len(names) < 2048 the next Readdirnames() call will
-		// result in io.EOF and can be skipped to reduce getdents(2)
-		// syscalls by half.
-		predictedEof = len(names) < 2048
-
-		for _, fn := range names {
-			if !strings.HasSuffix(fn, ".gz") ||
-				strings.HasSuffix(fn, ".html.gz") {
-				continue
-			}
-			full := filepath.Join(dir, fn)
-
-			m, err := manpage.FromServingPath(*servingDir, full)
-			if err != nil {
-				// If we run into this case, our code cannot correctly
-				// interpret the result of ServingPath().
-				log.Printf("BUG: cannot parse manpage from serving path %q: %v", full, err)
-				continue
-			}
-
-			manpageByName[fn] = m
-		}
+		manpageByName[fn] = m
 	}
 	return manpageByName, nil
 }
 
-func renderDirectoryIndex(dir string, newestModTime time.Time) error {
-	st, err := os.Stat(filepath.Join(dir, "index.html.gz"))
-	if !*forceRerender && err == nil && st.ModTime().After(newestModTime) {
+func renderDirectoryIndex(dir string, newestModTime time.Time, assets *assetState) error {
+	// e.g. “testing/i3-wm”
+	pkg := filepath.Base(filepath.Dir(dir)) + "/" + filepath.Base(dir)
+	st, err := serving.Stat(filepath.Join(dir, "index.html.gz"))
+	if !*forceRerender && err == nil && st.ModTime().After(newestModTime) && !assets.stalePackage(pkg, st.ModTime()) {
 		return nil
 	}
 
@@ -177,26 +155,54 @@ func renderDirectoryIndex(dir string, newestModTime time.Time) error {
 	return renderPkgindex(filepath.Join(dir, "index.html.gz"), manpageByName)
 }
 
+// extractedAt returns when the package in dir was last extracted, i.e.
+// the modification time of its VERSION file (zero if unknown). The
+// modification time of its manpages is not sufficient: they are
+// hardlinked to identical files of other packages (see -dedupe and
+// linkFirst), whose modification time they share.
+func extractedAt(dir string) time.Time {
+	st, err := serving.Stat(filepath.Join(dir, "VERSION"))
+	if err != nil {
+		return time.Time{}
+	}
+	return st.ModTime()
+}
+
+// statFunc returns information about path, following symlinks (see
+// Storage.Stat).
+type statFunc func(path string) (os.FileInfo, error)
+
+func newer(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
 // walkManContents walks over all entries in dir and, depending on mode, does:
 // 1. send a renderJob for each regular file
 // 2. send a renderJob for each symlink
 func walkManContents(ctx context.Context, renderChan chan<- renderJob, dir string, mode renderingMode, gv globalView, newestModTime time.Time) (time.Time, error) {
-	// the invariant is: each file ending in .gz must have a corresponding .html.gz file
-	// the .html.gz must have a modtime that is >= the modtime of the .gz file
+	// the invariant is: each file ending in .gz must have a corresponding .html.gz and .txt.gz file
+	// the .html.gz must have a modtime that is >= the modtime of the .gz file and of the package’s VERSION file (see extractedAt)
 
-	files, err := os.Open(dir)
+	files, err := serving.OpenDir(dir)
 	if err != nil {
 		return newestModTime, err
 	}
 	defer files.Close()
 
+	// e.g. “testing/i3-wm”
+	pkg := filepath.Base(filepath.Dir(dir)) + "/" + filepath.Base(dir)
+	var extracted time.Time
+
 	var predictedEof bool
-	for {
+	for first := true; ; first = false {
 		if predictedEof {
 			break
 		}
 
-		names, err := files.Readdirnames(2048)
+		batch, err := files.Readdir(2048)
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -204,31 +210,57 @@ func walkManContents(ctx context.Context, renderChan chan<- renderJob, dir strin
 				// We avoid an additional stat syscalls for each
 				// binary package directory by just optimistically
 				// calling readdir and handling the ENOTDIR error.
-				if sce, ok := err.(*os.SyscallError); ok && sce.Err == syscall.ENOTDIR {
+				if storage.IsNotDir(err) {
 					return newestModTime, nil
 				}
 				return newestModTime, err
 			}
 		}
 
-		// When len(names) < 2048 the next Readdirnames() call will
+		// When len(batch) < 2048 the next Readdir() call will
 		// result in io.EOF and can be skipped to reduce getdents(2)
 		// syscalls by half.
-		predictedEof = len(names) < 2048
+		predictedEof = len(batch) < 2048
+
+		if first {
+			extracted = extractedAt(dir)
+		}
 
-		for _, fn := range names {
+		// The renderings next to each manpage are looked up in the
+		// batch, which avoids one request per file in object
+		// storage. Only if the batch does not contain the whole
+		// directory, files which are not in the batch are stat’ed.
+		infos := make(map[string]os.FileInfo, len(batch))
+		for _, fi := range batch {
+			infos[fi.Name()] = fi
+		}
+		complete := first && predictedEof
+		stat := func(path string) (os.FileInfo, error) {
+			fi, ok := infos[filepath.Base(path)]
+			if ok && fi.Mode()&os.ModeSymlink == 0 {
+				return fi, nil
+			}
+			if !ok && complete {
+				return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+			}
+			return serving.Stat(path)
+		}
+
+		for _, fi := range batch {
+			fn := fi.Name()
 			if !strings.HasSuffix(fn, ".gz") ||
-				strings.HasSuffix(fn, ".html.gz") {
+				renderedSuffix(fn) != "" {
 				continue
 			}
 			full := filepath.Join(dir, fn)
 
-			st, err := os.Lstat(full)
-			if err != nil {
+			st, ok := infos[fn]
+			if !ok {
 				continue
 			}
-			if st.ModTime().After(newestModTime) {
-				newestModTime = st.ModTime()
+			modTime := newer(st.ModTime(), extracted)
+			if modTime.After(newestModTime) {
+				newestModTime = modTime
 			}
 
 			symlink := st.Mode()&os.ModeSymlink != 0
@@ -243,11 +275,40 @@ func walkManContents(ctx context.Context, renderChan chan<- renderJob, dir strin
 			}
 
 			n := strings.TrimSuffix(fn, ".gz") + ".html.gz"
-			htmlst, err := os.Stat(filepath.Join(dir, n))
+			htmlst, err := stat(filepath.Join(dir, n))
 			if err == nil {
 				atomic.AddUint64(&gv.stats.HtmlBytes, uint64(htmlst.Size()))
 			}
-			if err != nil || *forceRerender || htmlst.ModTime().Before(st.ModTime()) {
+			textst, textErr := stat(textPath(filepath.Join(dir, n)))
+			if textErr == nil {
+				atomic.AddUint64(&gv.stats.TextBytes, uint64(textst.Size()))
+			}
+			var reason string
+			switch {
+			case err != nil:
+				reason = reasonMissing
+			case htmlst.ModTime().Before(modTime):
+				reason = reasonOutdated
+			case *forceRerender && (gv.resumeSince.IsZero() || !htmlst.ModTime().After(gv.resumeSince)):
+				reason = reasonForced
+			case gv.assets.stalePackage(pkg, htmlst.ModTime()):
+				reason = reasonAssets
+			case missingPrintable(stat, filepath.Base(filepath.Dir(dir)), filepath.Join(dir, n)):
+				// The printable versions and the HTML page linking
+				// to them are rendered, see renderMissingPrint.
+				reason = reasonMissingPrint
+			case textErr != nil && gv.outputs.due(pkg):
+				// The text is rendered right before the HTML page, so it
+				// is only checked for existence: it may be hardlinked to
+				// an older file (see -dedupe). Only the text is
+				// rendered, see renderMissingText.
+				reason = reasonMissingText
+			case *renderMarkdown && gv.outputs.due(pkg) && outdatedMarkdown(stat, filepath.Join(dir, n), modTime):
+				// Only the Markdown rendering is rendered, see
+				// renderMissingMarkdown.
+				reason = reasonMissingMarkdown
+			}
+			if reason != "" {
 				m, err := manpage.FromServingPath(*servingDir, full)
 				if err != nil {
 					// If we run into this case, our code cannot correctly
@@ -270,26 +331,26 @@ func walkManContents(ctx context.Context, renderChan chan<- renderJob, dir strin
 				// Render dependent manpages first to properly resume
 				// in case debiman is interrupted.
 				for _, v := range versions {
-					if v == m || *forceRerender {
+					if v == m || *forceRerender || reason == reasonMissingPrint || reason == reasonMissingText || reason == reasonMissingMarkdown {
 						continue
 					}
 
 					vfull := filepath.Join(*servingDir, v.RawPath())
 					vfn := filepath.Join(*servingDir, v.ServingPath()+".html.gz")
-					vhtmlst, err := os.Stat(vfn)
+					vhtmlst, err := serving.Stat(vfn)
 					if err == nil && vhtmlst.ModTime().After(gv.start) {
 						// The variant was already re-rendered with this globalView.
 						continue
 					}
 
-					vst, err := os.Stat(vfull)
+					vst, err := serving.Stat(vfull)
 					if err != nil {
 						log.Printf("WARNING: stat %q: %v", vfull, err)
 						continue
 					}
 
 					vreuse := ""
-					if vhtmlst != nil && vhtmlst.ModTime().After(vst.ModTime()) {
+					if vhtmlst != nil && vhtmlst.ModTime().After(newer(vst.ModTime(), extractedAt(filepath.Dir(vfull)))) {
 						vreuse = vfn
 					}
 
@@ -304,7 +365,12 @@ func walkManContents(ctx context.Context, renderChan chan<- renderJob, dir strin
 						xref:     gv.xref,
 						modTime:  vst.ModTime(),
 						reuse:    vreuse,
+						report:   gv.report,
+						reason:   reasonInvalidated,
+						cache:    gv.fragmentCache,
 					}:
+						liveStatus.manpageQueued()
+						runMetrics.add("variants_invalidated_total", metricLabels("suite", v.Package.Suite), 1)
 					case <-ctx.Done():
 						break
 					}
@@ -312,7 +378,7 @@ func walkManContents(ctx context.Context, renderChan chan<- renderJob, dir strin
 
 				var reuse string
 				if symlink {
-					link, err := os.Readlink(full)
+					link, err := serving.Readlink(full)
 					if err == nil {
 						resolved := filepath.Join(dir, link)
 						reuse = strings.TrimSuffix(resolved, ".gz") + ".html.gz"
@@ -328,7 +394,11 @@ func walkManContents(ctx context.Context, renderChan chan<- renderJob, dir strin
 					xref:     gv.xref,
 					modTime:  st.ModTime(),
 					reuse:    reuse,
+					report:   gv.report,
+					reason:   reason,
+					cache:    gv.fragmentCache,
 				}:
+					liveStatus.manpageQueued()
 				case <-ctx.Done():
 					break
 				}
@@ -342,7 +412,14 @@ func walkManContents(ctx context.Context, renderChan chan<- renderJob, dir strin
 func walkContents(ctx context.Context, renderChan chan<- renderJob, whitelist map[string]bool, gv globalView) error {
 	sitemaps := make(map[string]time.Time)
 
-	suitedirs, err := ioutil.ReadDir(*servingDir)
+	// versions maps <suite>/<binarypkg> to the version of the package,
+	// so that new versions of quarantined packages are retried.
+	versions := make(map[string]string, len(gv.pkgs))
+	for _, p := range gv.pkgs {
+		versions[p.suite+"/"+p.binarypkg] = p.version.String()
+	}
+
+	suitedirs, err := serving.ReadDir(*servingDir)
 	if err != nil {
 		return err
 	}
@@ -353,11 +430,10 @@ func walkContents(ctx context.Context, renderChan chan<- renderJob, whitelist ma
 		if !gv.suites[sfi.Name()] {
 			continue
 		}
-		bins, err := os.Open(filepath.Join(*servingDir, sfi.Name()))
+		bins, err := serving.ReadDirNames(filepath.Join(*servingDir, sfi.Name()))
 		if err != nil {
 			return err
 		}
-		defer bins.Close()
 
 		// 20000 is the order of magnitude of binary packages
 		// (containing manpages) in any given Debian suite, so that is
@@ -365,15 +441,12 @@ func walkContents(ctx context.Context, renderChan chan<- renderJob, whitelist ma
 		sitemapEntries := make(map[string]time.Time, 20000)
 		var sitemapEntriesMu sync.RWMutex
 
-		for {
-			names, err := bins.Readdirnames(*manwalkConcurrency)
-			if err != nil {
-				if err == io.EOF {
-					break
-				} else {
-					return err
-				}
+		for len(bins) > 0 {
+			names := bins
+			if len(names) > *manwalkConcurrency {
+				names = names[:*manwalkConcurrency]
 			}
+			bins = bins[len(names):]
 
 			var wg errgroup.Group
 			for _, bfn := range names {
@@ -381,6 +454,12 @@ func walkContents(ctx context.Context, renderChan chan<- renderJob, whitelist ma
 					continue
 				}
 
+				key := sfi.Name() + "/" + bfn
+				if gv.quarantine.skip(stageRender, key, versions[key], time.Now()) {
+					log.Printf("Skipping quarantined package %s/%s", sfi.Name(), bfn)
+					continue
+				}
+
 				bfn := bfn // copy
 				dir := filepath.Join(*servingDir, sfi.Name(), bfn)
 				wg.Go(func() error {
@@ -405,9 +484,13 @@ func walkContents(ctx context.Context, renderChan chan<- renderJob, whitelist ma
 						return err
 					}
 
+					if *dryRun {
+						return nil
+					}
+
 					// and finally render the package index files which need to
 					// consider both regular files and symlinks.
-					if err := renderDirectoryIndex(dir, newestModTime); err != nil {
+					if err := renderDirectoryIndex(dir, newestModTime, gv.assets); err != nil {
 						return err
 					}
 
@@ -423,21 +506,38 @@ func walkContents(ctx context.Context, renderChan chan<- renderJob, whitelist ma
 			if err := wg.Wait(); err != nil {
 				return err
 			}
+			// Stop before writing an incomplete sitemap.
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		if *dryRun {
+			continue
 		}
-		bins.Close()
 
 		sitemapPath := filepath.Join(*servingDir, sfi.Name(), "sitemap.xml.gz")
-		if err := write.Atomically(sitemapPath, true, func(w io.Writer) error {
+		if err := serving.Write(sitemapPath, true, func(w io.Writer) error {
 			return sitemap.WriteTo(w, *baseURL+"/"+sfi.Name(), sitemapEntries)
 		}); err != nil {
 			return err
 		}
-		st, err := os.Stat(sitemapPath)
-		if err == nil {
+		if *reproducible {
+			var newest time.Time
+			for _, t := range sitemapEntries {
+				if t.After(newest) {
+					newest = t
+				}
+			}
+			sitemaps[sfi.Name()] = newest
+		} else if st, err := serving.Stat(sitemapPath); err == nil {
 			sitemaps[sfi.Name()] = st.ModTime()
 		}
 	}
-	return write.Atomically(filepath.Join(*servingDir, "sitemapindex.xml.gz"), true, func(w io.Writer) error {
+	if *dryRun {
+		return nil
+	}
+	return serving.Write(filepath.Join(*servingDir, "sitemapindex.xml.gz"), true, func(w io.Writer) error {
 		return sitemap.WriteIndexTo(w, *baseURL, sitemaps)
 	})
 }
@@ -457,8 +557,8 @@ func writeSourceIndex(gv globalView, newestForSource map[string]time.Time) error
 		for src, binaries := range binariesBySource {
 			srcDir := filepath.Join(*servingDir, suite, "src:"+src)
 			// skip if current index file is more recent than newestForSource
-			st, err := os.Stat(filepath.Join(srcDir, "index.html.gz"))
-			if !*forceRerender && err == nil && st.ModTime().After(newestForSource[src]) {
+			st, err := serving.Stat(filepath.Join(srcDir, "index.html.gz"))
+			if !*forceRerender && err == nil && st.ModTime().After(newestForSource[src]) && !gv.assets.staleSource(suite, binaries, st.ModTime()) {
 				continue
 			}
 
@@ -480,7 +580,7 @@ func writeSourceIndex(gv globalView, newestForSource map[string]time.Time) error
 				continue // The entire source package does not contain any manpages.
 			}
 
-			if err := os.MkdirAll(srcDir, 0755); err != nil {
+			if err := serving.MkdirAll(srcDir); err != nil {
 				return err
 			}
 			if err := renderSrcPkgindex(filepath.Join(srcDir, "index.html.gz"), src, manpages); err != nil {
@@ -506,7 +606,7 @@ func writeSourcesWithManpages(gv globalView) error {
 		}
 		sort.Strings(sourcesWithManpages)
 		dest := filepath.Join(*servingDir, suite, "sourcesWithManpages.txt.gz")
-		if err := write.Atomically(dest, true, func(w io.Writer) error {
+		if err := serving.Write(dest, true, func(w io.Writer) error {
 			for _, source := range sourcesWithManpages {
 				if _, err := fmt.Fprintln(w, source); err != nil {
 					return err
@@ -520,7 +620,23 @@ func writeSourcesWithManpages(gv globalView) error {
 	return nil
 }
 
-func renderAll(gv globalView) error {
+// renderWhitelist returns the binary packages specified in
+// -only_render_pkgs, or nil if all packages should be rendered.
+func renderWhitelist() map[string]bool {
+	if *onlyRender == "" {
+		return nil
+	}
+	whitelist := make(map[string]bool)
+	log.Printf("Restricting rendering to the following binary packages:")
+	for _, e := range strings.Split(strings.TrimSpace(*onlyRender), ",") {
+		whitelist[e] = true
+		log.Printf("  %q", e)
+	}
+	log.Printf("(total: %d whitelist entries)", len(whitelist))
+	return whitelist
+}
+
+func renderAll(ctx context.Context, gv globalView) error {
 	log.Printf("Preparing inverted maps")
 	sourceByBinary := make(map[string]string, len(gv.pkgs))
 	newestForSource := make(map[string]time.Time)
@@ -530,7 +646,14 @@ func renderAll(gv globalView) error {
 	}
 	log.Printf("%d sourceByBinary entries, %d newestForSource entries", len(sourceByBinary), len(newestForSource))
 
-	eg, ctx := errgroup.WithContext(context.Background())
+	fragmentCache, err := openFragmentCache(gv.store)
+	if err != nil {
+		log.Printf("WARNING: not using the fragment cache: %v", err)
+	}
+	gv.fragmentCache = fragmentCache
+
+	parent := ctx
+	eg, ctx := errgroup.WithContext(ctx)
 	renderChan := make(chan renderJob)
 	for i := 0; i < *renderConcurrency; i++ {
 		eg.Go(func() error {
@@ -539,6 +662,19 @@ func renderAll(gv globalView) error {
 				return err
 			}
 			defer converter.Kill()
+			textConverter, err := convert.NewFormatProcess(convert.FormatText)
+			if err != nil {
+				return err
+			}
+			defer textConverter.Kill()
+			var markdownConverter *convert.Process
+			if *renderMarkdown {
+				markdownConverter, err = convert.NewFormatProcess(convert.FormatMarkdown)
+				if err != nil {
+					return err
+				}
+				defer markdownConverter.Kill()
+			}
 
 			// NOTE(stapelberg): gzip’s decompression phase takes the same
 			// time, regardless of compression level. Hence, we invest the
@@ -549,39 +685,103 @@ func renderAll(gv globalView) error {
 			}
 
 			for r := range renderChan {
-				n, err := rendermanpage(gzipw, converter, r)
+				if r.reason == reasonMissingPrint {
+					// The HTML page is up to date, but printable
+					// versions are missing (see -print_suites).
+					if err := renderMissingPrint(gv, gzipw, converter, r); err != nil {
+						return err
+					}
+					liveStatus.manpageDone()
+					continue
+				}
+				if r.reason == reasonMissingText {
+					// The HTML page is up to date, only the text is
+					// missing.
+					if err := renderMissingText(gv, gzipw, textConverter, r); err != nil {
+						return err
+					}
+					liveStatus.manpageDone()
+					continue
+				}
+				if r.reason == reasonMissingMarkdown {
+					// The HTML page is up to date, only the Markdown
+					// rendering is missing.
+					if err := renderMissingMarkdown(gv, gzipw, markdownConverter, r); err != nil {
+						return err
+					}
+					liveStatus.manpageDone()
+					continue
+				}
+				printed, err := renderprint(r)
+				var n, tn uint64
+				if err == nil {
+					// The text is rendered before the HTML page,
+					// whose modification time marks the manpage as
+					// up to date (see walkManContents).
+					tn, err = rendertext(gzipw, textConverter, r)
+				}
+				if err == nil {
+					r.printed = printed
+					n, err = rendermanpage(gzipw, converter, r)
+				}
+				if err == nil && *renderMarkdown {
+					err = rendermarkdown(gzipw, markdownConverter, r)
+				}
 				if err != nil {
 					// rendermanpage writes an error page if rendering
 					// failed, any returned error is severe (e.g. file
-					// system full) and should lead to termination.
-					return err
+					// system full) and leads to termination once the
+					// failure budget is exhausted.
+					gv.report.renderFailure(r.meta, err)
+					pkg := r.meta.Package
+					if err := spendFailure(gv, stageRender, pkg.Suite+"/"+pkg.Binarypkg, pkg.Version.String(), err); err != nil {
+						return err
+					}
+					log.Printf("WARNING: rendering %s: %v (package quarantined)", r.dest, err)
+					liveStatus.manpageDone()
+					continue
+				}
+
+				if gv.store != nil {
+					// HTML pages and Markdown documents link to the
+					// other suites and differ between suites. Their
+					// fragments are stored in the fragment cache.
+					storeFile(gv.store, r.meta.Package.Suite, textPath(r.dest))
+					for _, p := range r.printed {
+						storeFile(gv.store, r.meta.Package.Suite, printPath(r.dest, p.Format))
+					}
 				}
 
 				atomic.AddUint64(&gv.stats.HtmlBytes, n)
+				atomic.AddUint64(&gv.stats.TextBytes, tn)
 				atomic.AddUint64(&gv.stats.ManpagesRendered, 1)
+				runMetrics.add("manpages_rendered_total", metricLabels("suite", r.meta.Package.Suite), 1)
+				liveStatus.manpageDone()
 			}
 			return nil
 		})
 	}
 
-	var whitelist map[string]bool
-	if *onlyRender != "" {
-		whitelist = make(map[string]bool)
-		log.Printf("Restricting rendering to the following binary packages:")
-		for _, e := range strings.Split(strings.TrimSpace(*onlyRender), ",") {
-			whitelist[e] = true
-			log.Printf("  %q", e)
-		}
-		log.Printf("(total: %d whitelist entries)", len(whitelist))
+	liveStatus.setWalking(true)
+	werr := walkContents(ctx, renderChan, renderWhitelist(), gv)
+	liveStatus.setWalking(false)
+	close(renderChan)
+	if err := eg.Wait(); err != nil {
+		return err
 	}
-
-	if err := walkContents(ctx, renderChan, whitelist, gv); err != nil {
+	if err := parent.Err(); err != nil {
 		return err
 	}
+	if werr != nil {
+		return werr
+	}
 
-	close(renderChan)
-	if err := eg.Wait(); err != nil {
-		return err
+	if gv.fragmentCache != nil {
+		removed, err := gv.fragmentCache.prune()
+		if err != nil {
+			return fmt.Errorf("pruning the fragment cache: %v", err)
+		}
+		log.Printf("Removed %d unused entries from the fragment cache", removed)
 	}
 
 	if err := writeSourceIndex(gv, newestForSource); err != nil {
@@ -592,7 +792,7 @@ func renderAll(gv globalView) error {
 		return fmt.Errorf("writing sourcesWithManpages: %v", err)
 	}
 
-	suitedirs, err := ioutil.ReadDir(*servingDir)
+	suitedirs, err := serving.ReadDir(*servingDir)
 	if err != nil {
 		return err
 	}
@@ -603,13 +803,7 @@ func renderAll(gv globalView) error {
 		if !gv.suites[sfi.Name()] {
 			continue
 		}
-		bins, err := os.Open(filepath.Join(*servingDir, sfi.Name()))
-		if err != nil {
-			return err
-		}
-		defer bins.Close()
-
-		names, err := bins.Readdirnames(-1)
+		names, err := serving.ReadDirNames(filepath.Join(*servingDir, sfi.Name()))
 		if err != nil {
 			return err
 		}
@@ -617,8 +811,17 @@ func renderAll(gv globalView) error {
 		if err := renderContents(filepath.Join(*servingDir, fmt.Sprintf("contents-%s.html.gz", sfi.Name())), sfi.Name(), names); err != nil {
 			return err
 		}
+	}
 
-		bins.Close()
+	// With -only_render_pkgs, the scheduled packages were not all
+	// re-rendered.
+	if *onlyRender == "" {
+		if err := gv.assets.advance(); err != nil {
+			return fmt.Errorf("writing asset state: %v", err)
+		}
+		if err := gv.outputs.advance(); err != nil {
+			return fmt.Errorf("writing output state: %v", err)
+		}
 	}
 
 	return nil
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"html/template"
 	"io"
 	"path/filepath"
@@ -9,8 +8,8 @@ import (
 	"strings"
 
 	"github.com/stapelberg/debiman/internal/bundled"
+	"github.com/stapelberg/debiman/internal/distro"
 	"github.com/stapelberg/debiman/internal/manpage"
-	"github.com/stapelberg/debiman/internal/write"
 )
 
 var indexTmpl = mustParseIndexTmpl()
@@ -36,12 +35,7 @@ type bySuiteStr []string
 func (p bySuiteStr) Len() int      { return len(p) }
 func (p bySuiteStr) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 func (p bySuiteStr) Less(i, j int) bool {
-	orderi, oki := sortOrder[p[i]]
-	orderj, okj := sortOrder[p[j]]
-	if !oki || !okj {
-		panic(fmt.Sprintf("either %q or %q is an unknown suite. known: %+v", p[i], p[j], sortOrder))
-	}
-	return orderi < orderj
+	return distro.Current().SuiteLess(p[i], p[j])
 }
 
 func renderAux(destDir string, gv globalView) error {
@@ -51,7 +45,7 @@ func renderAux(destDir string, gv globalView) error {
 	}
 	sort.Stable(bySuiteStr(suites))
 
-	if err := write.Atomically(filepath.Join(destDir, "index.html.gz"), true, func(w io.Writer) error {
+	if err := serving.Write(filepath.Join(destDir, "index.html.gz"), true, func(w io.Writer) error {
 		return indexTmpl.Execute(w, struct {
 			Title          string
 			DebimanVersion string
@@ -69,7 +63,7 @@ func renderAux(destDir string, gv globalView) error {
 		return err
 	}
 
-	if err := write.Atomically(filepath.Join(destDir, "faq.html.gz"), true, func(w io.Writer) error {
+	if err := serving.Write(filepath.Join(destDir, "faq.html.gz"), true, func(w io.Writer) error {
 		return faqTmpl.Execute(w, struct {
 			Title          string
 			DebimanVersion string
@@ -85,7 +79,7 @@ func renderAux(destDir string, gv globalView) error {
 		return err
 	}
 
-	if err := write.Atomically(filepath.Join(destDir, "about.html.gz"), true, func(w io.Writer) error {
+	if err := serving.Write(filepath.Join(destDir, "about.html.gz"), true, func(w io.Writer) error {
 		return aboutTmpl.Execute(w, struct {
 			Title          string
 			DebimanVersion string
@@ -104,14 +98,14 @@ func renderAux(destDir string, gv globalView) error {
 	for name, content := range bundled.AssetsFiltered(func(fn string) bool {
 		return !strings.HasSuffix(fn, ".tmpl") && !strings.HasSuffix(fn, "style.css")
 	}) {
-		if err := write.Atomically(filepath.Join(destDir, filepath.Base(name)+".gz"), true, func(w io.Writer) error {
+		if err := serving.Write(filepath.Join(destDir, filepath.Base(name)+".gz"), true, func(w io.Writer) error {
 			_, err := io.WriteString(w, content)
 			return err
 		}); err != nil {
 			return err
 		}
 
-		if err := write.Atomically(filepath.Join(destDir, filepath.Base(name)), false, func(w io.Writer) error {
+		if err := serving.Write(filepath.Join(destDir, filepath.Base(name)), false, func(w io.Writer) error {
 			_, err := io.WriteString(w, content)
 			return err
 		}); err != nil {
@@ -10,7 +10,6 @@ import (
 
 	"github.com/stapelberg/debiman/internal/bundled"
 	"github.com/stapelberg/debiman/internal/manpage"
-	"github.com/stapelberg/debiman/internal/write"
 )
 
 var contentsTmpl = mustParseContentsTmpl()
@@ -22,7 +21,7 @@ func mustParseContentsTmpl() *template.Template {
 func renderContents(dest, suite string, bins []string) error {
 	sort.Strings(bins)
 
-	if err := write.Atomically(dest, true, func(w io.Writer) error {
+	if err := serving.Write(dest, true, func(w io.Writer) error {
 		return contentsTmpl.Execute(w, struct {
 			Title          string
 			DebimanVersion string
@@ -48,7 +47,7 @@ func renderContents(dest, suite string, bins []string) error {
 
 	destPath := filepath.Join(*servingDir, suite, "index.html.gz")
 	link := fmt.Sprintf("../contents-%s.html.gz", suite)
-	if err := os.Symlink(link, destPath); err != nil && !os.IsExist(err) {
+	if err := serving.Symlink(link, destPath); err != nil && !os.IsExist(err) {
 		return err
 	}
 	return nil
@@ -18,48 +18,13 @@ import (
 	"github.com/stapelberg/debiman/internal/bundled"
 	"github.com/stapelberg/debiman/internal/commontmpl"
 	"github.com/stapelberg/debiman/internal/convert"
+	"github.com/stapelberg/debiman/internal/distro"
 	"github.com/stapelberg/debiman/internal/manpage"
-	"github.com/stapelberg/debiman/internal/write"
 	"golang.org/x/text/language"
 )
 
 const iso8601Format = "2006-01-02T15:04:05Z"
 
-// TODO(later): move this list to a package within pault.ag/debian/?
-var releaseList = []string{
-	"buzz",
-	"rex",
-	"bo",
-	"hamm",
-	"slink",
-	"potato",
-	"woody",
-	"sarge",
-	"etch",
-	"lenny",
-	"squeeze",
-	"wheezy",
-	"wheezy-backports",
-	"jessie",
-	"jessie-backports",
-	"stretch",
-	"stretch-backports",
-	"buster",
-	"buster-backports",
-	"bullseye",
-	"bullseye-backports",
-}
-var sortOrder = make(map[string]int)
-
-func init() {
-	for idx, r := range releaseList {
-		sortOrder[r] = idx
-	}
-	sortOrder["testing"] = sortOrder["stretch"]
-	sortOrder["unstable"] = len(releaseList)
-	sortOrder["experimental"] = sortOrder["unstable"] + 1
-}
-
 // stapelberg came up with the following abbreviations:
 var shortSections = map[string]string{
 	"1": "progs",
@@ -137,21 +102,15 @@ func mustParseManpagefooterextraTmpl() *template.Template {
 }
 
 func convertFile(converter *convert.Process, src string, resolve func(ref string) string) (doc string, toc []string, err error) {
-	f, err := os.Open(src)
+	in, err := readManpage(src)
 	if err != nil {
-		return "", nil, err
+		return "", nil, fmt.Errorf("convert(%q): %v", src, err)
 	}
-	defer f.Close()
-	r, err := gzip.NewReader(f)
-	if err != nil {
-		if err == io.EOF {
-			// TODO: better representation of an empty manpage
-			return "This space intentionally left blank.", nil, nil
-		}
-		return "", nil, err
+	if in.Len() == 0 {
+		// TODO: better representation of an empty manpage
+		return "This space intentionally left blank.", nil, nil
 	}
-	defer r.Close()
-	out, toc, err := converter.ToHTML(r, resolve)
+	out, toc, err := converter.ToHTML(in, resolve)
 	if err != nil {
 		return "", nil, fmt.Errorf("convert(%q): %v", src, err)
 	}
@@ -208,6 +167,38 @@ func bestLanguageMatch(current *manpage.Meta, options []*manpage.Meta) *manpage.
 	return options[idx]
 }
 
+// xrefResolver returns a function which resolves cross references
+// (e.g. “i3(1)”) found in meta to the URL path of the referenced
+// manpage, or the empty string if the manpage is not known.
+func xrefResolver(meta *manpage.Meta, xref map[string][]*manpage.Meta) func(ref string) string {
+	return func(ref string) string {
+		idx := strings.LastIndex(ref, "(")
+		if idx == -1 {
+			return ""
+		}
+		section := ref[idx+1 : len(ref)-1]
+		name := ref[:idx]
+		related, ok := xref[name]
+		if !ok {
+			return ""
+		}
+		filtered := make([]*manpage.Meta, 0, len(related))
+		for _, r := range related {
+			if r.MainSection() != section {
+				continue
+			}
+			if r.Package.Suite != meta.Package.Suite {
+				continue
+			}
+			filtered = append(filtered, r)
+		}
+		if len(filtered) == 0 {
+			return ""
+		}
+		return commontmpl.BaseURLPath() + "/" + bestLanguageMatch(meta, filtered).ServingPath() + ".html"
+	}
+}
+
 type byLanguage []*manpage.Meta
 
 func (p byLanguage) Len() int           { return len(p) }
@@ -222,8 +213,30 @@ type renderJob struct {
 	xref     map[string][]*manpage.Meta
 	modTime  time.Time
 	reuse    string
+	// report, if non-nil, receives manpages which failed to render.
+	report *runReport
+	// reason explains why the manpage needs to be rendered, see the
+	// reason* constants.
+	reason string
+	// cache, if non-nil, stores the converted fragments across runs
+	// and suites.
+	cache *fragmentCache
+	// printed lists the printable versions of the manpage, which are
+	// rendered before the HTML page linking to them.
+	printed []printable
 }
 
+const (
+	reasonMissing         = "missing html"
+	reasonMissingText     = "missing text"
+	reasonMissingPrint    = "missing printable"
+	reasonMissingMarkdown = "missing markdown"
+	reasonOutdated        = "older mtime"
+	reasonInvalidated     = "invalidated variant"
+	reasonForced          = "forced"
+	reasonAssets          = "assets changed"
+)
+
 var notYetRenderedSentinel = errors.New("Not yet rendered")
 
 type manpagePrepData struct {
@@ -242,6 +255,7 @@ type manpagePrepData struct {
 	Ambiguous      map[*manpage.Meta]bool
 	Content        template.HTML
 	Error          error
+	Printable      []printable
 }
 
 type bySuite []*manpage.Meta
@@ -249,19 +263,19 @@ type bySuite []*manpage.Meta
 func (p bySuite) Len() int      { return len(p) }
 func (p bySuite) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 func (p bySuite) Less(i, j int) bool {
-	orderi, oki := sortOrder[p[i].Package.Suite]
-	orderj, okj := sortOrder[p[j].Package.Suite]
-	if !oki || !okj {
-		panic(fmt.Sprintf("either %q or %q is an unknown suite. known: %+v", p[i].Package.Suite, p[j].Package.Suite, sortOrder))
-	}
-	return orderi < orderj
+	return distro.Current().SuiteLess(p[i].Package.Suite, p[j].Package.Suite)
 }
 
 type byMainSection []*manpage.Meta
 
-func (p byMainSection) Len() int           { return len(p) }
-func (p byMainSection) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
-func (p byMainSection) Less(i, j int) bool { return p[i].MainSection() < p[j].MainSection() }
+func (p byMainSection) Len() int      { return len(p) }
+func (p byMainSection) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byMainSection) Less(i, j int) bool {
+	if p[i].MainSection() != p[j].MainSection() {
+		return p[i].MainSection() < p[j].MainSection()
+	}
+	return p[i].Section < p[j].Section
+}
 
 type byBinarypkg []*manpage.Meta
 
@@ -273,46 +287,59 @@ func rendermanpageprep(converter *convert.Process, job renderJob) (*template.Tem
 	meta := job.meta // for convenience
 	// TODO(issue): document fundamental limitation: “other languages” is imprecise: e.g. crontab(1) — are the languages for package:systemd-cron or for package:cron?
 	// TODO(later): to boost confidence in detecting cross-references, can we add to testdata the entire list of man page names from debian to have a good test?
-	// TODO(later): add plain-text version
 
 	var (
 		content   string
 		toc       []string
 		renderErr = notYetRenderedSentinel
 	)
-	if job.reuse != "" {
+	suiteLabel := metricLabels("suite", meta.Package.Suite)
+	resolve := xrefResolver(meta, job.xref)
+	var key string
+	if job.cache != nil {
+		var err error
+		if key, err = fragmentKey(job.src); err != nil {
+			log.Printf("WARNING: not using the fragment cache for %q: %v", job.src, err)
+		} else if content, toc, err = job.cache.get(key, resolve); err == nil {
+			renderErr = nil
+			job.cache.use(job.dest, key)
+			runMetrics.add("renders_reused_total", suiteLabel, 1)
+		} else if !os.IsNotExist(err) {
+			log.Printf("not using the cached fragment of %q: %v", job.src, err)
+		}
+	}
+	if renderErr != nil && job.reuse != "" {
 		content, toc, renderErr = reuse(job.reuse)
 		if renderErr != nil {
 			log.Printf("WARNING: re-using %q failed: %v", job.reuse, renderErr)
+		} else {
+			runMetrics.add("renders_reused_total", suiteLabel, 1)
 		}
 	}
+	var refs map[string]string
 	if renderErr != nil {
-		content, toc, renderErr = convertFile(converter, job.src, func(ref string) string {
-			idx := strings.LastIndex(ref, "(")
-			if idx == -1 {
-				return ""
+		if key != "" {
+			refs = make(map[string]string)
+			unrecorded := resolve
+			resolve = func(ref string) string {
+				url := unrecorded(ref)
+				refs[ref] = url
+				return url
 			}
-			section := ref[idx+1 : len(ref)-1]
-			name := ref[:idx]
-			related, ok := job.xref[name]
-			if !ok {
-				return ""
-			}
-			filtered := make([]*manpage.Meta, 0, len(related))
-			for _, r := range related {
-				if r.MainSection() != section {
-					continue
-				}
-				if r.Package.Suite != meta.Package.Suite {
-					continue
+		}
+		convertStart := time.Now()
+		content, toc, renderErr = convertFile(converter, job.src, resolve)
+		runMetrics.observe("mandoc_render_duration_seconds", suiteLabel, time.Since(convertStart).Seconds())
+		if renderErr == nil && key != "" {
+			if err := job.cache.put(key, cachedFragment{Content: content, TOC: toc, Refs: refs}); err != nil {
+				log.Printf("WARNING: caching the fragment of %q: %v", job.src, err)
+			} else {
+				job.cache.use(job.dest, key)
+				if job.cache.store != nil {
+					storeFile(job.cache.store, meta.Package.Suite, job.cache.path(key))
 				}
-				filtered = append(filtered, r)
-			}
-			if len(filtered) == 0 {
-				return ""
 			}
-			return commontmpl.BaseURLPath() + "/" + bestLanguageMatch(meta, filtered).ServingPath() + ".html"
-		})
+		}
 	}
 
 	log.Printf("rendering %q", job.dest)
@@ -408,11 +435,11 @@ func rendermanpageprep(converter *convert.Process, job renderJob) (*template.Tem
 	}
 
 	// Sort alphabetically by the locale names (e.g. zh_TW).
-	sort.Sort(byLanguage(langs))
-	sort.Sort(byLanguage(hrefLangs))
+	sort.Stable(byLanguage(langs))
+	sort.Stable(byLanguage(hrefLangs))
 
 	t := manpageTmpl
-	title := fmt.Sprintf("%s(%s) — %s — Debian %s", meta.Name, meta.Section, meta.Package.Binarypkg, meta.Package.Suite)
+	title := fmt.Sprintf("%s(%s) — %s — %s %s", meta.Name, meta.Section, meta.Package.Binarypkg, distro.Current().Name, meta.Package.Suite)
 	shorttitle := fmt.Sprintf("%s(%s)", meta.Name, meta.Section)
 	if renderErr != nil {
 		t = manpageerrorTmpl
@@ -428,7 +455,7 @@ func rendermanpageprep(converter *convert.Process, job renderJob) (*template.Tem
 	}{
 		SourceFile:  filepath.Base(job.src),
 		LastUpdated: job.modTime,
-		Converted:   time.Now(),
+		Converted:   convertedTime(job.modTime),
 		Meta:        meta,
 	}); err != nil {
 		return nil, manpagePrepData{}, err
@@ -454,6 +481,7 @@ func rendermanpageprep(converter *convert.Process, job renderJob) (*template.Tem
 		Ambiguous:   ambiguous,
 		Content:     template.HTML(content),
 		Error:       renderErr,
+		Printable:   job.printed,
 	}, nil
 }
 
@@ -469,13 +497,18 @@ func rendermanpage(gzipw *gzip.Writer, converter *convert.Process, job renderJob
 	if err != nil {
 		return 0, err
 	}
+	if data.Error != nil {
+		runMetrics.add("render_failures_total", metricLabels("suite", job.meta.Package.Suite), 1)
+		if job.report != nil {
+			job.report.renderFailure(job.meta, data.Error)
+		}
+	}
 
 	var written countingWriter
-	if err := write.AtomicallyWithGz(job.dest, gzipw, func(w io.Writer) error {
+	if err := serving.WriteWithGz(job.dest, gzipw, func(w io.Writer) error {
 		return t.Execute(io.MultiWriter(w, &written), data)
 	}); err != nil {
 		return 0, err
 	}
-
 	return uint64(written), nil
 }
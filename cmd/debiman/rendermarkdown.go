@@ -0,0 +1,93 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/commontmpl"
+	"github.com/stapelberg/debiman/internal/convert"
+	"github.com/stapelberg/debiman/internal/manpage"
+)
+
+var renderMarkdown = flag.Bool("markdown",
+	false,
+	"Render each manpage to Markdown in addition to HTML, stored next to the HTML as <name>.<section>.<lang>.md.gz. Cross references link to -base_url. The Markdown renderings of manpages rendered before are added over the following runs, see -asset_rerender_limit.")
+
+// markdownPath returns the path of the Markdown rendering which belongs
+// to the HTML rendering htmlPath.
+func markdownPath(htmlPath string) string {
+	return strings.TrimSuffix(htmlPath, ".html.gz") + ".md.gz"
+}
+
+// outdatedMarkdown returns whether the Markdown rendering which belongs
+// to the HTML rendering htmlPath is missing or older than modTime.
+func outdatedMarkdown(stat statFunc, htmlPath string, modTime time.Time) bool {
+	st, err := stat(markdownPath(htmlPath))
+	return err != nil || st.ModTime().Before(modTime)
+}
+
+// absoluteResolver returns a function which resolves cross references
+// found in meta to absolute URLs within -base_url, so that they work
+// when the Markdown is embedded elsewhere.
+func absoluteResolver(meta *manpage.Meta, xref map[string][]*manpage.Meta) func(ref string) string {
+	resolve := xrefResolver(meta, xref)
+	origin := strings.TrimSuffix(*baseURL, commontmpl.BaseURLPath())
+	return func(ref string) string {
+		path := resolve(ref)
+		if path == "" {
+			return ""
+		}
+		return origin + path
+	}
+}
+
+// toMarkdown converts the manpage src (described by meta) to Markdown.
+// converter must have been started with convert.FormatMarkdown.
+func toMarkdown(converter *convert.Process, src string, meta *manpage.Meta, xref map[string][]*manpage.Meta) (string, error) {
+	in, err := readManpage(src)
+	if err != nil {
+		return "", err
+	}
+	if in.Len() == 0 {
+		return "This space intentionally left blank.\n", nil
+	}
+	return converter.ToMarkdown(in, absoluteResolver(meta, xref))
+}
+
+// rendermarkdown writes the Markdown rendering of job.src next to
+// job.dest. Like rendertext, manpages which fail to render are replaced
+// with the error message.
+func rendermarkdown(gzipw *gzip.Writer, converter *convert.Process, job renderJob) error {
+	md, err := toMarkdown(converter, job.src, job.meta, job.xref)
+	if err != nil {
+		log.Printf("WARNING: rendering %q as Markdown: %v", job.src, err)
+		md = fmt.Sprintf("Error: %s(%s) could not be rendered: %v\n", job.meta.Name, job.meta.Section, err)
+	}
+	return serving.WriteWithGz(markdownPath(job.dest), gzipw, func(w io.Writer) error {
+		_, err := io.WriteString(w, md)
+		return err
+	})
+}
+
+// renderMissingMarkdown writes the missing Markdown rendering of job,
+// whose HTML page is up to date (see -markdown).
+func renderMissingMarkdown(gv globalView, gzipw *gzip.Writer, converter *convert.Process, job renderJob) error {
+	if err := rendermarkdown(gzipw, converter, job); err != nil {
+		gv.report.renderFailure(job.meta, err)
+		pkg := job.meta.Package
+		if err := spendFailure(gv, stageRender, pkg.Suite+"/"+pkg.Binarypkg, pkg.Version.String(), err); err != nil {
+			return err
+		}
+		log.Printf("WARNING: rendering %s as Markdown: %v (package quarantined)", job.dest, err)
+		return nil
+	}
+	atomic.AddUint64(&gv.stats.ManpagesRendered, 1)
+	runMetrics.add("manpages_rendered_total", metricLabels("suite", job.meta.Package.Suite), 1)
+	return nil
+}
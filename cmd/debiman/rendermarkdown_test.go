@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stapelberg/debiman/internal/manpage"
+)
+
+func TestAbsoluteResolver(t *testing.T) {
+	i3, err := manpage.FromServingPath("/srv/man", "/srv/man/testing/i3-wm/i3.1.en.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve := absoluteResolver(i3, map[string][]*manpage.Meta{"i3": {i3}})
+	for ref, want := range map[string]string{
+		"i3(1)":      "https://manpages.debian.org/testing/i3-wm/i3.1.en.html",
+		"i3(5)":      "",
+		"i3-msg(1)":  "",
+		"no-section": "",
+	} {
+		if got := resolve(ref); got != want {
+			t.Errorf("resolve(%q) = %q, want %q", ref, got, want)
+		}
+	}
+}
@@ -8,7 +8,6 @@ import (
 
 	"github.com/stapelberg/debiman/internal/bundled"
 	"github.com/stapelberg/debiman/internal/manpage"
-	"github.com/stapelberg/debiman/internal/write"
 )
 
 var pkgindexTmpl = mustParsePkgindexTmpl()
@@ -23,19 +22,14 @@ func mustParseSrcPkgindexTmpl() *template.Template {
 }
 
 func renderPkgindex(dest string, manpageByName map[string]*manpage.Meta) error {
-	var first *manpage.Meta
-	for _, m := range manpageByName {
-		first = m
-		break
-	}
-
 	mans := make([]string, 0, len(manpageByName))
 	for n := range manpageByName {
 		mans = append(mans, n)
 	}
 	sort.Strings(mans)
+	first := manpageByName[mans[0]]
 
-	return write.Atomically(dest, true, func(w io.Writer) error {
+	return serving.Write(dest, true, func(w io.Writer) error {
 		return pkgindexTmpl.Execute(w, struct {
 			Title          string
 			DebimanVersion string
@@ -63,19 +57,14 @@ func renderPkgindex(dest string, manpageByName map[string]*manpage.Meta) error {
 }
 
 func renderSrcPkgindex(dest string, src string, manpageByName map[string]*manpage.Meta) error {
-	var first *manpage.Meta
-	for _, m := range manpageByName {
-		first = m
-		break
-	}
-
 	mans := make([]string, 0, len(manpageByName))
 	for n := range manpageByName {
 		mans = append(mans, n)
 	}
 	sort.Strings(mans)
+	first := manpageByName[mans[0]]
 
-	return write.Atomically(dest, true, func(w io.Writer) error {
+	return serving.Write(dest, true, func(w io.Writer) error {
 		return srcpkgindexTmpl.Execute(w, struct {
 			Title          string
 			DebimanVersion string
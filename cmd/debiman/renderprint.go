@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/stapelberg/debiman/internal/convert"
+	"github.com/stapelberg/debiman/internal/manpage"
+)
+
+var (
+	printFormatsList = flag.String("print_formats",
+		"",
+		"Comma-separated list of formats (pdf, ps) to render each manpage to for printing, in addition to HTML. The manpage page links to the printable versions it was rendered with. If empty, no printable versions are rendered.")
+
+	printSuitesList = flag.String("print_suites",
+		"",
+		"Comma-separated list of suites in which the missing printable versions (see -print_formats) of all manpages are rendered in the current run, along with the HTML pages linking to them. The redirector only redirects requests for printable versions to these suites. In all other suites, printable versions are rendered lazily: the next time a manpage is rendered, e.g. because its source changed.")
+)
+
+// printFormats and printSuites are parsed from -print_formats and
+// -print_suites by setupPrinting.
+var (
+	printFormats []string
+	printSuites  map[string]bool
+)
+
+// printable describes a printable version of a manpage, as linked from
+// the manpage page.
+type printable struct {
+	Format string // e.g. “pdf”
+	Name   string // e.g. “PDF”
+}
+
+var printNames = map[string]string{
+	"pdf": "PDF",
+	"ps":  "PostScript",
+}
+
+// printSuffixes maps print formats to the suffix of the files they are
+// stored in. PostScript compresses well, PDF is already compressed.
+var printSuffixes = map[string]string{
+	"pdf": ".pdf",
+	"ps":  ".ps.gz",
+}
+
+func setupPrinting() error {
+	printFormats = nil
+	for _, format := range strings.Split(*printFormatsList, ",") {
+		format = strings.TrimSpace(format)
+		if format == "" {
+			continue
+		}
+		if !convert.PrintFormats[format] {
+			return fmt.Errorf("-print_formats: unsupported format %q", format)
+		}
+		printFormats = append(printFormats, format)
+	}
+	printSuites = make(map[string]bool)
+	for _, suite := range strings.Split(*printSuitesList, ",") {
+		if suite = strings.TrimSpace(suite); suite != "" {
+			printSuites[suite] = true
+		}
+	}
+	return nil
+}
+
+// printPath returns the path of the printable version in format which
+// belongs to the HTML rendering htmlPath.
+func printPath(htmlPath, format string) string {
+	return strings.TrimSuffix(htmlPath, ".html.gz") + printSuffixes[format]
+}
+
+// missingPrintable returns whether a printable version of the HTML
+// rendering htmlPath in suite is missing and should be rendered in the
+// current run (see -print_suites).
+func missingPrintable(stat statFunc, suite, htmlPath string) bool {
+	if !printSuites[suite] {
+		return false
+	}
+	for _, format := range printFormats {
+		if _, err := stat(printPath(htmlPath, format)); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// printError returns a manpage stating that m could not be rendered for
+// printing because of err.
+func printError(m *manpage.Meta, err error) string {
+	msg := strings.Replace(err.Error(), "\\", "\\e", -1)
+	msg = strings.Replace(msg, "\n", " ", -1)
+	return fmt.Sprintf(".TH \"%s\" \"%s\"\n.SH ERROR\n\\&%s(%s) could not be rendered: %s\n",
+		strings.ToUpper(m.Name), m.Section, m.Name, m.Section, msg)
+}
+
+// renderprint writes the printable versions of job.src next to
+// job.dest and returns the versions which were written. Manpages
+// which fail to render are replaced with a version stating the error,
+// which is not linked, so that they are not retried until their source
+// changes.
+func renderprint(job renderJob) ([]printable, error) {
+	if len(printFormats) == 0 {
+		return nil, nil
+	}
+	in, readErr := readManpage(job.src)
+	var printed []printable
+	for _, format := range printFormats {
+		path := printPath(job.dest, format)
+		err := readErr
+		var out []byte
+		if err == nil {
+			out, err = convert.ToPrintable(bytes.NewReader(in.Bytes()), format)
+		}
+		failed := err != nil
+		if failed {
+			log.Printf("WARNING: rendering %q as %s: %v", job.src, format, err)
+			out, err = convert.ToPrintable(strings.NewReader(printError(job.meta, err)), format)
+			if err != nil {
+				log.Printf("WARNING: rendering the error message of %q as %s: %v", job.src, format, err)
+				continue
+			}
+		}
+		if err := serving.Write(path, strings.HasSuffix(path, ".gz"), func(w io.Writer) error {
+			_, err := w.Write(out)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if !failed {
+			printed = append(printed, printable{Format: format, Name: printNames[format]})
+		}
+	}
+	return printed, nil
+}
+
+// renderMissingPrint writes the printable versions of job, whose HTML
+// page is up to date (see -print_suites), and re-renders the HTML page
+// to link to them. All printable versions are rendered, as the HTML
+// page only links to the ones which rendered successfully.
+func renderMissingPrint(gv globalView, gzipw *gzip.Writer, converter *convert.Process, job renderJob) error {
+	printed, err := renderprint(job)
+	var n uint64
+	if err == nil {
+		job.printed = printed
+		n, err = rendermanpage(gzipw, converter, job)
+	}
+	if err != nil {
+		gv.report.renderFailure(job.meta, err)
+		pkg := job.meta.Package
+		if err := spendFailure(gv, stageRender, pkg.Suite+"/"+pkg.Binarypkg, pkg.Version.String(), err); err != nil {
+			return err
+		}
+		log.Printf("WARNING: rendering %s for printing: %v (package quarantined)", job.dest, err)
+		return nil
+	}
+	if gv.store != nil {
+		for _, p := range printed {
+			storeFile(gv.store, job.meta.Package.Suite, printPath(job.dest, p.Format))
+		}
+	}
+	atomic.AddUint64(&gv.stats.HtmlBytes, n)
+	atomic.AddUint64(&gv.stats.ManpagesRendered, 1)
+	runMetrics.add("manpages_rendered_total", metricLabels("suite", job.meta.Package.Suite), 1)
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stapelberg/debiman/internal/manpage"
+	"github.com/stapelberg/debiman/internal/redirect"
+)
+
+func TestSetupPrinting(t *testing.T) {
+	defer func() {
+		flag.Set("print_formats", "")
+		flag.Set("print_suites", "")
+		setupPrinting()
+	}()
+
+	flag.Set("print_formats", "pdf, ps")
+	flag.Set("print_suites", "testing,")
+	if err := setupPrinting(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := printFormats, []string{"pdf", "ps"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("printFormats = %v, want %v", got, want)
+	}
+	if got, want := printSuites, map[string]bool{"testing": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("printSuites = %v, want %v", got, want)
+	}
+	for format, want := range map[string]string{
+		"pdf": "testing/i3-wm/i3.1.en.pdf",
+		"ps":  "testing/i3-wm/i3.1.en.ps.gz",
+	} {
+		if got := printPath("testing/i3-wm/i3.1.en.html.gz", format); got != want {
+			t.Errorf("printPath(%q) = %q, want %q", format, got, want)
+		}
+	}
+
+	// The redirector only redirects to printable versions in
+	// -print_suites.
+	dir, err := ioutil.TempDir("", "debiman-print")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "auxserver.idx")
+	if err := writeIndex(path, globalView{stats: &stats{}}); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := redirect.IndexFromProto(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"testing": true}; !reflect.DeepEqual(idx.PrintSuites, want) {
+		t.Errorf("index PrintSuites = %v, want %v", idx.PrintSuites, want)
+	}
+	if want := map[string]bool{"pdf": true, "ps": true}; !reflect.DeepEqual(idx.PrintFormats, want) {
+		t.Errorf("index PrintFormats = %v, want %v", idx.PrintFormats, want)
+	}
+
+	flag.Set("print_formats", "pdf,dvi")
+	if err := setupPrinting(); err == nil {
+		t.Errorf("setupPrinting() unexpectedly accepted -print_formats=pdf,dvi")
+	}
+}
+
+func TestPrintError(t *testing.T) {
+	m := &manpage.Meta{Name: "i3", Section: "1"}
+	got := printError(m, errors.New("exit status 3, stderr: mandoc: \\fB\n.so: ERROR"))
+	want := ".TH \"I3\" \"1\"\n.SH ERROR\n\\&i3(1) could not be rendered: exit status 3, stderr: mandoc: \\efB .so: ERROR\n"
+	if got != want {
+		t.Errorf("printError() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/stapelberg/debiman/internal/convert"
+)
+
+// renderedSuffixes are the suffixes of the files which manpages are
+// rendered to, next to their source (e.g. i3.1.en.gz).
+var renderedSuffixes = []string{".html.gz", ".txt.gz", ".md.gz", ".pdf", ".ps.gz"}
+
+// renderedSuffix returns the suffix of fn if fn is a rendered manpage,
+// or the empty string if fn is not.
+func renderedSuffix(fn string) string {
+	for _, suffix := range renderedSuffixes {
+		if strings.HasSuffix(fn, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// textPath returns the path of the plain-text rendering which belongs
+// to the HTML rendering htmlPath.
+func textPath(htmlPath string) string {
+	return strings.TrimSuffix(htmlPath, ".html.gz") + ".txt.gz"
+}
+
+// readManpage returns the contents of the manpage src, with .so
+// includes inlined when mandoc cannot read them from -serving_dir.
+func readManpage(src string) (*bytes.Buffer, error) {
+	rc, err := openSource(src)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var buf bytes.Buffer
+	if servingLocally() {
+		_, err = io.Copy(&buf, rc)
+	} else {
+		err = inlineIncludes(&buf, rc, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// rendertext writes the plain-text rendering of job.src next to
+// job.dest. Manpages which fail to render are replaced with the error
+// message, so that they are not retried until their source changes.
+// converter must have been started with convert.FormatText.
+func rendertext(gzipw *gzip.Writer, converter *convert.Process, job renderJob) (uint64, error) {
+	var text string
+	if job.reuse != "" {
+		if rc, err := openSource(textPath(job.reuse)); err == nil {
+			b, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err == nil {
+				text = string(b)
+			}
+		}
+	}
+	if text == "" {
+		r, err := readManpage(job.src)
+		if err == nil {
+			text, err = converter.ToText(r)
+		}
+		if err != nil {
+			log.Printf("WARNING: rendering %q as text: %v", job.src, err)
+			text = fmt.Sprintf("Error: %s(%s) could not be rendered: %v\n", job.meta.Name, job.meta.Section, err)
+		}
+	}
+	if text == "" {
+		text = "This space intentionally left blank.\n"
+	}
+
+	var written countingWriter
+	if err := serving.WriteWithGz(textPath(job.dest), gzipw, func(w io.Writer) error {
+		_, err := io.WriteString(io.MultiWriter(w, &written), text)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	return uint64(written), nil
+}
+
+// renderMissingText writes the missing plain-text rendering of job,
+// whose HTML page is up to date.
+func renderMissingText(gv globalView, gzipw *gzip.Writer, converter *convert.Process, job renderJob) error {
+	n, err := rendertext(gzipw, converter, job)
+	if err != nil {
+		gv.report.renderFailure(job.meta, err)
+		pkg := job.meta.Package
+		if err := spendFailure(gv, stageRender, pkg.Suite+"/"+pkg.Binarypkg, pkg.Version.String(), err); err != nil {
+			return err
+		}
+		log.Printf("WARNING: rendering %s as text: %v (package quarantined)", job.dest, err)
+		return nil
+	}
+	if gv.store != nil {
+		storeFile(gv.store, job.meta.Package.Suite, textPath(job.dest))
+	}
+	atomic.AddUint64(&gv.stats.TextBytes, n)
+	atomic.AddUint64(&gv.stats.ManpagesRendered, 1)
+	runMetrics.add("manpages_rendered_total", metricLabels("suite", job.meta.Package.Suite), 1)
+	return nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/bundled"
+	"github.com/stapelberg/debiman/internal/manpage"
+)
+
+var knownIssuesBugs = flag.String("known_issues_bugs",
+	"",
+	"If non-empty, path to a file which maps binary packages with known issues to bug numbers. Each line contains a binary package (optionally prefixed with <suite>/) followed by one or more bug numbers, e.g. “manpages-ja 123456”. Lines starting with # are ignored.")
+
+type packageFailure struct {
+	Package string `json:"package"`
+	Version string `json:"version"`
+	Error   string `json:"error"`
+}
+
+type unparseablePath struct {
+	Package string `json:"package"`
+	Path    string `json:"path"`
+	Error   string `json:"error"`
+}
+
+type danglingSymlink struct {
+	Package string `json:"package"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+}
+
+type omittedSo struct {
+	Package string `json:"package"`
+	Manpage string `json:"manpage"`
+	Ref     string `json:"ref"`
+}
+
+type renderFailure struct {
+	Manpage string `json:"manpage"`
+	Error   string `json:"error"`
+}
+
+type knownIssue struct {
+	Package string   `json:"package"`
+	Errors  []string `json:"errors"`
+	Bugs    []int    `json:"bugs,omitempty"`
+}
+
+// runReport collects everything noteworthy which happened during a
+// debiman run. It is written to -serving_dir as report.json (for
+// machines) and status.html (for humans).
+type runReport struct {
+	mu sync.Mutex
+
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Error   string    `json:"error,omitempty"`
+	Version string    `json:"debiman_version"`
+	// Stage is the stage which was run last, if the stages were run
+	// individually (see mergeStage).
+	Stage string `json:"stage,omitempty"`
+
+	Packages          int    `json:"packages"`
+	PackagesExtracted uint64 `json:"packages_extracted"`
+	PackagesDeleted   uint64 `json:"packages_deleted"`
+	ManpagesRendered  uint64 `json:"manpages_rendered"`
+	ManpageBytes      uint64 `json:"manpage_bytes"`
+	HtmlBytes         uint64 `json:"html_bytes"`
+	TextBytes         uint64 `json:"text_bytes"`
+	IndexBytes        uint64 `json:"index_bytes"`
+	StoreBytes        uint64 `json:"store_bytes,omitempty"`
+	StoreSavedBytes   uint64 `json:"store_saved_bytes,omitempty"`
+
+	FailedPackages   []packageFailure   `json:"failed_packages"`
+	SkippedPackages  []string           `json:"skipped_packages"`
+	UnparseablePaths []unparseablePath  `json:"unparseable_paths"`
+	DanglingSymlinks []danglingSymlink  `json:"dangling_symlinks"`
+	OmittedSoLines   []omittedSo        `json:"omitted_so_lines"`
+	RenderFailures   []renderFailure    `json:"render_failures"`
+	KnownIssues      []knownIssue       `json:"known_issues"`
+	Quarantined      []*quarantineEntry `json:"quarantined"`
+}
+
+func newRunReport(start time.Time) *runReport {
+	return &runReport{
+		Start:   start,
+		Version: debimanVersion,
+	}
+}
+
+func (r *runReport) failedPackage(p pkgEntry, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.FailedPackages = append(r.FailedPackages, packageFailure{
+		Package: p.suite + "/" + p.binarypkg,
+		Version: p.version.String(),
+		Error:   err.Error(),
+	})
+}
+
+func (r *runReport) skippedPackage(p pkgEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.SkippedPackages = append(r.SkippedPackages, p.suite+"/"+p.binarypkg)
+}
+
+func (r *runReport) unparseablePath(p pkgEntry, path string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.UnparseablePaths = append(r.UnparseablePaths, unparseablePath{
+		Package: p.suite + "/" + p.binarypkg,
+		Path:    path,
+		Error:   err.Error(),
+	})
+}
+
+func (r *runReport) danglingSymlink(p pkgEntry, from, to string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DanglingSymlinks = append(r.DanglingSymlinks, danglingSymlink{
+		Package: p.suite + "/" + p.binarypkg,
+		From:    from,
+		To:      to,
+	})
+}
+
+func (r *runReport) omittedSo(p pkgEntry, src string, refs []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ref := range refs {
+		r.OmittedSoLines = append(r.OmittedSoLines, omittedSo{
+			Package: p.suite + "/" + p.binarypkg,
+			Manpage: src,
+			Ref:     ref,
+		})
+	}
+}
+
+func (r *runReport) renderFailure(m *manpage.Meta, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.RenderFailures = append(r.RenderFailures, renderFailure{
+		Manpage: m.ServingPath(),
+		Error:   err.Error(),
+	})
+}
+
+func (r *runReport) knownIssues(issues map[string][]error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, errs := range issues {
+		issue := knownIssue{Package: key}
+		for _, err := range errs {
+			issue.Errors = append(issue.Errors, err.Error())
+		}
+		r.KnownIssues = append(r.KnownIssues, issue)
+	}
+}
+
+// parseBugs parses a -known_issues_bugs file into a map from binary
+// package (or <suite>/<binarypkg>) to bug numbers.
+func parseBugs(r io.Reader) (map[string][]int, error) {
+	bugs := make(map[string][]int)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed line %q: expected <binarypkg> <bug>…", line)
+		}
+		for _, field := range fields[1:] {
+			bug, err := strconv.Atoi(strings.TrimPrefix(field, "#"))
+			if err != nil {
+				return nil, fmt.Errorf("malformed bug number %q in line %q: %v", field, line, err)
+			}
+			bugs[fields[0]] = append(bugs[fields[0]], bug)
+		}
+	}
+	return bugs, scanner.Err()
+}
+
+// linkBugs associates known issues with the bug numbers from the
+// -known_issues_bugs file.
+func (r *runReport) linkBugs(bugs map[string][]int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for idx, issue := range r.KnownIssues {
+		// Copy the bugs, so that appending does not modify the slices
+		// shared with other issues.
+		linked := append([]int(nil), bugs[issue.Package]...)
+		if binarypkg := issue.Package[strings.Index(issue.Package, "/")+1:]; binarypkg != issue.Package {
+			linked = append(linked, bugs[binarypkg]...)
+		}
+		r.KnownIssues[idx].Bugs = linked
+	}
+}
+
+// finish fills in the totals and sorts all lists, so that the report
+// does not depend on scheduling order.
+func (r *runReport) finish(gv globalView, runErr error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Start = runTime(r.Start)
+	r.End = runTime(time.Now())
+	if runErr != nil {
+		r.Error = runErr.Error()
+	}
+	r.Packages = len(gv.pkgs)
+	if gv.stats != nil {
+		r.PackagesExtracted = gv.stats.PackagesExtracted
+		r.PackagesDeleted = gv.stats.PackagesDeleted
+		r.ManpagesRendered = gv.stats.ManpagesRendered
+		r.ManpageBytes = gv.stats.ManpageBytes
+		r.HtmlBytes = gv.stats.HtmlBytes
+		r.TextBytes = gv.stats.TextBytes
+		r.IndexBytes = gv.stats.IndexBytes
+		r.StoreBytes = gv.stats.StoreBytes
+		r.StoreSavedBytes = gv.stats.StoreSavedBytes
+	}
+	sort.Slice(r.FailedPackages, func(i, j int) bool { return r.FailedPackages[i].Package < r.FailedPackages[j].Package })
+	sort.Strings(r.SkippedPackages)
+	sort.Slice(r.UnparseablePaths, func(i, j int) bool { return r.UnparseablePaths[i].Path < r.UnparseablePaths[j].Path })
+	sort.Slice(r.DanglingSymlinks, func(i, j int) bool { return r.DanglingSymlinks[i].From < r.DanglingSymlinks[j].From })
+	sort.Slice(r.OmittedSoLines, func(i, j int) bool { return r.OmittedSoLines[i].Manpage < r.OmittedSoLines[j].Manpage })
+	sort.Slice(r.RenderFailures, func(i, j int) bool { return r.RenderFailures[i].Manpage < r.RenderFailures[j].Manpage })
+	sort.Slice(r.KnownIssues, func(i, j int) bool { return r.KnownIssues[i].Package < r.KnownIssues[j].Package })
+	if gv.quarantine != nil {
+		r.Quarantined = gv.quarantine.list()
+	}
+}
+
+// loadReport reads the report which was written to path by writeReport.
+func loadReport(path string) (*runReport, error) {
+	b, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r runReport
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// mergeStage takes all results which stage does not produce from prev,
+// the report of the previous run, so that running the stages
+// individually results in a complete report.
+func (r *runReport) mergeStage(prev *runReport, stage string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Stage = stage
+	if stage != "discover" {
+		r.Start = prev.Start
+		r.KnownIssues = prev.KnownIssues
+	}
+	if stage != "extract" {
+		r.PackagesExtracted = prev.PackagesExtracted
+		r.FailedPackages = prev.FailedPackages
+		r.SkippedPackages = prev.SkippedPackages
+		r.UnparseablePaths = prev.UnparseablePaths
+		r.DanglingSymlinks = prev.DanglingSymlinks
+		r.OmittedSoLines = prev.OmittedSoLines
+	}
+	if stage != "render" {
+		r.ManpagesRendered = prev.ManpagesRendered
+		r.ManpageBytes = prev.ManpageBytes
+		r.HtmlBytes = prev.HtmlBytes
+		r.TextBytes = prev.TextBytes
+		r.RenderFailures = prev.RenderFailures
+	}
+	if stage != "index" {
+		r.PackagesDeleted = prev.PackagesDeleted
+		r.IndexBytes = prev.IndexBytes
+		r.StoreBytes = prev.StoreBytes
+		r.StoreSavedBytes = prev.StoreSavedBytes
+	}
+}
+
+var statusTmpl = mustParseStatusTmpl()
+
+func mustParseStatusTmpl() *template.Template {
+	return template.Must(template.Must(commonTmpls.Clone()).New("status").Parse(bundled.Asset("status.tmpl")))
+}
+
+// writeReport writes report.json and status.html.gz to destDir.
+func writeReport(destDir string, r *runReport) error {
+	if *knownIssuesBugs != "" {
+		f, err := os.Open(*knownIssuesBugs)
+		if err != nil {
+			return fmt.Errorf("loading -known_issues_bugs: %v", err)
+		}
+		defer f.Close()
+		bugs, err := parseBugs(f)
+		if err != nil {
+			return fmt.Errorf("parsing -known_issues_bugs: %v", err)
+		}
+		r.linkBugs(bugs)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := serving.Write(filepath.Join(destDir, "report.json"), false, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}); err != nil {
+		return err
+	}
+
+	return serving.Write(filepath.Join(destDir, "status.html.gz"), true, func(w io.Writer) error {
+		return statusTmpl.Execute(w, struct {
+			Title          string
+			DebimanVersion string
+			Breadcrumbs    breadcrumbs
+			FooterExtra    string
+			Meta           *manpage.Meta
+			HrefLangs      []*manpage.Meta
+			Report         *runReport
+			Runtime        time.Duration
+		}{
+			Title:          "Status",
+			DebimanVersion: debimanVersion,
+			Report:         r,
+			Runtime:        r.End.Sub(r.Start),
+		})
+	})
+}
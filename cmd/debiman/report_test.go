@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBugs(t *testing.T) {
+	bugs, err := parseBugs(strings.NewReader(`# comment
+manpages-ja 123456 #234567
+
+testing/dpkg 345678
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]int{
+		"manpages-ja":  {123456, 234567},
+		"testing/dpkg": {345678},
+	}
+	if !reflect.DeepEqual(bugs, want) {
+		t.Fatalf("unexpected parseBugs() result: got %v, want %v", bugs, want)
+	}
+
+	for _, input := range []string{
+		"manpages-ja\n",
+		"manpages-ja notanumber\n",
+	} {
+		if _, err := parseBugs(strings.NewReader(input)); err == nil {
+			t.Errorf("parseBugs(%q) unexpectedly succeeded", input)
+		}
+	}
+}
+
+func TestLinkBugs(t *testing.T) {
+	r := newRunReport(time.Now())
+	r.knownIssues(map[string][]error{
+		"testing/manpages-ja": {errors.New("conflicting")},
+		"testing/dpkg":        {errors.New("conflicting")},
+		"unstable/dpkg":       {errors.New("conflicting")},
+		"testing/bash":        {errors.New("conflicting")},
+		"coreutils":           {errors.New("conflicting")},
+	})
+	testingBash := make([]int, 1, 4)
+	testingBash[0] = 234567
+	bugs := map[string][]int{
+		"manpages-ja":  {123456},
+		"testing/dpkg": {345678},
+		"testing/bash": testingBash,
+		"bash":         {456789},
+		"coreutils":    {567890},
+	}
+	r.linkBugs(bugs)
+	r.finish(globalView{}, nil)
+	if got, want := bugs["testing/bash"][:cap(testingBash)], []int{234567, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("linkBugs modified its argument: got %v, want %v", got, want)
+	}
+	want := []knownIssue{
+		{Package: "coreutils", Errors: []string{"conflicting"}, Bugs: []int{567890}},
+		{Package: "testing/bash", Errors: []string{"conflicting"}, Bugs: []int{234567, 456789}},
+		{Package: "testing/dpkg", Errors: []string{"conflicting"}, Bugs: []int{345678}},
+		{Package: "testing/manpages-ja", Errors: []string{"conflicting"}, Bugs: []int{123456}},
+		{Package: "unstable/dpkg", Errors: []string{"conflicting"}},
+	}
+	if got := r.KnownIssues; !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected known issues: got %+v, want %+v", got, want)
+	}
+}
+
+func TestMergeStage(t *testing.T) {
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := &runReport{
+		Start:             start,
+		PackagesExtracted: 3,
+		FailedPackages:    []packageFailure{{Package: "testing/i3-wm"}},
+		ManpagesRendered:  1,
+		KnownIssues:       []knownIssue{{Package: "testing/dpkg"}},
+	}
+	r := newRunReport(start.Add(1 * time.Hour))
+	r.ManpagesRendered = 5
+	r.mergeStage(prev, "render")
+	if got, want := r.ManpagesRendered, uint64(5); got != want {
+		t.Errorf("ManpagesRendered = %d, want %d", got, want)
+	}
+	if got, want := r.PackagesExtracted, uint64(3); got != want {
+		t.Errorf("PackagesExtracted = %d, want %d", got, want)
+	}
+	if got, want := r.FailedPackages, prev.FailedPackages; !reflect.DeepEqual(got, want) {
+		t.Errorf("FailedPackages = %v, want %v", got, want)
+	}
+	if got, want := r.KnownIssues, prev.KnownIssues; !reflect.DeepEqual(got, want) {
+		t.Errorf("KnownIssues = %v, want %v", got, want)
+	}
+	if !r.Start.Equal(start) {
+		t.Errorf("Start = %v, want %v", r.Start, start)
+	}
+	if got, want := r.Stage, "render"; got != want {
+		t.Errorf("Stage = %q, want %q", got, want)
+	}
+}
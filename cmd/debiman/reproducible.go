@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/commontmpl"
+	"github.com/stapelberg/debiman/internal/manpage"
+)
+
+var reproducible = flag.Bool("reproducible",
+	false,
+	"Produce bit-identical output for identical input, e.g. to compare deployments: timestamps in pages and the run report are taken from the SOURCE_DATE_EPOCH environment variable (or, for manpages, the modification time of their source) instead of the current time, and all lists derived from the archive indices are sorted. State files such as assets.json are not reproducible.")
+
+// reproducibleEpoch is the time specified by SOURCE_DATE_EPOCH, if any.
+var reproducibleEpoch time.Time
+
+// setupReproducible reads SOURCE_DATE_EPOCH (see
+// https://reproducible-builds.org/specs/source-date-epoch/) and fixes
+// the time in page footers.
+func setupReproducible() error {
+	if v := os.Getenv("SOURCE_DATE_EPOCH"); v != "" {
+		epoch, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %v", v, err)
+		}
+		reproducibleEpoch = time.Unix(epoch, 0).UTC()
+		commontmpl.ReproducibleTime = reproducibleEpoch
+	} else {
+		log.Printf("SOURCE_DATE_EPOCH not set, using the Unix epoch as the time of pages other than manpages")
+		commontmpl.ReproducibleTime = time.Unix(0, 0).UTC()
+	}
+	return nil
+}
+
+// convertedTime returns the time at which a manpage whose source was
+// last modified at modTime is stated to be converted to HTML.
+func convertedTime(modTime time.Time) time.Time {
+	if !*reproducible {
+		return time.Now()
+	}
+	if !reproducibleEpoch.IsZero() {
+		return reproducibleEpoch
+	}
+	return modTime
+}
+
+// runTime returns the time at which an event of the run (e.g. its end)
+// happened at now is stated in the run report.
+func runTime(now time.Time) time.Time {
+	if !*reproducible {
+		return now
+	}
+	return commontmpl.ReproducibleTime
+}
+
+type byServingPath []*manpage.Meta
+
+func (p byServingPath) Len() int           { return len(p) }
+func (p byServingPath) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byServingPath) Less(i, j int) bool { return p[i].ServingPath() < p[j].ServingPath() }
+
+// sortGlobalView sorts the slices of gv whose order depends on the order
+// in which index files were processed. Their order determines e.g. which
+// manpage a cross reference or .so line resolves to when there are
+// multiple candidates.
+func sortGlobalView(gv globalView) {
+	for _, versions := range gv.xref {
+		sort.Stable(byServingPath(versions))
+	}
+	for _, entries := range gv.contentByPath {
+		sort.SliceStable(entries, func(i, j int) bool {
+			if entries[i].suite != entries[j].suite {
+				return entries[i].suite < entries[j].suite
+			}
+			if entries[i].binarypkg != entries[j].binarypkg {
+				return entries[i].binarypkg < entries[j].binarypkg
+			}
+			return entries[i].arch < entries[j].arch
+		})
+	}
+}
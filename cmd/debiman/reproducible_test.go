@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/commontmpl"
+	"github.com/stapelberg/debiman/internal/manpage"
+)
+
+func TestConvertedTime(t *testing.T) {
+	defer flag.Set("reproducible", "false")
+	defer func() {
+		reproducibleEpoch = time.Time{}
+		commontmpl.ReproducibleTime = time.Time{}
+	}()
+	modTime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	flag.Set("reproducible", "true")
+	if got := convertedTime(modTime); !got.Equal(modTime) {
+		t.Errorf("convertedTime() without SOURCE_DATE_EPOCH = %v, want %v", got, modTime)
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+	if err := setupReproducible(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := convertedTime(modTime), time.Unix(1500000000, 0); !got.Equal(want) {
+		t.Errorf("convertedTime() with SOURCE_DATE_EPOCH = %v, want %v", got, want)
+	}
+
+	os.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if err := setupReproducible(); err == nil {
+		t.Errorf("setupReproducible() unexpectedly succeeded with an invalid SOURCE_DATE_EPOCH")
+	}
+}
+
+func TestWriteIndexReproducible(t *testing.T) {
+	defer flag.Set("reproducible", "false")
+	flag.Set("reproducible", "true")
+
+	dir, err := ioutil.TempDir("", "debiman-reproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := func(name, suite, binarypkg, section, language string) *manpage.Meta {
+		return &manpage.Meta{
+			Name:     name,
+			Package:  &manpage.PkgMeta{Binarypkg: binarypkg, Suite: suite},
+			Section:  section,
+			Language: language,
+		}
+	}
+	gv := func(reverse bool) globalView {
+		metas := []*manpage.Meta{
+			meta("i3", "testing", "i3-wm", "1", "en"),
+			meta("i3", "unstable", "i3-wm", "1", "en"),
+			meta("i3", "unstable", "i3-wm", "1", "fr"),
+			meta("crontab", "testing", "cron", "1", "en"),
+			meta("crontab", "testing", "cron", "5", "de"),
+		}
+		if reverse {
+			for i, j := 0, len(metas)-1; i < j; i, j = i+1, j-1 {
+				metas[i], metas[j] = metas[j], metas[i]
+			}
+		}
+		xref := make(map[string][]*manpage.Meta)
+		for _, m := range metas {
+			xref[m.Name] = append(xref[m.Name], m)
+		}
+		return globalView{
+			xref:         xref,
+			idxSuites:    map[string]string{"testing": "testing", "buster": "testing", "unstable": "unstable", "sid": "unstable"},
+			suiteOrder:   []string{"testing", "unstable"},
+			defaultSuite: "testing",
+			stats:        &stats{},
+		}
+	}
+
+	var idx [][]byte
+	for i := 0; i < 10; i++ {
+		path := filepath.Join(dir, "auxserver.idx")
+		if err := writeIndex(path, gv(i%2 == 1)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx = append(idx, b)
+	}
+	for i := 1; i < len(idx); i++ {
+		if !bytes.Equal(idx[i], idx[0]) {
+			t.Fatalf("writeIndex() output differs between runs over the same input")
+		}
+	}
+}
+
+func TestReportReproducible(t *testing.T) {
+	defer flag.Set("reproducible", "false")
+	defer func() {
+		reproducibleEpoch = time.Time{}
+		commontmpl.ReproducibleTime = time.Time{}
+	}()
+	flag.Set("reproducible", "true")
+	os.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+	if err := setupReproducible(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "debiman-reproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		r := newRunReport(time.Now())
+		r.finish(globalView{}, nil)
+		if got, want := r.End, time.Unix(1500000000, 0); !got.Equal(want) {
+			t.Errorf("report end = %v, want %v", got, want)
+		}
+		if err := writeReport(dir, r); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"report.json", "status.html.gz"} {
+			b, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputs = append(outputs, b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		if !bytes.Equal(outputs[i], outputs[2+i]) {
+			t.Errorf("writeReport() output %d differs between runs", i)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "runtime"
+
+func systemResources() resources {
+	return resources{cpus: runtime.NumCPU()}
+}
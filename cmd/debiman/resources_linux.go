@@ -0,0 +1,14 @@
+// +build linux
+
+package main
+
+import "syscall"
+
+func systemResources() resources {
+	res := readResources("/")
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err == nil {
+		res.openFiles = uint64(rlim.Cur)
+	}
+	return res
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/stapelberg/debiman/internal/write"
+)
+
+var resume = flag.Bool("resume",
+	false,
+	"If the previous run was interrupted (e.g. by SIGINT or SIGTERM) or failed, continue where it stopped: completed stages are skipped (re-using the snapshot of the interrupted run), and -force_reextract and -force_rerender skip packages and manpages which were already processed. Only use -resume with the same flags as the interrupted run.")
+
+// checkpointMaxAge is the age after which a checkpoint is discarded:
+// the archive has likely changed since, so a fresh discovery is
+// preferable over resuming.
+const checkpointMaxAge = 24 * time.Hour
+
+// checkpoint records the progress of a full run (all stages) in
+// -serving_dir, so that an interrupted run can be resumed. Within a
+// stage, progress is tracked by the files in -serving_dir themselves
+// (VERSION files and rendered manpages), so only completed stages
+// need to be recorded.
+type checkpoint struct {
+	path string
+	// resumed is true if the checkpoint was left behind by an
+	// interrupted run.
+	resumed bool
+
+	Started   time.Time `json:"started"`
+	Completed []string  `json:"completed_stages"`
+}
+
+// loadCheckpoint loads the checkpoint at path, or returns a new
+// checkpoint for a run starting at start.
+func loadCheckpoint(path string, start time.Time) (*checkpoint, error) {
+	fresh := &checkpoint{path: path, Started: start}
+	if !*resume {
+		return fresh, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fresh, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	c := &checkpoint{path: path, resumed: true}
+	if err := json.NewDecoder(f).Decode(c); err != nil {
+		return nil, err
+	}
+	if age := start.Sub(c.Started); age > checkpointMaxAge {
+		log.Printf("Discarding checkpoint of the run started at %v (older than %v)", c.Started, checkpointMaxAge)
+		return fresh, nil
+	}
+	log.Printf("Resuming the run started at %v, completed stages: %q", c.Started, c.Completed)
+	return c, nil
+}
+
+// since returns the start of the run which is being resumed, or the
+// zero time if no run is being resumed.
+func (c *checkpoint) since() time.Time {
+	if c == nil || !c.resumed {
+		return time.Time{}
+	}
+	return c.Started
+}
+
+func (c *checkpoint) completed(stage string) bool {
+	if c == nil {
+		return false
+	}
+	for _, s := range c.Completed {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// complete records that stage was completed.
+func (c *checkpoint) complete(stage string) error {
+	if c == nil {
+		return nil
+	}
+	c.Completed = append(c.Completed, stage)
+	return c.save()
+}
+
+func (c *checkpoint) save() error {
+	if c == nil {
+		return nil
+	}
+	return write.Atomically(c.path, false, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(c)
+	})
+}
+
+// remove deletes the checkpoint once the run completed.
+func (c *checkpoint) remove() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cancelOnSignal returns a context which is cancelled when SIGINT or
+// SIGTERM is received, so that the packages and manpages which are
+// in progress can be finished cleanly. A second signal terminates
+// the process immediately.
+func cancelOnSignal(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case sig := <-c:
+			log.Printf("%v received, finishing the work in progress (send again to exit immediately)", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
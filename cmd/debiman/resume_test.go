@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpoint(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "debiman-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	path := filepath.Join(tmpdir, "checkpoint.json")
+	flag.Set("resume", "true")
+	defer flag.Set("resume", "false")
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	c, err := loadCheckpoint(path, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.since().IsZero() {
+		t.Fatalf("fresh checkpoint resumes from %v", c.since())
+	}
+	if err := c.complete("discover"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.complete("extract"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The run is interrupted and resumed an hour later.
+	c, err = loadCheckpoint(path, start.Add(1*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.since(), start; !got.Equal(want) {
+		t.Fatalf("unexpected resume time: got %v, want %v", got, want)
+	}
+	for _, stage := range []string{"discover", "extract"} {
+		if !c.completed(stage) {
+			t.Fatalf("stage %q not completed", stage)
+		}
+	}
+	if c.completed("render") {
+		t.Fatalf("stage %q unexpectedly completed", "render")
+	}
+
+	// Checkpoints which are too old are discarded.
+	later := start.Add(checkpointMaxAge + time.Hour)
+	c, err = loadCheckpoint(path, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.completed("discover") || !c.since().IsZero() {
+		t.Fatalf("outdated checkpoint not discarded: %+v", c)
+	}
+
+	if err := c.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed: %v", err)
+	}
+}
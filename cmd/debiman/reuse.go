@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
-	"os"
 )
 
 var mandocDivB = []byte(`<div class="mandoc">`)
@@ -12,7 +11,7 @@ var tocLinkPrefix = []byte(`  <a class="toclink"`)
 var footerB = []byte(`<div id="footer">`)
 
 func reuse(src string) (doc string, toc []string, err error) {
-	f, err := os.Open(src)
+	f, err := serving.Open(src)
 	if err != nil {
 		return "", nil, err
 	}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/manpage"
+	"github.com/stapelberg/debiman/internal/tag"
+	"github.com/stapelberg/debiman/internal/write"
+	"pault.ag/go/debian/version"
+)
+
+var snapshotPath = flag.String("snapshot",
+	"<serving_dir>/.globalview.gob.gz",
+	"Path to the snapshot of the discovered packages, written by the discover stage and read by all other stages")
+
+// snapshotFormat must be increased whenever the snapshot types below
+// change incompatibly.
+const snapshotFormat = 1
+
+// The snapshot types mirror the globalView types with exported fields,
+// so that they can be encoded using encoding/gob.
+
+type snapshotPkg struct {
+	Source    string
+	Suite     string
+	Binarypkg string
+	Arch      string
+	Filename  string
+	Version   version.Version
+	Sha256    []byte
+	Bytes     int64
+	Replaces  []string
+	Local     bool
+	Tree      string
+	Files     []string
+}
+
+func snapshotPkgFrom(p *pkgEntry) snapshotPkg {
+	return snapshotPkg{
+		Source:    p.source,
+		Suite:     p.suite,
+		Binarypkg: p.binarypkg,
+		Arch:      p.arch,
+		Filename:  p.filename,
+		Version:   p.version,
+		Sha256:    p.sha256,
+		Bytes:     p.bytes,
+		Replaces:  p.replaces,
+		Local:     p.local,
+		Tree:      p.tree,
+		Files:     p.files,
+	}
+}
+
+func (p snapshotPkg) pkgEntry() *pkgEntry {
+	return &pkgEntry{
+		source:    p.Source,
+		suite:     p.Suite,
+		binarypkg: p.Binarypkg,
+		arch:      p.Arch,
+		filename:  p.Filename,
+		version:   p.Version,
+		sha256:    p.Sha256,
+		bytes:     p.Bytes,
+		replaces:  p.Replaces,
+		local:     p.Local,
+		tree:      p.Tree,
+		files:     p.Files,
+	}
+}
+
+type snapshotContent struct {
+	Suite     string
+	Arch      string
+	Binarypkg string
+	Filename  string
+}
+
+func snapshotContentFrom(e *contentEntry) snapshotContent {
+	return snapshotContent{
+		Suite:     e.suite,
+		Arch:      e.arch,
+		Binarypkg: e.binarypkg,
+		Filename:  e.filename,
+	}
+}
+
+func (e snapshotContent) contentEntry() *contentEntry {
+	return &contentEntry{
+		suite:     e.Suite,
+		arch:      e.Arch,
+		binarypkg: e.Binarypkg,
+		filename:  e.Filename,
+	}
+}
+
+type snapshotMeta struct {
+	Name     string
+	Section  string
+	Language string
+	// Package is an index into snapshot.PkgMetas. Many manpages share
+	// the same package, so storing each package only once keeps the
+	// snapshot small and preserves pointer identity when loading.
+	Package int
+}
+
+type snapshotLink struct {
+	From string
+	To   string
+}
+
+type snapshot struct {
+	Format         int
+	DebimanVersion string
+	Created        time.Time
+
+	Pkgs          []snapshotPkg
+	Suites        []string
+	IdxSuites     map[string]string
+	ContentByPath map[string][]snapshotContent
+	PkgMetas      []manpage.PkgMeta
+	Xref          map[string][]snapshotMeta
+	Alternatives  map[string][]snapshotLink
+	KnownIssues   []knownIssue
+	SuiteOrder    []string
+	DefaultSuite  string
+}
+
+func snapshotFromGlobalView(gv globalView) *snapshot {
+	s := &snapshot{
+		Format:         snapshotFormat,
+		DebimanVersion: debimanVersion,
+		Created:        gv.start,
+		Pkgs:           make([]snapshotPkg, 0, len(gv.pkgs)),
+		Suites:         make([]string, 0, len(gv.suites)),
+		IdxSuites:      gv.idxSuites,
+		ContentByPath:  make(map[string][]snapshotContent, len(gv.contentByPath)),
+		Xref:           make(map[string][]snapshotMeta, len(gv.xref)),
+		Alternatives:   make(map[string][]snapshotLink, len(gv.alternatives)),
+		SuiteOrder:     gv.suiteOrder,
+		DefaultSuite:   gv.defaultSuite,
+	}
+	for _, p := range gv.pkgs {
+		s.Pkgs = append(s.Pkgs, snapshotPkgFrom(p))
+	}
+	for suite := range gv.suites {
+		s.Suites = append(s.Suites, suite)
+	}
+	for path, entries := range gv.contentByPath {
+		c := make([]snapshotContent, 0, len(entries))
+		for _, e := range entries {
+			c = append(c, snapshotContentFrom(e))
+		}
+		s.ContentByPath[path] = c
+	}
+	pkgIdx := make(map[*manpage.PkgMeta]int)
+	for name, metas := range gv.xref {
+		x := make([]snapshotMeta, 0, len(metas))
+		for _, m := range metas {
+			idx, ok := pkgIdx[m.Package]
+			if !ok {
+				idx = len(s.PkgMetas)
+				pkgIdx[m.Package] = idx
+				s.PkgMetas = append(s.PkgMetas, *m.Package)
+			}
+			x = append(x, snapshotMeta{
+				Name:     m.Name,
+				Section:  m.Section,
+				Language: m.Language,
+				Package:  idx,
+			})
+		}
+		s.Xref[name] = x
+	}
+	for key, links := range gv.alternatives {
+		l := make([]snapshotLink, 0, len(links))
+		for _, link := range links {
+			l = append(l, snapshotLink{From: link.from, To: link.to})
+		}
+		s.Alternatives[key] = l
+	}
+	if gv.report != nil {
+		gv.report.mu.Lock()
+		s.KnownIssues = gv.report.KnownIssues
+		gv.report.mu.Unlock()
+	}
+	return s
+}
+
+// globalView converts s into a globalView for a run which started at
+// start.
+func (s *snapshot) globalView(start time.Time) (globalView, error) {
+	var stats stats
+	gv := globalView{
+		pkgs:          make([]*pkgEntry, 0, len(s.Pkgs)),
+		suites:        make(map[string]bool, len(s.Suites)),
+		idxSuites:     s.IdxSuites,
+		contentByPath: make(map[string][]*contentEntry, len(s.ContentByPath)),
+		xref:          make(map[string][]*manpage.Meta, len(s.Xref)),
+		alternatives:  make(map[string][]link, len(s.Alternatives)),
+		suiteOrder:    s.SuiteOrder,
+		defaultSuite:  s.DefaultSuite,
+		report:        newRunReport(start),
+		stats:         &stats,
+		start:         start,
+	}
+	if gv.idxSuites == nil {
+		gv.idxSuites = make(map[string]string)
+	}
+	for _, p := range s.Pkgs {
+		gv.pkgs = append(gv.pkgs, p.pkgEntry())
+	}
+	for _, suite := range s.Suites {
+		gv.suites[suite] = true
+	}
+	for path, entries := range s.ContentByPath {
+		c := make([]*contentEntry, 0, len(entries))
+		for _, e := range entries {
+			c = append(c, e.contentEntry())
+		}
+		gv.contentByPath[path] = c
+	}
+	pkgMetas := make([]*manpage.PkgMeta, len(s.PkgMetas))
+	for idx := range s.PkgMetas {
+		pkgMetas[idx] = &s.PkgMetas[idx]
+	}
+	for name, metas := range s.Xref {
+		x := make([]*manpage.Meta, 0, len(metas))
+		for _, m := range metas {
+			if m.Package < 0 || m.Package >= len(pkgMetas) {
+				return gv, fmt.Errorf("manpage %q references invalid package %d", m.Name, m.Package)
+			}
+			langTag, err := tag.FromLocale(m.Language)
+			if err != nil {
+				return gv, fmt.Errorf("manpage %q: %v", m.Name, err)
+			}
+			x = append(x, &manpage.Meta{
+				Name:        m.Name,
+				Package:     pkgMetas[m.Package],
+				Section:     m.Section,
+				Language:    m.Language,
+				LanguageTag: langTag,
+			})
+		}
+		gv.xref[name] = x
+	}
+	for key, links := range s.Alternatives {
+		l := make([]link, 0, len(links))
+		for _, sl := range links {
+			l = append(l, link{from: sl.From, to: sl.To})
+		}
+		gv.alternatives[key] = l
+	}
+	gv.report.KnownIssues = s.KnownIssues
+	return gv, nil
+}
+
+func encodeSnapshot(w io.Writer, gv globalView) error {
+	return gob.NewEncoder(w).Encode(snapshotFromGlobalView(gv))
+}
+
+func decodeSnapshot(r io.Reader, start time.Time) (globalView, error) {
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return globalView{}, err
+	}
+	if got, want := s.Format, snapshotFormat; got != want {
+		return globalView{}, fmt.Errorf("unsupported snapshot format %d (written by debiman %s), want %d", got, s.DebimanVersion, want)
+	}
+	return s.globalView(start)
+}
+
+// writeSnapshot writes gv to path, so that the stages after discovery
+// can run without accessing the archive.
+func writeSnapshot(path string, gv globalView) error {
+	return write.Atomically(path, true, func(w io.Writer) error {
+		return encodeSnapshot(w, gv)
+	})
+}
+
+// readSnapshot reads a globalView previously written by writeSnapshot.
+func readSnapshot(path string, start time.Time) (globalView, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return globalView{}, err
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return globalView{}, err
+	}
+	defer r.Close()
+	return decodeSnapshot(r, start)
+}
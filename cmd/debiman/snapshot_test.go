@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/manpage"
+	"pault.ag/go/debian/version"
+)
+
+func TestSnapshot(t *testing.T) {
+	pkg := &manpage.PkgMeta{
+		Filename:  "pool/main/i/i3-wm/i3-wm_4.13-1_amd64.deb",
+		Sourcepkg: "i3-wm",
+		Binarypkg: "i3-wm",
+		Version:   version.Version{Version: "4.13", Revision: "1"},
+		Suite:     "testing",
+	}
+	i3, err := manpage.FromManPath("man1/i3.1.gz", pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i3de, err := manpage.FromManPath("de/man1/i3.1.gz", pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	gv := globalView{
+		pkgs: []*pkgEntry{
+			{
+				source:    "i3-wm",
+				suite:     "testing",
+				binarypkg: "i3-wm",
+				arch:      "amd64",
+				filename:  pkg.Filename,
+				version:   pkg.Version,
+				sha256:    []byte{0xde, 0xad},
+				bytes:     1234,
+			},
+		},
+		suites:    map[string]bool{"testing": true},
+		idxSuites: map[string]string{"testing": "testing", "buster": "testing"},
+		contentByPath: map[string][]*contentEntry{
+			"man1/i3.1.gz": {{suite: "testing", arch: "amd64", binarypkg: "i3-wm", filename: "man1/i3.1.gz"}},
+		},
+		xref: map[string][]*manpage.Meta{
+			"i3": {i3, i3de},
+		},
+		alternatives: map[string][]link{
+			"testing/i3-wm": {{from: "/usr/share/man/man1/x-window-manager.1.gz", to: "/usr/share/man/man1/i3.1.gz"}},
+		},
+		report: newRunReport(start),
+		stats:  &stats{},
+		start:  start,
+	}
+
+	var buf bytes.Buffer
+	if err := encodeSnapshot(&buf, gv); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeSnapshot(&buf, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"pkgs", got.pkgs, gv.pkgs},
+		{"suites", got.suites, gv.suites},
+		{"idxSuites", got.idxSuites, gv.idxSuites},
+		{"contentByPath", got.contentByPath, gv.contentByPath},
+		{"xref", got.xref, gv.xref},
+		{"alternatives", got.alternatives, gv.alternatives},
+	} {
+		if !reflect.DeepEqual(field.got, field.want) {
+			t.Errorf("%s differs after round-trip: got %+v, want %+v", field.name, field.got, field.want)
+		}
+	}
+
+	// Manpages of the same package must share their PkgMeta.
+	if got.xref["i3"][0].Package != got.xref["i3"][1].Package {
+		t.Errorf("PkgMeta not shared after round-trip")
+	}
+}
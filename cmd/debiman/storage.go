@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/stapelberg/debiman/internal/storage"
+)
+
+var storageURL = flag.String("storage",
+	"",
+	"Where to store the output (manpages, rendered pages, indices and sitemaps). Empty stores it in -serving_dir on local disk. An URL like s3://bucket/prefix?endpoint=https://s3.example.net&region=us-east-1 stores it in S3-compatible object storage, using the credentials from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables. -serving_dir then only holds debiman’s state (e.g. caches and auxserver.idx).")
+
+// serving stores the files underneath -serving_dir, see -storage.
+var serving storage.Storage = storage.Local{}
+
+// servingLocally returns whether -serving_dir is stored on local disk,
+// which features relying on hardlinks or on mandoc reading files
+// require.
+func servingLocally() bool {
+	_, ok := serving.(storage.Local)
+	return ok
+}
+
+// readFile is like ioutil.ReadFile, but reads from serving.
+func readFile(path string) ([]byte, error) {
+	f, err := serving.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// openSource opens the manpage or auxiliary file path, which is
+// decompressed if it is gzip-compressed like manpages.
+func openSource(path string) (io.ReadCloser, error) {
+	f, err := serving.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	gzr, err := gzip.NewReader(f)
+	if err == io.EOF {
+		// An empty manpage, see convertFile.
+		f.Close()
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gzr, f}, nil
+}
+
+// maxIncludeDepth limits the nesting of .so includes, so that include
+// loops are detected.
+const maxIncludeDepth = 7
+
+// inlineIncludes copies the manpage r to w, replacing each .so line
+// (which soElim rewrote to a path within -serving_dir) with the
+// contents of the included file. mandoc reads included files from
+// local disk, which does not work when -serving_dir is not stored
+// there.
+func inlineIncludes(w io.Writer, r io.Reader, depth int) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, ".so ") {
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+			continue
+		}
+		if depth >= maxIncludeDepth {
+			return fmt.Errorf("%s: .so nested too deeply", line)
+		}
+		include := strings.TrimSpace(line[len(".so "):])
+		rc, err := openSource(filepath.Join(*servingDir, include))
+		if err != nil {
+			return fmt.Errorf("%s: %v", line, err)
+		}
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if err := inlineIncludes(w, &buf, depth+1); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInlineIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flag.Set("serving_dir", dir)
+
+	write := func(path string, content []byte) {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("testing/bash/bash-builtins.7.en.gz", gzipped(t, ".TH BASH-BUILTINS 7\n.so testing/bash/aux/usr/share/man/macros\n"))
+	write("testing/bash/aux/usr/share/man/macros", []byte(".de XX\n..\n"))
+	write("testing/bash/empty.7.en.gz", nil)
+	write("testing/bash/loop.7.en.gz", gzipped(t, ".so testing/bash/loop.7.en.gz\n"))
+
+	var buf bytes.Buffer
+	in := ".TH BUILTINS 7\n.so testing/bash/bash-builtins.7.en.gz\n.so testing/bash/empty.7.en.gz\n.SH NAME\n"
+	if err := inlineIncludes(&buf, strings.NewReader(in), 0); err != nil {
+		t.Fatal(err)
+	}
+	want := ".TH BUILTINS 7\n.TH BASH-BUILTINS 7\n.de XX\n..\n.SH NAME\n"
+	if got := buf.String(); got != want {
+		t.Errorf("inlineIncludes() = %q, want %q", got, want)
+	}
+
+	for _, in := range []string{
+		".so testing/bash/missing.7.en.gz\n",
+		".so testing/bash/loop.7.en.gz\n",
+	} {
+		if err := inlineIncludes(ioutil.Discard, strings.NewReader(in), 0); err == nil {
+			t.Errorf("inlineIncludes(%q) unexpectedly succeeded", in)
+		}
+	}
+}
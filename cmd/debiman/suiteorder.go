@@ -0,0 +1,150 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"pault.ag/go/archive"
+)
+
+// suiteInfo contains the Release file fields which determine the order
+// of a suite relative to the other suites.
+type suiteInfo struct {
+	name     string // as in globalView.suites
+	suite    string // e.g. “stable”
+	codename string // e.g. “stretch”
+	version  string // e.g. “9.4”, empty for testing and unstable
+	date     time.Time
+}
+
+func suiteInfoFromRelease(name string, release *archive.Release) suiteInfo {
+	info := suiteInfo{
+		name:     name,
+		suite:    release.Suite,
+		codename: release.Codename,
+		version:  release.Version,
+	}
+	for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+		if t, err := time.Parse(layout, release.Date); err == nil {
+			info.date = t
+			break
+		}
+	}
+	return info
+}
+
+// developmentRank orders the suites which do not carry a version
+// number (yet).
+var developmentRank = map[string]int{
+	"testing":      0,
+	"unstable":     1,
+	"experimental": 2,
+}
+
+// compareVersions compares dotted release versions (e.g. “8.10” and
+// “9.4”) numerically.
+func compareVersions(a, b string) int {
+	pa := strings.Split(a, ".")
+	pb := strings.Split(b, ".")
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (a suiteInfo) less(b suiteInfo) bool {
+	// Released suites come first, ordered by version.
+	if (a.version != "") != (b.version != "") {
+		return a.version != ""
+	}
+	if a.version != "" {
+		if c := compareVersions(a.version, b.version); c != 0 {
+			return c < 0
+		}
+	}
+	// Development suites are ordered by their well-known names, then
+	// by date.
+	ra, oka := developmentRank[a.suite]
+	rb, okb := developmentRank[b.suite]
+	if oka != okb {
+		return oka
+	}
+	if oka && ra != rb {
+		return ra < rb
+	}
+	if !a.date.Equal(b.date) {
+		return a.date.Before(b.date)
+	}
+	return a.name < b.name
+}
+
+// backportsBase returns the codename of the suite for which info
+// contains backports (e.g. “stretch” for “stretch-backports” or
+// “stretch-backports-sloppy”), or the empty string.
+func backportsBase(info suiteInfo) string {
+	for _, name := range []string{info.codename, info.suite} {
+		if idx := strings.Index(name, "-backports"); idx > 0 {
+			return name[:idx]
+		}
+	}
+	return ""
+}
+
+// orderSuites returns the suites from oldest to newest and the suite to
+// which debiman-auxserver should redirect by default (the current
+// stable release, if it is among the suites). Backports suites are
+// ordered directly after the suite they are based on.
+func orderSuites(infos []suiteInfo) (order []string, defaultSuite string) {
+	byCodename := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		byCodename[info.codename] = true
+	}
+
+	var main []suiteInfo
+	backports := make(map[string][]suiteInfo)
+	for _, info := range infos {
+		if base := backportsBase(info); base != "" && byCodename[base] {
+			backports[base] = append(backports[base], info)
+			continue
+		}
+		main = append(main, info)
+	}
+	sort.SliceStable(main, func(i, j int) bool { return main[i].less(main[j]) })
+
+	for _, info := range main {
+		order = append(order, info.name)
+		bp := backports[info.codename]
+		sort.Slice(bp, func(i, j int) bool { return bp[i].name < bp[j].name })
+		for _, b := range bp {
+			order = append(order, b.name)
+		}
+
+		if info.suite == "stable" {
+			defaultSuite = info.name
+		}
+	}
+
+	if defaultSuite == "" {
+		// Fall back to the newest released suite.
+		for _, info := range main {
+			if info.version != "" {
+				defaultSuite = info.name
+			}
+		}
+	}
+	return order, defaultSuite
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOrderSuites(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2018, time.March, d, 0, 0, 0, 0, time.UTC)
+	}
+	infos := []suiteInfo{
+		{name: "unstable", suite: "unstable", codename: "sid", date: day(10)},
+		{name: "stretch-backports", suite: "stretch-backports", codename: "stretch-backports", date: day(10)},
+		{name: "jessie", suite: "oldstable", codename: "jessie", version: "8.10", date: day(3)},
+		{name: "experimental", suite: "experimental", codename: "rc-buggy", date: day(10)},
+		{name: "stretch", suite: "stable", codename: "stretch", version: "9.4", date: day(10)},
+		{name: "testing", suite: "testing", codename: "buster", date: day(10)},
+		{name: "jessie-backports", suite: "jessie-backports", codename: "jessie-backports", date: day(10)},
+		{name: "acme", suite: "acme", codename: "acme", date: day(1)},
+		{name: "wheezy", suite: "oldoldstable", codename: "wheezy", version: "7.11", date: day(1)},
+		// Backports of a suite which is not synchronized are ordered
+		// like any other development suite.
+		{name: "lenny-backports", suite: "lenny-backports", codename: "lenny-backports", date: day(2)},
+	}
+	order, defaultSuite := orderSuites(infos)
+	want := []string{
+		"wheezy",
+		"jessie",
+		"jessie-backports",
+		"stretch",
+		"stretch-backports",
+		"testing",
+		"unstable",
+		"experimental",
+		"acme",
+		"lenny-backports",
+	}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("unexpected suite order:\ngot  %v\nwant %v", order, want)
+	}
+	if got, want := defaultSuite, "stretch"; got != want {
+		t.Fatalf("unexpected default suite: got %q, want %q", got, want)
+	}
+
+	// Without a stable suite, the newest released suite is the default.
+	_, defaultSuite = orderSuites(infos[:4])
+	if got, want := defaultSuite, "jessie"; got != want {
+		t.Fatalf("unexpected default suite: got %q, want %q", got, want)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, entry := range []struct {
+		a, b string
+		want int
+	}{
+		{"8.10", "9.4", -1},
+		{"10", "9.4", 1},
+		{"9.4", "9.4", 0},
+		{"9", "9.0", 0},
+		{"8.10", "8.9", 1},
+	} {
+		if got := compareVersions(entry.a, entry.b); got != entry.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", entry.a, entry.b, got, entry.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"io"
+	"sort"
 	"sync/atomic"
 
 	pb "github.com/stapelberg/debiman/internal/proto"
@@ -36,17 +37,52 @@ func writeIndex(dest string, gv globalView) error {
 	for lang := range langs {
 		idx.Language = append(idx.Language, lang)
 	}
+	sort.Strings(idx.Language)
 
 	for section := range sections {
 		idx.Section = append(idx.Section, section)
 	}
+	sort.Strings(idx.Section)
+
+	if *reproducible {
+		sort.Slice(idx.Entry, func(i, j int) bool {
+			a, b := idx.Entry[i], idx.Entry[j]
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			if a.Suite != b.Suite {
+				return a.Suite < b.Suite
+			}
+			if a.Binarypkg != b.Binarypkg {
+				return a.Binarypkg < b.Binarypkg
+			}
+			if a.Section != b.Section {
+				return a.Section < b.Section
+			}
+			return a.Language < b.Language
+		})
+	}
 
 	idx.Suite = gv.idxSuites
+	idx.SuiteOrder = gv.suiteOrder
+	idx.DefaultSuite = gv.defaultSuite
+	if len(printFormats) > 0 {
+		// In these suites, the missing printable versions were
+		// rendered in this run (see missingPrintable).
+		for suite := range printSuites {
+			idx.PrintSuite = append(idx.PrintSuite, suite)
+		}
+		sort.Strings(idx.PrintSuite)
+		idx.PrintFormat = printFormats
+	}
 
-	idxb, err := proto.Marshal(idx)
-	if err != nil {
+	// Deterministic marshaling sorts map fields (idx.Suite).
+	var buf proto.Buffer
+	buf.SetDeterministic(*reproducible)
+	if err := buf.Marshal(idx); err != nil {
 		return err
 	}
+	idxb := buf.Bytes()
 
 	return write.Atomically(dest, false, func(w io.Writer) error {
 		_, err := w.Write(idxb)
@@ -113,6 +113,9 @@ func (s *Server) HandleRedirect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The redirect target depends on the Accept header, see
+	// redirect.Index.Redirect.
+	w.Header().Add("Vary", "Accept")
 	// StatusTemporaryRedirect (HTTP 307) means subsequent requests
 	// should use the old URI, which is what we want — the redirect
 	// target will likely change in the future.
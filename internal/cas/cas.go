@@ -0,0 +1,177 @@
+// Package cas implements a content-addressed store, which replaces
+// files with identical contents by hardlinks to a single object.
+package cas
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store keeps one object per distinct file content in a directory. An
+// object is hardlinked to all paths with its content, so objects and
+// paths must be on the same file system.
+//
+// Linked paths must only be replaced atomically (e.g. using
+// write.Atomically), never modified in place, as modifying a path would
+// modify all paths sharing its object.
+type Store struct {
+	dir string
+}
+
+// New returns a Store which keeps its objects underneath dir.
+func New(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+func (s *Store) objectPath(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash[2:])
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Link replaces path with a hardlink to the object with the same
+// content, which is added to the store if it does not exist yet. It
+// returns whether path was replaced, i.e. whether its content was
+// already stored for another path.
+//
+// All paths linked to an object share its modification time, which is
+// the modification time of the first path stored with its content.
+// The modification time of a linked path hence does not say when the
+// path was written; callers must track that separately.
+func (s *Store) Link(path string) (bool, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return false, nil
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		return false, err
+	}
+	obj := s.objectPath(hash)
+	ofi, err := os.Stat(obj)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(obj), 0755); err != nil {
+			return false, err
+		}
+		err = os.Link(path, obj)
+		if err == nil {
+			return false, nil
+		}
+		if !os.IsExist(err) {
+			return false, err
+		}
+		// The object was added concurrently.
+		ofi, err = os.Stat(obj)
+	}
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(fi, ofi) {
+		return false, nil
+	}
+	if ofi.Size() != fi.Size() {
+		return false, fmt.Errorf("object %s: size %d does not match the size of %s (%d)", obj, ofi.Size(), path, fi.Size())
+	}
+
+	// Replace path atomically: readers see either the old file or the
+	// object, never a missing file.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "debiman-")
+	if err != nil {
+		return false, err
+	}
+	tmp.Close()
+	if err := os.Remove(tmp.Name()); err != nil {
+		return false, err
+	}
+	if err := os.Link(obj, tmp.Name()); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// Usage describes the disk space used by the store.
+type Usage struct {
+	// Objects is the number of objects in the store.
+	Objects int
+	// Links is the number of paths linked to objects.
+	Links int
+	// Bytes is the disk space used by all objects.
+	Bytes int64
+	// SavedBytes is the disk space which the paths would additionally
+	// use if they were not hardlinked.
+	SavedBytes int64
+}
+
+// walk calls fn for every object in the store.
+func (s *Store) walk(fn func(path string, fi os.FileInfo) error) error {
+	err := filepath.Walk(s.dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		return fn(path, fi)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Usage returns the disk space used and saved by the store.
+func (s *Store) Usage() (Usage, error) {
+	var u Usage
+	err := s.walk(func(path string, fi os.FileInfo) error {
+		links := linkCount(fi) - 1 // the object itself
+		if links < 1 {
+			return nil
+		}
+		u.Objects++
+		u.Links += links
+		u.Bytes += fi.Size()
+		u.SavedBytes += int64(links-1) * fi.Size()
+		return nil
+	})
+	return u, err
+}
+
+// Collect removes all objects which are no longer linked to any path
+// and returns the number of removed objects and their size.
+func (s *Store) Collect() (removed int, freed int64, err error) {
+	err = s.walk(func(path string, fi os.FileInfo) error {
+		if linkCount(fi) != 1 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += fi.Size()
+		return nil
+	})
+	return removed, freed, err
+}
@@ -0,0 +1,125 @@
+package cas
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/write"
+)
+
+func sameFile(t *testing.T, a, b string) bool {
+	ast, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bst, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(ast, bst)
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debiman-cas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := New(filepath.Join(dir, ".cas"))
+	files := map[string]string{
+		"testing/i3-wm/i3.1.en.gz":  "identical",
+		"unstable/i3-wm/i3.1.en.gz": "identical",
+		"unstable/i3-wm/i3bar.1.gz": "different",
+	}
+	old := time.Now().Add(-1 * time.Hour).Truncate(time.Second)
+	for path, content := range files {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testingPath := filepath.Join(dir, "testing/i3-wm/i3.1.en.gz")
+	unstablePath := filepath.Join(dir, "unstable/i3-wm/i3.1.en.gz")
+	if err := os.Chtimes(testingPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"testing/i3-wm/i3.1.en.gz", false},
+		{"unstable/i3-wm/i3.1.en.gz", true},
+		{"unstable/i3-wm/i3bar.1.gz", false},
+		{"unstable/i3-wm/i3.1.en.gz", false}, // already linked
+	} {
+		linked, err := s.Link(filepath.Join(dir, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if linked != tt.want {
+			t.Errorf("Link(%q) = %v, want %v", tt.path, linked, tt.want)
+		}
+	}
+	if !sameFile(t, testingPath, unstablePath) {
+		t.Fatalf("identical files not hardlinked")
+	}
+	st, err := os.Stat(testingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.ModTime().Equal(old) {
+		t.Errorf("modification time of %s changed by linking another path: got %v, want %v", testingPath, st.ModTime(), old)
+	}
+
+	u, err := s.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Usage{Objects: 2, Links: 3, Bytes: 18, SavedBytes: 9}
+	if u != want {
+		t.Errorf("Usage() = %+v, want %+v", u, want)
+	}
+
+	// Replacing a linked file must not modify the other linked files.
+	if err := write.Atomically(unstablePath, false, func(w io.Writer) error {
+		_, err := w.Write([]byte("changed"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(testingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "identical"; got != want {
+		t.Fatalf("linked file modified: got %q, want %q", got, want)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "unstable/i3-wm/i3bar.1.gz")); err != nil {
+		t.Fatal(err)
+	}
+	removed, freed, err := s.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || freed != 9 {
+		t.Errorf("Collect() = %d, %d, want 1, 9", removed, freed)
+	}
+	u, err = s.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Usage{Objects: 1, Links: 1, Bytes: 9, SavedBytes: 0}
+	if u != want {
+		t.Errorf("Usage() after Collect() = %+v, want %+v", u, want)
+	}
+}
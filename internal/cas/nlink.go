@@ -0,0 +1,17 @@
+// +build !windows
+
+package cas
+
+import (
+	"os"
+	"syscall"
+)
+
+// linkCount returns the number of hardlinks of fi, or 0 if unknown.
+func linkCount(fi os.FileInfo) int {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return int(st.Nlink)
+}
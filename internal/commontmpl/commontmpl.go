@@ -2,6 +2,7 @@ package commontmpl
 
 import (
 	"flag"
+	"fmt"
 	"html/template"
 	"log"
 	"net/url"
@@ -13,6 +14,7 @@ import (
 	"golang.org/x/text/language/display"
 
 	"github.com/stapelberg/debiman/internal/bundled"
+	"github.com/stapelberg/debiman/internal/distro"
 )
 
 const iso8601Format = "2006-01-02T15:04:05Z"
@@ -28,6 +30,10 @@ var (
 	baseURLOnce sync.Once
 )
 
+// ReproducibleTime, if non-zero, replaces the current time in the page
+// footer, see the -reproducible flag of debiman.
+var ReproducibleTime time.Time
+
 // BaseURLPath returns the path of the -base_url flag. E.g. “/sub” for
 // “https://example.com/sub”, or “” for “https://manpages.debian.org”.
 func BaseURLPath() string {
@@ -71,7 +77,22 @@ func MustParseCommonTmpls() *template.Template {
 			return BaseURLPath()
 		},
 		"Now": func() string {
+			if !ReproducibleTime.IsZero() {
+				return ReproducibleTime.UTC().Format(iso8601Format)
+			}
 			return time.Now().UTC().Format(iso8601Format)
+		},
+		"Distribution": func() string {
+			return distro.Current().Name
+		},
+		"TrackerURL": func(binarypkg, sourcepkg string) string {
+			return distro.Current().TrackerURL(binarypkg, sourcepkg)
+		},
+		"SnapshotURL": func(sourcepkg string, version interface{}) string {
+			return distro.Current().SnapshotURL(sourcepkg, fmt.Sprint(version))
+		},
+		"BugURL": func(bug int) string {
+			return distro.Current().BugURL(bug)
 		}}
 
 	t := template.New("root")
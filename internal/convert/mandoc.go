@@ -2,6 +2,7 @@ package convert
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,15 +16,71 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-// Process starts a mandoc process to convert manpages to HTML.
+// Version must be increased whenever the output of ToHTML changes for
+// the same mandoc output, e.g. when postprocess is modified.
+const Version = 1
+
+// MandocVersion identifies the mandoc binaries which are used for
+// converting manpages, so that results cached across runs can be
+// discarded when mandoc is upgraded.
+func MandocVersion() (string, error) {
+	h := sha256.New()
+	var found bool
+	for _, name := range []string{"mandoc", "mandocd"} {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\n", name)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+		found = true
+	}
+	if !found {
+		return "", fmt.Errorf("mandoc not found")
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))[:16], nil
+}
+
+// Output formats of a Process, see NewFormatProcess.
+const (
+	FormatHTML     = "html"
+	FormatText     = "utf8"
+	FormatMarkdown = "markdown"
+)
+
+// mandocdFormats are the output formats which mandocd(8) implements.
+// Manpages are converted to other formats by running mandoc for each
+// manpage, like when mandocd is not installed.
+var mandocdFormats = map[string]bool{
+	FormatHTML: true,
+	FormatText: true,
+}
+
+// Process starts a mandoc process to convert manpages to HTML or, see
+// NewFormatProcess, to other formats.
 type Process struct {
+	format        string
 	mandocConn    *net.UnixConn
 	mandocProcess *os.Process
 	stopWait      chan bool
 }
 
 func NewProcess() (*Process, error) {
-	p := &Process{}
+	return NewFormatProcess(FormatHTML)
+}
+
+// NewFormatProcess starts a mandoc process to convert manpages to
+// format, one of the Format constants.
+func NewFormatProcess(format string) (*Process, error) {
+	p := &Process{format: format}
 	return p, p.initMandoc()
 }
 
@@ -36,6 +93,10 @@ func (p *Process) Kill() error {
 }
 
 func (p *Process) initMandoc() error {
+	if !mandocdFormats[p.format] {
+		return nil
+	}
+
 	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
 	if err != nil {
 		return err
@@ -59,7 +120,7 @@ func (p *Process) initMandoc() error {
 		return err
 	}
 
-	cmd := exec.Command(path, "-Thtml", "3") // Go dup2()s ExtraFiles to 3 and onwards
+	cmd := exec.Command(path, "-T"+p.format, "3") // Go dup2()s ExtraFiles to 3 and onwards
 	cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(pair[1]), "")}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -99,7 +160,7 @@ func (p *Process) mandoc(r io.Reader) (stdout string, stderr string, err error)
 	// TODO(later): once a new-enough version of mandoc is in Debian,
 	// get rid of this compatibility code by changing our CSS to not
 	// rely on the mandoc class at all anymore.
-	if err == nil && !strings.HasPrefix(stdout, `<div class="mandoc">`) {
+	if err == nil && p.format == FormatHTML && !strings.HasPrefix(stdout, `<div class="mandoc">`) {
 		stdout = `<div class="mandoc">
 ` + stdout + `</div>
 `
@@ -109,7 +170,11 @@ func (p *Process) mandoc(r io.Reader) (stdout string, stderr string, err error)
 
 func (p *Process) mandocFork(r io.Reader) (stdout string, stderr string, err error) {
 	var stdoutb, stderrb bytes.Buffer
-	cmd := exec.Command("mandoc", "-Ofragment", "-Thtml")
+	args := []string{"-T" + p.format}
+	if p.format == FormatHTML {
+		args = append([]string{"-Ofragment"}, args...)
+	}
+	cmd := exec.Command("mandoc", args...)
 	cmd.Stdin = r
 	cmd.Stdout = &stdoutb
 	cmd.Stderr = &stderrb
@@ -0,0 +1,62 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// mdXrefRe matches cross references in mandoc’s Markdown output, which
+// are optionally emphasized and contain backslash-escaped characters,
+// e.g. “**git\-rebase**(1)”.
+var mdXrefRe = regexp.MustCompile(`(\*\*|\*|_)?((?:[A-Za-z0-9.:+-]|\\[-_.+*])+)(\*\*|\*|_)?\(([1-9n][A-Za-z0-9]*)\)`)
+
+// ToMarkdown converts the manpage r to Markdown using mandoc. Cross
+// references are turned into links using resolve (see ToHTML). p must
+// have been started with FormatMarkdown.
+func (p *Process) ToMarkdown(r io.Reader, resolve func(ref string) string) (string, error) {
+	if p.format != FormatMarkdown {
+		return "", fmt.Errorf("ToMarkdown requires a %s process, not %s", FormatMarkdown, p.format)
+	}
+	stdout, _, err := p.mandoc(r)
+	if err != nil {
+		return "", fmt.Errorf("running mandoc failed: %v", err)
+	}
+	return linkXrefs(stdout, resolve), nil
+}
+
+// linkXrefs turns the cross references in the Markdown document md into
+// links, unless they are within code blocks or already links.
+func linkXrefs(md string, resolve func(ref string) string) string {
+	lines := strings.SplitAfter(md, "\n")
+	for idx, line := range lines {
+		if strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") {
+			continue // code block
+		}
+		var linked bytes.Buffer
+		var last int
+		for _, m := range mdXrefRe.FindAllStringSubmatchIndex(line, -1) {
+			if m[0] > 0 && strings.ContainsAny(line[m[0]-1:m[0]], "[\\/") {
+				continue
+			}
+			if strings.HasPrefix(line[m[1]:], "](") {
+				continue
+			}
+			name := strings.Replace(line[m[4]:m[5]], "\\", "", -1)
+			url := resolve(name + "(" + line[m[8]:m[9]] + ")")
+			if url == "" {
+				continue
+			}
+			linked.WriteString(line[last:m[0]])
+			fmt.Fprintf(&linked, "[%s](%s)", line[m[0]:m[1]], url)
+			last = m[1]
+		}
+		if last > 0 {
+			linked.WriteString(line[last:])
+			lines[idx] = linked.String()
+		}
+	}
+	return strings.Join(lines, "")
+}
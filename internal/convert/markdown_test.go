@@ -0,0 +1,38 @@
+package convert
+
+import "testing"
+
+func TestLinkXrefs(t *testing.T) {
+	resolve := func(ref string) string {
+		switch ref {
+		case "i3(1)", "git-rebase(1)", "i3_input(1)":
+			return "https://manpages.debian.org/" + ref
+		}
+		return ""
+	}
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "See i3(1) for details.\n",
+			want: "See [i3(1)](https://manpages.debian.org/i3(1)) for details.\n",
+		},
+		{
+			in:   "**i3**(1), *git\\-rebase*(1) and i3\\_input(1)\n",
+			want: "[**i3**(1)](https://manpages.debian.org/i3(1)), [*git\\-rebase*(1)](https://manpages.debian.org/git-rebase(1)) and [i3\\_input(1)](https://manpages.debian.org/i3_input(1))\n",
+		},
+		{
+			in:   "unknown(1) and i3(7) are not linked\n",
+			want: "unknown(1) and i3(7) are not linked\n",
+		},
+		{
+			in:   "    $ man i3(1)\n[i3(1)](https://i3wm.org/) and https://example.net/i3(1)\n",
+			want: "    $ man i3(1)\n[i3(1)](https://i3wm.org/) and https://example.net/i3(1)\n",
+		},
+	} {
+		if got := linkXrefs(tt.in, resolve); got != tt.want {
+			t.Errorf("linkXrefs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package convert
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// PrintFormats contains the mandoc output formats which ToPrintable
+// supports.
+var PrintFormats = map[string]bool{
+	"pdf": true,
+	"ps":  true,
+}
+
+// ToPrintable converts the manpage r to format (see PrintFormats) for
+// printing.
+func ToPrintable(r io.Reader, format string) ([]byte, error) {
+	if !PrintFormats[format] {
+		return nil, fmt.Errorf("unsupported print format %q", format)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("mandoc", "-T"+format)
+	cmd.Stdin = r
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v, stderr: %s", err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
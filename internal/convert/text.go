@@ -0,0 +1,36 @@
+package convert
+
+import (
+	"fmt"
+	"io"
+)
+
+// ToText converts the manpage r to plain text using mandoc’s UTF-8
+// output, without the overstriking mandoc uses for bold and
+// underlined text. p must have been started with FormatText.
+func (p *Process) ToText(r io.Reader) (string, error) {
+	if p.format != FormatText {
+		return "", fmt.Errorf("ToText requires a %s process, not %s", FormatText, p.format)
+	}
+	stdout, _, err := p.mandoc(r)
+	if err != nil {
+		return "", fmt.Errorf("running mandoc failed: %v", err)
+	}
+	return stripOverstrike(stdout), nil
+}
+
+// stripOverstrike removes backspace sequences (e.g. “_\bx” or “x\bx”),
+// keeping only the last character of each sequence.
+func stripOverstrike(s string) string {
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		if r == '\b' {
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
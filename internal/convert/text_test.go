@@ -0,0 +1,20 @@
+package convert
+
+import "testing"
+
+func TestStripOverstrike(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"NAME", "NAME"},
+		{"N\bNA\bAM\bME\bE", "NAME"},
+		{"_\bf_\bi_\bl_\be", "file"},
+		{"_\bä\bä", "ä"},
+		{"\bx", "x"},
+	} {
+		if got := stripOverstrike(tt.in); got != tt.want {
+			t.Errorf("stripOverstrike(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+// Package distro describes the distribution whose manpages are served,
+// e.g. Debian, Ubuntu or a custom derivative.
+package distro
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Layout describes where files are located in the archive and where
+// packages are described on the web.
+type Layout struct {
+	// ContentsPerComponent specifies whether Contents files are
+	// located per component (dists/<suite>/<component>/Contents-<arch>.gz,
+	// as in Debian) or per suite (dists/<suite>/Contents-<arch>.gz, as
+	// in Ubuntu).
+	ContentsPerComponent bool `json:"contents_per_component"`
+
+	// PreferredArchitecture is used when we need to pick an arbitrary
+	// architecture. Downloading the package for the most popular
+	// architecture has the least bad influence on the mirror server’s
+	// caches.
+	PreferredArchitecture string `json:"preferred_architecture"`
+
+	// TrackerURL is a format string (see fmt) for linking to a package
+	// tracker. %[1]s is replaced with the binary package name, %[2]s
+	// with the source package name.
+	TrackerURL string `json:"tracker_url"`
+
+	// SnapshotURL is a format string (see fmt) for linking to a
+	// specific package version. %[1]s is replaced with the source
+	// package name, %[2]s with the version.
+	SnapshotURL string `json:"snapshot_url"`
+
+	// BugURL is a format string (see fmt) for linking to a bug in the
+	// bug tracker. %[1]d is replaced with the bug number.
+	BugURL string `json:"bug_url"`
+}
+
+// Profile describes a distribution.
+type Profile struct {
+	// Name is the human-readable distribution name, e.g. “Debian”.
+	Name string `json:"name"`
+
+	// Suites lists the suites of the distribution, from oldest to
+	// newest. Suites which are not listed are sorted after the listed
+	// suites, in alphabetical order.
+	Suites []string `json:"suites"`
+
+	// Aliases maps suite names to the suite (as in Suites) they should
+	// be sorted with, e.g. testing → buster.
+	Aliases map[string]string `json:"aliases"`
+
+	// DefaultSuite is the suite to which the redirector prefers to
+	// redirect when no suite was specified.
+	DefaultSuite string `json:"default_suite"`
+
+	Layout Layout `json:"layout"`
+
+	orderOnce sync.Once
+	order     map[string]int
+}
+
+// Debian is the profile for the Debian distribution.
+var Debian = &Profile{
+	Name: "Debian",
+	Suites: []string{
+		"buzz",
+		"rex",
+		"bo",
+		"hamm",
+		"slink",
+		"potato",
+		"woody",
+		"sarge",
+		"etch",
+		"lenny",
+		"squeeze",
+		"wheezy",
+		"wheezy-backports",
+		"jessie",
+		"jessie-backports",
+		"stretch",
+		"stretch-backports",
+		"buster",
+		"buster-backports",
+		"bullseye",
+		"bullseye-backports",
+		"bookworm",
+		"bookworm-backports",
+		"trixie",
+		"trixie-backports",
+		"forky",
+		"unstable",
+		"experimental",
+	},
+	Aliases: map[string]string{
+		"testing":  "forky",
+		"sid":      "unstable",
+		"rc-buggy": "experimental",
+	},
+	DefaultSuite: "trixie",
+	Layout: Layout{
+		ContentsPerComponent:  true,
+		PreferredArchitecture: "amd64",
+		TrackerURL:            "https://tracker.debian.org/pkg/%[1]s",
+		SnapshotURL:           "http://snapshot.debian.org/package/%[1]s/%[2]s/",
+		BugURL:                "https://bugs.debian.org/%[1]d",
+	},
+}
+
+// Ubuntu is the profile for the Ubuntu distribution.
+var Ubuntu = &Profile{
+	Name: "Ubuntu",
+	Suites: []string{
+		"trusty",
+		"trusty-updates",
+		"trusty-backports",
+		"xenial",
+		"xenial-updates",
+		"xenial-backports",
+		"bionic",
+		"bionic-updates",
+		"bionic-backports",
+		"focal",
+		"focal-updates",
+		"focal-backports",
+		"jammy",
+		"jammy-updates",
+		"jammy-backports",
+		"noble",
+		"noble-updates",
+		"noble-backports",
+	},
+	DefaultSuite: "noble",
+	Layout: Layout{
+		ContentsPerComponent:  false,
+		PreferredArchitecture: "amd64",
+		TrackerURL:            "https://launchpad.net/ubuntu/+source/%[2]s",
+		SnapshotURL:           "https://launchpad.net/ubuntu/+source/%[1]s/%[2]s",
+		BugURL:                "https://bugs.launchpad.net/bugs/%[1]d",
+	},
+}
+
+var builtin = map[string]*Profile{
+	"debian": Debian,
+	"ubuntu": Ubuntu,
+}
+
+// Load returns the built-in profile called nameOrPath (e.g. “debian”),
+// or reads a JSON-encoded profile from the file nameOrPath.
+func Load(nameOrPath string) (*Profile, error) {
+	if p, ok := builtin[nameOrPath]; ok {
+		return p, nil
+	}
+	f, err := os.Open(nameOrPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%q is neither a built-in distribution profile (debian, ubuntu) nor a file: %v", nameOrPath, err)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var p Profile
+	if err := json.NewDecoder(f).Decode(&p); err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", nameOrPath, err)
+	}
+	if p.Name == "" {
+		return nil, fmt.Errorf("parsing %q: name must not be empty", nameOrPath)
+	}
+	if p.Layout.PreferredArchitecture == "" {
+		p.Layout.PreferredArchitecture = Debian.Layout.PreferredArchitecture
+	}
+	return &p, nil
+}
+
+var current = Debian
+
+// Current returns the profile set by Set, Debian by default.
+func Current() *Profile {
+	return current
+}
+
+// Set makes p the profile returned by Current. It must be called
+// before any goroutines using Current are started.
+func Set(p *Profile) {
+	current = p
+}
+
+// WithSuites returns a copy of p which orders suites according to
+// suites (from oldest to newest) and defaults to defaultSuite. Empty
+// arguments retain the values of p.
+func (p *Profile) WithSuites(suites []string, defaultSuite string) *Profile {
+	c := &Profile{
+		Name:         p.Name,
+		Suites:       p.Suites,
+		Aliases:      p.Aliases,
+		DefaultSuite: p.DefaultSuite,
+		Layout:       p.Layout,
+	}
+	if len(suites) > 0 {
+		c.Suites = suites
+	}
+	if defaultSuite != "" {
+		c.DefaultSuite = defaultSuite
+	}
+	return c
+}
+
+func (p *Profile) initOrder() {
+	p.order = make(map[string]int, len(p.Suites)+len(p.Aliases))
+	for idx, s := range p.Suites {
+		p.order[s] = idx
+	}
+	for alias, s := range p.Aliases {
+		if _, ok := p.order[alias]; ok {
+			// The alias is a suite itself (e.g. “testing” when
+			// synchronizing suites instead of codenames), whose
+			// position takes precedence.
+			continue
+		}
+		if idx, ok := p.order[s]; ok {
+			p.order[alias] = idx
+		}
+	}
+}
+
+// SuiteLess reports whether suite a sorts before suite b, i.e. is
+// older.
+func (p *Profile) SuiteLess(a, b string) bool {
+	p.orderOnce.Do(p.initOrder)
+	orderA, okA := p.order[a]
+	orderB, okB := p.order[b]
+	switch {
+	case okA && okB:
+		return orderA < orderB
+	case okA != okB:
+		// Known suites sort before unknown suites.
+		return okA
+	default:
+		return a < b
+	}
+}
+
+// SortSuites sorts suites from oldest to newest.
+func (p *Profile) SortSuites(suites []string) {
+	sort.SliceStable(suites, func(i, j int) bool {
+		return p.SuiteLess(suites[i], suites[j])
+	})
+}
+
+// TrackerURL returns the package tracker URL for the specified
+// package, or the empty string if the distribution has no tracker.
+func (p *Profile) TrackerURL(binarypkg, sourcepkg string) string {
+	if p.Layout.TrackerURL == "" {
+		return ""
+	}
+	return fmt.Sprintf(p.Layout.TrackerURL, binarypkg, sourcepkg)
+}
+
+// SnapshotURL returns the URL for the specified package version, or
+// the empty string if the distribution has no such URLs.
+func (p *Profile) SnapshotURL(sourcepkg, version string) string {
+	if p.Layout.SnapshotURL == "" {
+		return ""
+	}
+	return fmt.Sprintf(p.Layout.SnapshotURL, sourcepkg, version)
+}
+
+// BugURL returns the URL of the specified bug, or the empty string if
+// the distribution has no bug tracker.
+func (p *Profile) BugURL(bug int) string {
+	if p.Layout.BugURL == "" {
+		return ""
+	}
+	return fmt.Sprintf(p.Layout.BugURL, bug)
+}
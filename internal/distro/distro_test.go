@@ -0,0 +1,94 @@
+package distro
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSortSuites(t *testing.T) {
+	suites := []string{"unstable", "zesty", "testing", "jessie", "custom", "stretch-backports", "sid"}
+	Debian.SortSuites(suites)
+	want := []string{"jessie", "stretch-backports", "testing", "unstable", "sid", "custom", "zesty"}
+	if !reflect.DeepEqual(suites, want) {
+		t.Fatalf("unexpected order: got %v, want %v", suites, want)
+	}
+}
+
+func TestWithSuitesOverridesAliases(t *testing.T) {
+	// As derived from the Release files of -sync_codenames=stretch,buster
+	// and -sync_suites=testing, with testing at the time being stretch.
+	p := (&Profile{Aliases: map[string]string{"testing": "stretch"}}).
+		WithSuites([]string{"stretch", "buster", "testing"}, "buster")
+	suites := []string{"testing", "buster", "stretch"}
+	p.SortSuites(suites)
+	want := []string{"stretch", "buster", "testing"}
+	if !reflect.DeepEqual(suites, want) {
+		t.Fatalf("unexpected order: got %v, want %v", suites, want)
+	}
+}
+
+func TestURLs(t *testing.T) {
+	if got, want := Debian.TrackerURL("i3-wm", "i3-wm-src"), "https://tracker.debian.org/pkg/i3-wm"; got != want {
+		t.Errorf("Debian.TrackerURL() = %q, want %q", got, want)
+	}
+	if got, want := Ubuntu.TrackerURL("i3-wm", "i3-wm-src"), "https://launchpad.net/ubuntu/+source/i3-wm-src"; got != want {
+		t.Errorf("Ubuntu.TrackerURL() = %q, want %q", got, want)
+	}
+	if got, want := Debian.SnapshotURL("i3-wm", "4.13-1"), "http://snapshot.debian.org/package/i3-wm/4.13-1/"; got != want {
+		t.Errorf("Debian.SnapshotURL() = %q, want %q", got, want)
+	}
+	if got, want := (&Profile{}).TrackerURL("i3-wm", "i3-wm"), ""; got != want {
+		t.Errorf("TrackerURL() without tracker = %q, want %q", got, want)
+	}
+	if got, want := Debian.BugURL(123456), "https://bugs.debian.org/123456"; got != want {
+		t.Errorf("Debian.BugURL() = %q, want %q", got, want)
+	}
+	if got, want := Ubuntu.BugURL(123456), "https://bugs.launchpad.net/bugs/123456"; got != want {
+		t.Errorf("Ubuntu.BugURL() = %q, want %q", got, want)
+	}
+	if got, want := (&Profile{}).BugURL(123456), ""; got != want {
+		t.Errorf("BugURL() without bug tracker = %q, want %q", got, want)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if p, err := Load("ubuntu"); err != nil || p != Ubuntu {
+		t.Fatalf("Load(ubuntu) = %v, %v; want Ubuntu", p, err)
+	}
+
+	dir, err := ioutil.TempDir("", "distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acme.json")
+	if err := ioutil.WriteFile(path, []byte(`{
+  "name": "Acme Linux",
+  "suites": ["old", "current", "next"],
+  "aliases": {"stable": "current"},
+  "default_suite": "current",
+  "layout": {"contents_per_component": true}
+}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := p.Name, "Acme Linux"; got != want {
+		t.Errorf("unexpected name: got %q, want %q", got, want)
+	}
+	if got, want := p.Layout.PreferredArchitecture, "amd64"; got != want {
+		t.Errorf("unexpected preferred architecture: got %q, want %q", got, want)
+	}
+	if !p.SuiteLess("stable", "next") || p.SuiteLess("next", "old") {
+		t.Errorf("suites not ordered according to the profile")
+	}
+
+	if _, err := Load(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Errorf("Load(nonexistent) unexpectedly succeeded")
+	}
+}
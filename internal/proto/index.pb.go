@@ -78,10 +78,14 @@ func (m *IndexEntry) GetLanguage() string {
 }
 
 type Index struct {
-	Entry    []*IndexEntry     `protobuf:"bytes,1,rep,name=entry" json:"entry,omitempty"`
-	Language []string          `protobuf:"bytes,2,rep,name=language" json:"language,omitempty"`
-	Suite    map[string]string `protobuf:"bytes,3,rep,name=suite" json:"suite,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
-	Section  []string          `protobuf:"bytes,4,rep,name=section" json:"section,omitempty"`
+	Entry        []*IndexEntry     `protobuf:"bytes,1,rep,name=entry" json:"entry,omitempty"`
+	Language     []string          `protobuf:"bytes,2,rep,name=language" json:"language,omitempty"`
+	Suite        map[string]string `protobuf:"bytes,3,rep,name=suite" json:"suite,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Section      []string          `protobuf:"bytes,4,rep,name=section" json:"section,omitempty"`
+	SuiteOrder   []string          `protobuf:"bytes,5,rep,name=suite_order,json=suiteOrder" json:"suite_order,omitempty"`
+	DefaultSuite string            `protobuf:"bytes,6,opt,name=default_suite,json=defaultSuite" json:"default_suite,omitempty"`
+	PrintSuite   []string          `protobuf:"bytes,7,rep,name=print_suite,json=printSuite" json:"print_suite,omitempty"`
+	PrintFormat  []string          `protobuf:"bytes,8,rep,name=print_format,json=printFormat" json:"print_format,omitempty"`
 }
 
 func (m *Index) Reset()                    { *m = Index{} }
@@ -117,6 +121,34 @@ func (m *Index) GetSection() []string {
 	return nil
 }
 
+func (m *Index) GetSuiteOrder() []string {
+	if m != nil {
+		return m.SuiteOrder
+	}
+	return nil
+}
+
+func (m *Index) GetDefaultSuite() string {
+	if m != nil {
+		return m.DefaultSuite
+	}
+	return ""
+}
+
+func (m *Index) GetPrintSuite() []string {
+	if m != nil {
+		return m.PrintSuite
+	}
+	return nil
+}
+
+func (m *Index) GetPrintFormat() []string {
+	if m != nil {
+		return m.PrintFormat
+	}
+	return nil
+}
+
 func init() {
 	proto1.RegisterType((*IndexEntry)(nil), "proto.IndexEntry")
 	proto1.RegisterType((*Index)(nil), "proto.Index")
@@ -125,20 +157,24 @@ func init() {
 func init() { proto1.RegisterFile("index.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 235 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x54, 0x90, 0x3d, 0x4e, 0xc4, 0x30,
-	0x10, 0x85, 0xe5, 0x78, 0x0d, 0xec, 0x6c, 0x03, 0x23, 0x24, 0xac, 0x15, 0x45, 0xb4, 0x0d, 0xdb,
-	0x90, 0x02, 0x9a, 0x88, 0x9e, 0x82, 0x36, 0x9c, 0xc0, 0x01, 0x2b, 0xb2, 0x12, 0x9c, 0x28, 0x71,
-	0x10, 0xb9, 0x02, 0x97, 0xe3, 0x4a, 0xc8, 0xe3, 0xfc, 0x56, 0x9e, 0x37, 0xcf, 0x7a, 0xfe, 0xfc,
-	0xe0, 0x60, 0xec, 0xa7, 0xfe, 0x49, 0x9a, 0xb6, 0x76, 0x35, 0x0a, 0x3a, 0x4e, 0xbf, 0x0c, 0xe0,
-	0xcd, 0xaf, 0x5f, 0xad, 0x6b, 0x07, 0x44, 0xd8, 0x59, 0xf5, 0xa5, 0x25, 0x8b, 0xd9, 0x79, 0x9f,
-	0xd1, 0x8c, 0xb7, 0x20, 0xba, 0xde, 0x38, 0x2d, 0x23, 0x5a, 0x06, 0x81, 0xf7, 0xb0, 0xcf, 0x8d,
-	0x55, 0xed, 0xd0, 0x94, 0x85, 0xe4, 0xe4, 0x2c, 0x0b, 0x94, 0x70, 0xd9, 0xe9, 0x0f, 0x67, 0x6a,
-	0x2b, 0x77, 0xe4, 0x4d, 0x12, 0x8f, 0x70, 0x55, 0x29, 0x5b, 0xf4, 0xaa, 0xd0, 0x52, 0x90, 0x35,
-	0xeb, 0xd3, 0x1f, 0x03, 0x41, 0x30, 0xf8, 0x00, 0x42, 0x7b, 0x20, 0xc9, 0x62, 0x7e, 0x3e, 0x3c,
-	0xdd, 0x04, 0xe8, 0x64, 0x21, 0xcd, 0x82, 0xbf, 0x89, 0x8b, 0x62, 0xbe, 0x8e, 0xc3, 0xc7, 0x09,
-	0x9c, 0x53, 0xc8, 0xdd, 0x3a, 0x24, 0x79, 0xf7, 0xce, 0x18, 0x15, 0x7e, 0xb4, 0x61, 0xe6, 0x2b,
-	0xe6, 0x63, 0x0a, 0xb0, 0x5c, 0xc7, 0x6b, 0xe0, 0xa5, 0x1e, 0xc6, 0x8a, 0xfc, 0xe8, 0x1b, 0xfa,
-	0x56, 0x55, 0x3f, 0x37, 0x44, 0xe2, 0x25, 0x4a, 0x59, 0x7e, 0x41, 0x4f, 0x3e, 0xff, 0x07, 0x00,
-	0x00, 0xff, 0xff, 0xe2, 0xe5, 0x32, 0xf9, 0x7b, 0x01, 0x00, 0x00,
+	// 298 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x54, 0x51, 0xcd, 0x4a, 0xf3, 0x40,
+	0x14, 0x25, 0x99, 0x4e, 0x7f, 0x6e, 0xfb, 0xc1, 0xe7, 0x45, 0x70, 0x28, 0x82, 0xb1, 0x2e, 0xec,
+	0xc6, 0x2c, 0x74, 0x53, 0xdc, 0x2b, 0xb8, 0x12, 0xea, 0x03, 0x94, 0xa9, 0x99, 0x86, 0xd0, 0x74,
+	0x12, 0xa6, 0x13, 0x31, 0xaf, 0xe0, 0x1b, 0xfa, 0x36, 0x32, 0x77, 0x92, 0x26, 0x5d, 0x65, 0xce,
+	0x4f, 0xce, 0x3d, 0x97, 0x0b, 0xd3, 0x4c, 0x27, 0xea, 0x3b, 0x2e, 0x4d, 0x61, 0x0b, 0xe4, 0xf4,
+	0x59, 0xfc, 0x04, 0x00, 0x6f, 0x8e, 0x7e, 0xd1, 0xd6, 0xd4, 0x88, 0x30, 0xd0, 0xf2, 0xa0, 0x44,
+	0x10, 0x05, 0xcb, 0xc9, 0x9a, 0xde, 0x78, 0x09, 0xfc, 0x58, 0x65, 0x56, 0x89, 0x90, 0x48, 0x0f,
+	0xf0, 0x1a, 0x26, 0xdb, 0x4c, 0x4b, 0x53, 0x97, 0xfb, 0x54, 0x30, 0x52, 0x3a, 0x02, 0x05, 0x8c,
+	0x8e, 0xea, 0xd3, 0x66, 0x85, 0x16, 0x03, 0xd2, 0x5a, 0x88, 0x73, 0x18, 0xe7, 0x52, 0xa7, 0x95,
+	0x4c, 0x95, 0xe0, 0x24, 0x9d, 0xf0, 0xe2, 0x37, 0x04, 0x4e, 0x65, 0xf0, 0x1e, 0xb8, 0x72, 0x85,
+	0x44, 0x10, 0xb1, 0xe5, 0xf4, 0xf1, 0xc2, 0x97, 0x8e, 0xbb, 0xa6, 0x6b, 0xaf, 0x9f, 0xc5, 0x85,
+	0x11, 0xeb, 0xc7, 0xe1, 0x43, 0x5b, 0x9c, 0x51, 0xc8, 0x55, 0x3f, 0x24, 0xfe, 0x70, 0x4a, 0x13,
+	0xe5, 0x37, 0x3a, 0xeb, 0xcc, 0xfa, 0x9d, 0x6f, 0x60, 0x4a, 0x96, 0x4d, 0x61, 0x12, 0x65, 0x04,
+	0x27, 0x15, 0x88, 0x7a, 0x77, 0x0c, 0xde, 0xc1, 0xbf, 0x44, 0xed, 0x64, 0x95, 0xdb, 0x8d, 0x9f,
+	0x38, 0xa4, 0xcd, 0x66, 0x0d, 0x49, 0xb3, 0x5c, 0x4a, 0x69, 0x32, 0xdd, 0x5a, 0x46, 0x3e, 0x85,
+	0x28, 0x6f, 0xb8, 0x85, 0x99, 0x37, 0xec, 0x0a, 0x73, 0x90, 0x56, 0x8c, 0xc9, 0xe1, 0x7f, 0x7a,
+	0x25, 0x6a, 0xbe, 0x02, 0xe8, 0x8a, 0xe3, 0x7f, 0x60, 0x7b, 0x55, 0x37, 0xc7, 0x72, 0x4f, 0x77,
+	0xab, 0x2f, 0x99, 0x57, 0xa7, 0x5b, 0x11, 0x78, 0x0e, 0x57, 0xc1, 0x76, 0x48, 0xcb, 0x3f, 0xfd,
+	0x0d, 0x00, 0xf0, 0x8b, 0xa8, 0x0f, 0x05, 0x02, 0x00, 0x00,
 }
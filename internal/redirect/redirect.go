@@ -7,8 +7,10 @@ import (
 	"net/http"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/stapelberg/debiman/internal/distro"
 	pb "github.com/stapelberg/debiman/internal/proto"
 	"github.com/stapelberg/debiman/internal/tag"
 	"github.com/golang/protobuf/proto"
@@ -32,12 +34,38 @@ type Index struct {
 	Suites   map[string]string
 	Langs    map[string]bool
 	Sections map[string]bool
+
+	// SuiteOrder lists all suites from oldest to newest. Empty for
+	// indexes written by older debiman versions.
+	SuiteOrder []string
+
+	// DefaultSuite is the suite to redirect to if the request does
+	// not specify a suite. If empty, the default suite of the
+	// distribution profile is used.
+	DefaultSuite string
+
+	// PrintSuites contains the suites in which the printable
+	// versions of all manpages exist, in each of PrintFormats (e.g.
+	// “pdf”). Elsewhere, they only exist once a manpage was rendered
+	// after enabling them, so they are not redirected to.
+	PrintSuites  map[string]bool
+	PrintFormats map[string]bool
 }
 
-// TODO(later): the default suite should be the latest stable release
-const defaultSuite = "stretch"
 const defaultLanguage = "en"
 
+// unreleasedSuites contain packages which are not meant to be installed
+// by default, e.g. experimental. They are only redirected to if the
+// manpage is not available in any other suite.
+var unreleasedSuites = map[string]bool{
+	"experimental": true,
+	"rc-buggy":     true,
+}
+
+func (i Index) unreleased(suite string) bool {
+	return unreleasedSuites[suite] || unreleasedSuites[i.Suites[suite]]
+}
+
 // bestLanguageMatch is like bestLanguageMatch in rendermanpage.go, but for the redirector index. TODO: can we de-duplicate the code?
 func bestLanguageMatch(t []language.Tag, options []IndexEntry) IndexEntry {
 	// ensure that en comes first, so that language.Matcher treats it as default
@@ -239,8 +267,12 @@ func (i Index) Narrow(acceptLang string, template, ref IndexEntry, entries []Ind
 				break
 			}
 		}
-		// Default to defaultSuite
+		// Default to the distribution’s default suite
 		if t.Suite == "" {
+			defaultSuite := i.DefaultSuite
+			if defaultSuite == "" {
+				defaultSuite = distro.Current().DefaultSuite
+			}
 			for _, e := range filtered {
 				if e.Suite == defaultSuite {
 					t.Suite = defaultSuite
@@ -248,12 +280,29 @@ func (i Index) Narrow(acceptLang string, template, ref IndexEntry, entries []Ind
 				}
 			}
 		}
-		// If the manpage is not contained in defaultSuite, use the
-		// first suite we can find for which the manpage is available.
+		// If the manpage is not contained in the default suite, use the
+		// newest suite in which the manpage is available, or the
+		// first suite we can find if the suite order is unknown.
+		// Unreleased suites (e.g. experimental) are used last.
 		if t.Suite == "" {
+			rank := make(map[string]int, len(i.SuiteOrder))
+			for idx, s := range i.SuiteOrder {
+				rank[s] = idx + 1
+				if !i.unreleased(s) {
+					rank[s] += len(i.SuiteOrder)
+				}
+			}
+			best := -1
 			for _, e := range filtered {
-				t.Suite = e.Suite
-				break
+				r := rank[e.Suite]
+				if r == 0 && !i.unreleased(e.Suite) {
+					// Unknown suites rank after all unreleased suites.
+					r = len(i.SuiteOrder) + 1
+				}
+				if r > best {
+					best = r
+					t.Suite = e.Suite
+				}
 			}
 		}
 	}
@@ -332,6 +381,29 @@ func (e *NotFoundError) Error() string {
 	return "No such man page"
 }
 
+// prefersText returns whether the Accept header accept prefers
+// text/plain over text/html, e.g. for curl -H 'Accept: text/plain'.
+// Wildcards are ignored, so that browsers get HTML.
+func prefersText(accept string) bool {
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if f, err := strconv.ParseFloat(param[len("q="):], 64); err == nil {
+				q = f
+			}
+		}
+		quality[mediaType] = q
+	}
+	return quality["text/plain"] > quality["text/html"]
+}
+
 func (i Index) Redirect(r *http.Request) (string, error) {
 	path := r.URL.Path
 
@@ -342,13 +414,28 @@ func (i Index) Redirect(r *http.Request) (string, error) {
 	}
 
 	suffix := ".html"
-	// If a raw manpage was requested, redirect to raw, not HTML
-	if strings.HasSuffix(path, ".gz") && !strings.HasSuffix(path, ".html.gz") {
+	switch {
+	case strings.HasSuffix(path, ".txt") || strings.HasSuffix(path, ".txt.gz"):
+		suffix = ".txt"
+	case strings.HasSuffix(path, ".pdf"):
+		// Printable versions are kept, like raw manpages
+		suffix = ".pdf"
+	case strings.HasSuffix(path, ".ps") || strings.HasSuffix(path, ".ps.gz"):
+		suffix = ".ps"
+	case strings.HasSuffix(path, ".gz") && !strings.HasSuffix(path, ".html.gz"):
+		// If a raw manpage was requested, redirect to raw, not HTML
 		suffix = ".gz"
-	}
-	for strings.HasSuffix(path, ".html") || strings.HasSuffix(path, ".gz") {
-		path = strings.TrimSuffix(path, ".gz")
-		path = strings.TrimSuffix(path, ".html")
+	case !strings.HasSuffix(path, ".html") && prefersText(r.Header.Get("Accept")):
+		suffix = ".txt"
+	}
+	for trimmed := true; trimmed; {
+		trimmed = false
+		for _, trim := range []string{".gz", ".html", ".txt", ".pdf", ".ps"} {
+			if strings.HasSuffix(path, trim) {
+				path = strings.TrimSuffix(path, trim)
+				trimmed = true
+			}
+		}
 	}
 
 	// Parens are converted into dots, so that “i3(1)” becomes
@@ -414,14 +501,23 @@ func (i Index) Redirect(r *http.Request) (string, error) {
 			BestChoice: best}
 	}
 
+	if (suffix == ".pdf" || suffix == ".ps") &&
+		(!i.PrintFormats[strings.TrimPrefix(suffix, ".")] || !i.PrintSuites[filtered[0].Suite]) {
+		// The printable version might not exist: redirect to the
+		// HTML page, which links to it if it does.
+		suffix = ".html"
+	}
+
 	return filtered[0].ServingPath(suffix), nil
 }
 
 func IndexFromProto(path string) (Index, error) {
 	index := Index{
-		Langs:    make(map[string]bool),
-		Sections: make(map[string]bool),
-		Suites:   make(map[string]string),
+		Langs:        make(map[string]bool),
+		Sections:     make(map[string]bool),
+		Suites:       make(map[string]string),
+		PrintSuites:  make(map[string]bool),
+		PrintFormats: make(map[string]bool),
 	}
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -446,10 +542,18 @@ func IndexFromProto(path string) (Index, error) {
 		index.Langs[l] = true
 	}
 	index.Suites = idx.Suite
+	index.SuiteOrder = idx.SuiteOrder
+	index.DefaultSuite = idx.DefaultSuite
 	for _, l := range idx.Section {
 		index.Sections[l] = true
 	}
 	index.Sections["0"] = true
+	for _, s := range idx.PrintSuite {
+		index.PrintSuites[s] = true
+	}
+	for _, f := range idx.PrintFormat {
+		index.PrintFormats[f] = true
+	}
 
 	return index, nil
 }
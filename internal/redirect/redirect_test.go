@@ -42,6 +42,15 @@ var testIdx = Index{
 		// TODO: where can we get historical release names from?
 	},
 
+	PrintSuites: map[string]bool{
+		"testing": true,
+	},
+
+	PrintFormats: map[string]bool{
+		"pdf": true,
+		"ps":  true,
+	},
+
 	Entries: map[string][]IndexEntry{
 		"i3": []IndexEntry{
 			{
@@ -582,6 +591,11 @@ func TestRawManpageRedirect(t *testing.T) {
 		want string
 	}{
 		{URL: "stretch/i3-wm/i3.1.en.gz", want: "testing/i3-wm/i3.1.en.gz"},
+		{URL: "stretch/i3-wm/i3.1.en.pdf", want: "testing/i3-wm/i3.1.en.pdf"},
+		{URL: "stretch/i3-wm/i3.1.en.ps.gz", want: "testing/i3-wm/i3.1.en.ps"},
+		// Printable versions only exist in -print_suites.
+		{URL: "i3.pdf", want: "jessie/i3-wm/i3.1.en.html"},
+		{URL: "jessie/i3-wm/i3.1.en.ps", want: "jessie/i3-wm/i3.1.en.html"},
 	}
 	for _, entry := range table {
 		entry := entry // capture
@@ -607,6 +621,46 @@ func TestRawManpageRedirect(t *testing.T) {
 	}
 }
 
+func TestTextRedirect(t *testing.T) {
+	table := []struct {
+		URL    string
+		accept string
+		want   string
+	}{
+		{URL: "stretch/i3-wm/i3.1.en.txt", want: "testing/i3-wm/i3.1.en.txt"},
+		{URL: "stretch/i3-wm/i3.1.en.txt.gz", want: "testing/i3-wm/i3.1.en.txt"},
+		{URL: "i3.txt", want: "jessie/i3-wm/i3.1.en.txt"},
+		{URL: "i3", accept: "text/plain", want: "jessie/i3-wm/i3.1.en.txt"},
+		{URL: "i3", accept: "text/html;q=0.9, text/plain", want: "jessie/i3-wm/i3.1.en.txt"},
+		{URL: "i3", accept: "text/html,application/xhtml+xml,*/*;q=0.8", want: "jessie/i3-wm/i3.1.en.html"},
+		{URL: "i3", accept: "*/*", want: "jessie/i3-wm/i3.1.en.html"},
+		{URL: "i3.1.en.html", accept: "text/plain", want: "jessie/i3-wm/i3.1.en.html"},
+	}
+	for _, entry := range table {
+		entry := entry // capture
+		t.Run(entry.URL+" "+entry.accept, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := url.Parse("http://man.debian.org/" + entry.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{
+				URL:    u,
+				Header: http.Header{"Accept": []string{entry.accept}},
+			}
+			got, err := testIdx.Redirect(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "/" + entry.want
+			if got != want {
+				t.Fatalf("Unexpected redirect: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
 func TestBlankRedirect(t *testing.T) {
 	table := []struct {
 		URL  string
@@ -645,3 +699,56 @@ func TestBlankRedirect(t *testing.T) {
 // 	URL:  "http://man.debian.org/lenny/i3",
 // 	want: "http://man.debian.org/wheezy/i3-wm/i3.1.en.html",
 // },
+
+func TestSuiteOrderFromIndex(t *testing.T) {
+	idx := Index{
+		Langs:    map[string]bool{"en": true},
+		Sections: map[string]bool{"1": true},
+		Suites: map[string]string{
+			"jessie":       "jessie",
+			"stretch":      "stretch",
+			"buster":       "buster",
+			"experimental": "experimental",
+			"rc-buggy":     "experimental",
+		},
+		SuiteOrder:   []string{"jessie", "stretch", "buster", "experimental"},
+		DefaultSuite: "jessie",
+		Entries: map[string][]IndexEntry{
+			"i3": []IndexEntry{
+				{Name: "i3", Suite: "stretch", Binarypkg: "i3-wm", Section: "1", Language: "en"},
+				{Name: "i3", Suite: "jessie", Binarypkg: "i3-wm", Section: "1", Language: "en"},
+				{Name: "i3", Suite: "buster", Binarypkg: "i3-wm", Section: "1", Language: "en"},
+			},
+			"sway": []IndexEntry{
+				{Name: "sway", Suite: "experimental", Binarypkg: "sway", Section: "1", Language: "en"},
+				{Name: "sway", Suite: "buster", Binarypkg: "sway", Section: "1", Language: "en"},
+				{Name: "sway", Suite: "stretch", Binarypkg: "sway", Section: "1", Language: "en"},
+			},
+			"swaylock": []IndexEntry{
+				{Name: "swaylock", Suite: "experimental", Binarypkg: "swaylock", Section: "1", Language: "en"},
+			},
+		},
+	}
+	table := []struct {
+		URL  string
+		want string
+	}{
+		{URL: "i3", want: "jessie/i3-wm/i3.1.en.html"},    // default suite
+		{URL: "sway", want: "buster/sway/sway.1.en.html"}, // newest released suite
+		{URL: "swaylock", want: "experimental/swaylock/swaylock.1.en.html"},
+		{URL: "stretch/sway", want: "stretch/sway/sway.1.en.html"},
+	}
+	for _, entry := range table {
+		u, err := url.Parse("http://man.debian.org/" + entry.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := idx.Redirect(&http.Request{URL: u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "/" + entry.want; got != want {
+			t.Fatalf("%s: unexpected redirect: got %q, want %q", entry.URL, got, want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/stapelberg/debiman/internal/write"
+)
+
+// Local stores files on local disk.
+type Local struct{}
+
+func (Local) Write(path string, compress bool, w func(w io.Writer) error) error {
+	return write.Atomically(path, compress, w)
+}
+
+func (Local) WriteWithGz(path string, gzipw *gzip.Writer, w func(w io.Writer) error) error {
+	return write.AtomicallyWithGz(path, gzipw, w)
+}
+
+func (Local) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (Local) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (Local) Lstat(path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (Local) ReadDir(dir string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dir)
+}
+
+func (Local) OpenDir(dir string) (Dir, error) {
+	return os.Open(dir)
+}
+
+func (Local) ReadDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+func (Local) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (Local) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (Local) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (Local) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(name, mtime, mtime)
+}
+
+func (Local) MkdirAll(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+func (Local) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
@@ -0,0 +1,613 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	headerMtime    = "X-Amz-Meta-Mtime"
+	headerSymlink  = "X-Amz-Meta-Symlink"
+	headerRedirect = "X-Amz-Website-Redirect-Location"
+)
+
+// defaultClient is used if S3.Client is nil. Its timeout covers the
+// whole request, including reading the response body.
+var defaultClient = &http.Client{Timeout: 1 * time.Minute}
+
+// maxAttempts is the number of times a request is sent before giving
+// up on network errors and server errors (e.g. 503 SlowDown).
+const maxAttempts = 5
+
+// retryDelay is the delay before the first retry, which is doubled for
+// every further attempt.
+var retryDelay = 500 * time.Millisecond
+
+// maxSymlinks is the maximum number of symlinks which are followed when
+// resolving a path, like MAXSYMLINKS on Linux.
+const maxSymlinks = 40
+
+// S3 stores files in a bucket of S3-compatible object storage (e.g.
+// Amazon S3 or MinIO), using path-style requests.
+//
+// Directories are implicit: a directory exists while it contains
+// objects. Symlinks are stored as empty redirect objects, whose
+// destination is set as website redirect location, so that a bucket
+// which is configured for website hosting serves them as HTTP
+// redirects. Modification times are stored as object metadata, as the
+// Last-Modified time of an object cannot be set.
+type S3 struct {
+	// Root is the directory which corresponds to Prefix, i.e. the
+	// object key of a path is Prefix followed by the path relative
+	// to Root.
+	Root string
+
+	// Endpoint is the base URL of the object storage, e.g.
+	// https://s3.amazonaws.com.
+	Endpoint string
+	Region   string
+	Bucket   string
+	Prefix   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Client is used for all requests. If nil, a client with a
+	// timeout of one minute is used.
+	Client *http.Client
+}
+
+func (s *S3) key(op, p string) (string, error) {
+	rel, err := filepath.Rel(s.Root, p)
+	if err != nil {
+		return "", &os.PathError{Op: op, Path: p, Err: err}
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", &os.PathError{Op: op, Path: p, Err: fmt.Errorf("not underneath %q", s.Root)}
+	}
+	if rel == "." {
+		rel = ""
+	}
+	return strings.Trim(path.Join(s.Prefix, rel), "/"), nil
+}
+
+// rootKey returns the key of Root, which always exists as a directory.
+func (s *S3) rootKey() string {
+	return strings.Trim(s.Prefix, "/")
+}
+
+// dirPrefix returns the prefix of all object keys within the directory
+// whose key is key.
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+// do sends a request for key, retrying with exponential backoff on
+// network errors and server errors. After the last attempt, the error
+// or response is returned as is.
+func (s *S3) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + key
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = query.Encode()
+	payloadHash := fmt.Sprintf("%x", sha256.Sum256(body))
+	client := s.Client
+	if client == nil {
+		client = defaultClient
+	}
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		signV4(req, s.AccessKeyID, s.SecretAccessKey, s.Region, payloadHash, time.Now())
+		resp, err := client.Do(req)
+		if attempt == maxAttempts ||
+			err == nil && resp.StatusCode < 500 {
+			return resp, err
+		}
+		if err == nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// check returns an error if resp indicates that the request failed and
+// closes resp.Body in that case.
+func check(resp *http.Response, op, p string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &os.PathError{Op: op, Path: p, Err: fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))}
+}
+
+type objectInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (o *objectInfo) Name() string       { return o.name }
+func (o *objectInfo) Size() int64        { return o.size }
+func (o *objectInfo) Mode() os.FileMode  { return o.mode }
+func (o *objectInfo) ModTime() time.Time { return o.mtime }
+func (o *objectInfo) IsDir() bool        { return o.mode.IsDir() }
+func (o *objectInfo) Sys() interface{}   { return nil }
+
+func objectInfoFromHeader(name string, h http.Header, size int64) *objectInfo {
+	o := &objectInfo{name: name, size: size, mode: 0644}
+	if ns, err := strconv.ParseInt(h.Get(headerMtime), 10, 64); err == nil {
+		o.mtime = time.Unix(0, ns)
+	} else if t, err := http.ParseTime(h.Get("Last-Modified")); err == nil {
+		o.mtime = t
+	}
+	if h.Get(headerSymlink) != "" {
+		o.mode = os.ModeSymlink | 0777
+	}
+	return o
+}
+
+// symlinkTarget returns the path to which the symlink p with the object
+// header h points.
+func symlinkTarget(p string, h http.Header) (string, error) {
+	link, err := url.PathUnescape(h.Get(headerSymlink))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(p), link), nil
+}
+
+// head returns the header and size of the object at p, or a directory
+// header (with size -1) if p is a directory.
+func (s *S3) head(op, p string) (http.Header, int64, error) {
+	key, err := s.key(op, p)
+	if err != nil {
+		return nil, 0, err
+	}
+	if key != s.rootKey() {
+		resp, err := s.do("HEAD", key, nil, nil, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := check(resp, op, p); err == nil {
+			resp.Body.Close()
+			return resp.Header, resp.ContentLength, nil
+		} else if !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+	}
+	res, err := s.list(dirPrefix(key), "/", 1, "")
+	if err != nil {
+		return nil, 0, &os.PathError{Op: op, Path: p, Err: err}
+	}
+	if len(res.Contents) == 0 && len(res.CommonPrefixes) == 0 && key != s.rootKey() {
+		return nil, 0, &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+	}
+	return nil, -1, nil
+}
+
+// resolve follows symlinks until p refers to an object or directory.
+func (s *S3) resolve(op, p string) (string, http.Header, int64, error) {
+	for i := 0; i < maxSymlinks; i++ {
+		h, size, err := s.head(op, p)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		if h.Get(headerSymlink) == "" {
+			return p, h, size, nil
+		}
+		if p, err = symlinkTarget(p, h); err != nil {
+			return "", nil, 0, &os.PathError{Op: op, Path: p, Err: err}
+		}
+	}
+	return "", nil, 0, &os.PathError{Op: op, Path: p, Err: syscall.ELOOP}
+}
+
+func info(p string, h http.Header, size int64) os.FileInfo {
+	if size == -1 {
+		return &objectInfo{name: filepath.Base(p), mode: os.ModeDir | 0755}
+	}
+	return objectInfoFromHeader(filepath.Base(p), h, size)
+}
+
+func (s *S3) Stat(p string) (os.FileInfo, error) {
+	resolved, h, size, err := s.resolve("stat", p)
+	if err != nil {
+		return nil, err
+	}
+	fi := info(resolved, h, size)
+	fi.(*objectInfo).name = filepath.Base(p)
+	return fi, nil
+}
+
+func (s *S3) Lstat(p string) (os.FileInfo, error) {
+	h, size, err := s.head("lstat", p)
+	if err != nil {
+		return nil, err
+	}
+	return info(p, h, size), nil
+}
+
+func (s *S3) Readlink(name string) (string, error) {
+	h, _, err := s.head("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if h.Get(headerSymlink) == "" {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: syscall.EINVAL}
+	}
+	return url.PathUnescape(h.Get(headerSymlink))
+}
+
+func (s *S3) Open(p string) (io.ReadCloser, error) {
+	for i := 0; i < maxSymlinks; i++ {
+		key, err := s.key("open", p)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do("GET", key, nil, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := check(resp, "open", p); err != nil {
+			return nil, err
+		}
+		if resp.Header.Get(headerSymlink) == "" {
+			return resp.Body, nil
+		}
+		resp.Body.Close()
+		if p, err = symlinkTarget(p, resp.Header); err != nil {
+			return nil, &os.PathError{Op: "open", Path: p, Err: err}
+		}
+	}
+	return nil, &os.PathError{Op: "open", Path: p, Err: syscall.ELOOP}
+}
+
+func (s *S3) put(op, p string, header http.Header, body []byte) error {
+	key, err := s.key(op, p)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	if header.Get(headerMtime) == "" && header.Get("X-Amz-Copy-Source") == "" {
+		header.Set(headerMtime, strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
+	resp, err := s.do("PUT", key, nil, header, body)
+	if err != nil {
+		return err
+	}
+	if err := check(resp, op, p); err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// Write stores the output of write in a single request, which replaces
+// the object atomically.
+func (s *S3) Write(p string, compress bool, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	if compress {
+		// NOTE(stapelberg): gzip’s decompression phase takes the same
+		// time, regardless of compression level. Hence, we invest the
+		// maximum CPU time once to achieve the best compression.
+		gzipw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		if err := write(gzipw); err != nil {
+			return err
+		}
+		if err := gzipw.Close(); err != nil {
+			return err
+		}
+	} else if err := write(&buf); err != nil {
+		return err
+	}
+	return s.put("write", p, nil, buf.Bytes())
+}
+
+func (s *S3) WriteWithGz(p string, gzipw *gzip.Writer, write func(w io.Writer) error) error {
+	var buf bytes.Buffer
+	gzipw.Reset(&buf)
+	if err := write(gzipw); err != nil {
+		return err
+	}
+	if err := gzipw.Close(); err != nil {
+		return err
+	}
+	return s.put("write", p, nil, buf.Bytes())
+}
+
+func (s *S3) Symlink(oldname, newname string) error {
+	if _, err := s.Lstat(newname); err == nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	target, err := s.key("symlink", filepath.Join(filepath.Dir(newname), oldname))
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	header.Set(headerSymlink, uriEncode(oldname, false))
+	header.Set(headerRedirect, "/"+uriEncode(target, false))
+	return s.put("symlink", newname, header, nil)
+}
+
+// copyObject copies the object at src to dest, replacing its metadata
+// with header if header is non-nil.
+func (s *S3) copyObject(op, src, dest string, header http.Header) error {
+	key, err := s.key(op, src)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		header = make(http.Header)
+		header.Set("X-Amz-Metadata-Directive", "COPY")
+	} else {
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	}
+	header.Set("X-Amz-Copy-Source", "/"+s.Bucket+"/"+uriEncode(key, false))
+	return s.put(op, dest, header, nil)
+}
+
+func (s *S3) Link(oldname, newname string) error {
+	if _, err := s.Lstat(newname); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return s.copyObject("link", oldname, newname, nil)
+}
+
+func (s *S3) Chtimes(name string, mtime time.Time) error {
+	resolved, h, size, err := s.resolve("chtimes", name)
+	if err != nil {
+		return err
+	}
+	if size == -1 {
+		return nil // directories have no modification time
+	}
+	header := make(http.Header)
+	for _, k := range []string{headerSymlink, headerRedirect, "Content-Type", "Content-Encoding"} {
+		if v := h.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	header.Set(headerMtime, strconv.FormatInt(mtime.UnixNano(), 10))
+	return s.copyObject("chtimes", resolved, resolved, header)
+}
+
+// MkdirAll does nothing, as directories are implicit.
+func (s *S3) MkdirAll(p string) error {
+	return nil
+}
+
+func (s *S3) RemoveAll(p string) error {
+	key, err := s.key("removeall", p)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	if key != s.rootKey() {
+		keys = append(keys, key)
+	}
+	var token string
+	for {
+		res, err := s.list(dirPrefix(key), "", 0, token)
+		if err != nil {
+			return &os.PathError{Op: "removeall", Path: p, Err: err}
+		}
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	for _, key := range keys {
+		resp, err := s.do("DELETE", key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		if err := check(resp, "removeall", p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns one page of the objects whose key starts with prefix
+// (see ListObjectsV2). If maxKeys is 0, the server’s default is used.
+func (s *S3) list(prefix, delimiter string, maxKeys int, token string) (*listBucketResult, error) {
+	query := url.Values{
+		"list-type": []string{"2"},
+		"prefix":    []string{prefix},
+	}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	resp, err := s.do("GET", "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := check(resp, "list", prefix); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var res listBucketResult
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// s3Dir lists a directory page by page, see OpenDir.
+type s3Dir struct {
+	s      *S3
+	dir    string
+	key    string
+	token  string
+	done   bool
+	listed bool // whether any entry was returned
+}
+
+// OpenDir returns a handle to list dir. Sizes and modification times
+// are taken from the listing, i.e. modification times are the times at
+// which objects were last written (see Storage). Empty objects are
+// requested individually to detect symlinks.
+func (s *S3) OpenDir(dir string) (Dir, error) {
+	key, err := s.key("readdir", dir)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Dir{s: s, dir: dir, key: key}, nil
+}
+
+func (d *s3Dir) Readdir(n int) ([]os.FileInfo, error) {
+	prefix := dirPrefix(d.key)
+	var infos []os.FileInfo
+	for !d.done && (n <= 0 || len(infos) < n) {
+		maxKeys := 0
+		if n > 0 {
+			maxKeys = n - len(infos)
+		}
+		res, err := d.s.list(prefix, "/", maxKeys, d.token)
+		if err != nil {
+			return infos, &os.PathError{Op: "readdir", Path: d.dir, Err: err}
+		}
+		for _, c := range res.Contents {
+			fi := &objectInfo{
+				name:  strings.TrimPrefix(c.Key, prefix),
+				size:  c.Size,
+				mode:  0644,
+				mtime: c.LastModified,
+			}
+			if c.Size == 0 {
+				p := filepath.Join(d.dir, fi.name)
+				h, size, err := d.s.head("readdir", p)
+				if os.IsNotExist(err) {
+					continue // removed since listing
+				}
+				if err != nil {
+					return infos, err
+				}
+				fi = info(p, h, size).(*objectInfo)
+			}
+			infos = append(infos, fi)
+		}
+		for _, c := range res.CommonPrefixes {
+			infos = append(infos, &objectInfo{
+				name: strings.TrimSuffix(strings.TrimPrefix(c.Prefix, prefix), "/"),
+				mode: os.ModeDir | 0755,
+			})
+		}
+		d.done = !res.IsTruncated
+		d.token = res.NextContinuationToken
+	}
+	if len(infos) > 0 {
+		d.listed = true
+		return infos, nil
+	}
+	if !d.listed && d.key != d.s.rootKey() {
+		d.listed = true
+		// Distinguish an empty listing of a file from a directory
+		// which does not exist.
+		if _, _, err := d.s.head("readdir", d.dir); err != nil {
+			return nil, err
+		}
+		return nil, &os.PathError{Op: "readdir", Path: d.dir, Err: syscall.ENOTDIR}
+	}
+	if n > 0 {
+		return nil, io.EOF
+	}
+	return nil, nil
+}
+
+func (d *s3Dir) Close() error {
+	return nil
+}
+
+func (s *S3) ReadDir(dir string) ([]os.FileInfo, error) {
+	d, err := s.OpenDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (s *S3) ReadDirNames(dir string) ([]string, error) {
+	infos, err := s.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for idx, fi := range infos {
+		names[idx] = fi.Name()
+	}
+	return names, nil
+}
@@ -0,0 +1,148 @@
+// Package storage abstracts the file system operations which debiman
+// uses to publish its output, so that the output can be stored on local
+// disk or in S3-compatible object storage.
+package storage
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Storage stores files underneath a root directory. All paths are file
+// system paths (as on local disk), which implementations other than
+// Local interpret relative to their root directory.
+//
+// Errors can be inspected using os.IsNotExist and os.IsExist.
+type Storage interface {
+	// Write atomically replaces path with the output of write,
+	// gzip-compressed if compress is true (see write.Atomically).
+	Write(path string, compress bool, write func(w io.Writer) error) error
+
+	// WriteWithGz is like Write, but compresses using gzipw, so that
+	// callers can re-use gzip writers (see write.AtomicallyWithGz).
+	WriteWithGz(path string, gzipw *gzip.Writer, write func(w io.Writer) error) error
+
+	// Open opens path for reading, following symlinks.
+	Open(path string) (io.ReadCloser, error)
+
+	// Stat returns information about path, following symlinks.
+	Stat(path string) (os.FileInfo, error)
+
+	// Lstat returns information about path. If path is a symlink,
+	// its mode contains os.ModeSymlink.
+	Lstat(path string) (os.FileInfo, error)
+
+	// ReadDir lists the directory dir, sorted by name, like
+	// OpenDir followed by Readdir(-1).
+	ReadDir(dir string) ([]os.FileInfo, error)
+
+	// OpenDir opens the directory dir for listing its entries in
+	// batches, like os.File.Readdir. The entries are described like
+	// Lstat does, except that in object storage, their modification
+	// times are the times at which they were last written, including
+	// by Chtimes. If dir is a file, Readdir returns an error which
+	// satisfies IsNotDir.
+	OpenDir(dir string) (Dir, error)
+
+	// ReadDirNames returns the names of all entries of the directory
+	// dir, in no particular order. If dir is a file, the returned
+	// error satisfies IsNotDir.
+	ReadDirNames(dir string) ([]string, error)
+
+	// Symlink creates newname as a symlink to oldname, which is
+	// relative to the directory of newname.
+	Symlink(oldname, newname string) error
+
+	// Readlink returns the destination of the symlink name.
+	Readlink(name string) (string, error)
+
+	// Link creates newname as a copy of oldname. On local disk, this
+	// is a hardlink.
+	Link(oldname, newname string) error
+
+	// Chtimes sets the modification time of name. In object
+	// storage, the modification time is stored as metadata, which
+	// can only be set by copying the object onto itself: this
+	// resets its Last-Modified time, which directory listings return
+	// (see OpenDir).
+	Chtimes(name string, mtime time.Time) error
+
+	// MkdirAll creates the directory path and all its parents, if
+	// the implementation has directories.
+	MkdirAll(path string) error
+
+	// RemoveAll removes path and, if it is a directory, everything
+	// it contains.
+	RemoveAll(path string) error
+}
+
+// Dir is a directory opened by Storage.OpenDir.
+type Dir interface {
+	// Readdir returns the next n entries of the directory, or all
+	// remaining entries if n <= 0. At the end of the directory, it
+	// returns io.EOF if n > 0.
+	Readdir(n int) ([]os.FileInfo, error)
+
+	Close() error
+}
+
+// IsNotDir returns whether err indicates that a path is not a
+// directory.
+func IsNotDir(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOTDIR
+}
+
+// Open returns the Storage described by spec, which is either empty
+// (for local disk) or an URL of the form
+//
+//	s3://bucket/prefix?endpoint=https://s3.example.net&region=us-east-1
+//
+// for S3-compatible object storage. The credentials for object storage
+// are read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// environment variables. Paths are stored relative to root.
+func Open(spec, root string) (Storage, error) {
+	if spec == "" {
+		return Local{}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" {
+		return nil, fmt.Errorf("unsupported storage %q: expected an s3:// URL", spec)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("storage %q does not specify a bucket", spec)
+	}
+	s := &S3{
+		Root:            root,
+		Endpoint:        u.Query().Get("endpoint"),
+		Region:          u.Query().Get("region"),
+		Bucket:          u.Host,
+		Prefix:          strings.Trim(u.Path, "/"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+	if s.Endpoint == "" {
+		s.Endpoint = "https://s3.amazonaws.com"
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for storage %q", spec)
+	}
+	return s, nil
+}